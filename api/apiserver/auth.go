@@ -0,0 +1,133 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/pkg/auth"
+)
+
+// resources maps the first segment of a route to the resource name used in
+// authorization policies
+var resources = map[string]string{
+	"service":   "services",
+	"endpoints": "endpoints",
+	"frontend":  "frontends",
+}
+
+// clusterResources belong to the cluster instead of a namespace, their
+// requests are authorized without a namespace
+var clusterResources = map[string]bool{
+	"nodes":   true,
+	"metrics": true,
+}
+
+func resourceForRoute(route string) string {
+	segment := strings.Split(strings.TrimPrefix(route, "/"), "/")[0]
+	if resource, ok := resources[segment]; ok {
+		return resource
+	}
+	return segment
+}
+
+// requestAttributes describes the action of a request on resource
+func requestAttributes(r *http.Request, resource string, vars map[string]string) auth.Attributes {
+	attrs := auth.Attributes{
+		Resource: resource,
+		Name:     vars["name"],
+	}
+	if !clusterResources[resource] {
+		attrs.Namespace = namespaceOf(vars)
+	}
+	switch r.Method {
+	case "GET":
+		attrs.Verb = "get"
+		if attrs.Name == "" {
+			attrs.Verb = "list"
+		}
+	case "POST":
+		attrs.Verb = "create"
+	case "PUT":
+		attrs.Verb = "update"
+	case "PATCH":
+		attrs.Verb = "patch"
+	case "DELETE":
+		attrs.Verb = "delete"
+	default:
+		attrs.Verb = strings.ToLower(r.Method)
+	}
+	return attrs
+}
+
+// authorize authenticates the request and checks the authorizer allows it.
+// Without an authenticator every request is handled as anonymous, without an
+// authorizer every authenticated request is allowed.
+func (s *Server) authorize(r *http.Request, attrs *auth.Attributes) error {
+	attrs.User = auth.Anonymous()
+	if s.Authenticator != nil {
+		user, ok, err := s.Authenticator.AuthenticateRequest(r)
+		if err != nil {
+			return apierrors.NewUnauthorized(err.Error())
+		}
+		if !ok {
+			return apierrors.NewUnauthorized("missing credentials")
+		}
+		attrs.User = user
+	}
+	if s.Authorizer == nil {
+		return nil
+	}
+	if allowed, reason := s.Authorizer.Authorize(*attrs); !allowed {
+		return apierrors.NewForbidden(attrs.Resource, attrs.Name, reason)
+	}
+	return nil
+}
+
+// auditEvent is written as a json line to the audit log for every mutating
+// request, including the denied ones
+type auditEvent struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Groups     []string  `json:"groups,omitempty"`
+	Verb       string    `json:"verb"`
+	Namespace  string    `json:"namespace"`
+	Resource   string    `json:"resource"`
+	Name       string    `json:"name,omitempty"`
+	Code       int       `json:"code"`
+	RemoteAddr string    `json:"remoteAddr"`
+}
+
+func (s *Server) audit(r *http.Request, attrs auth.Attributes, code int) {
+	if s.AuditLog == nil || attrs.ReadOnly() {
+		return
+	}
+	event := auditEvent{
+		Time:       time.Now().UTC(),
+		Verb:       attrs.Verb,
+		Namespace:  attrs.Namespace,
+		Resource:   attrs.Resource,
+		Name:       attrs.Name,
+		Code:       code,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if attrs.User != nil {
+		event.User, event.Groups = attrs.User.Name, attrs.User.Groups
+	}
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	json.NewEncoder(s.AuditLog).Encode(event)
+}
+
+// statusRecorder remembers the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,269 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/twanies/flow/api"
+)
+
+// applyPatch applies a json patch (RFC 6902) or a json merge patch (RFC 7386),
+// depending on patchType, on the json document original.
+func applyPatch(patchType string, original, patch []byte) ([]byte, error) {
+	var doc interface{}
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return nil, err
+	}
+	switch patchType {
+	case api.MergePatchType:
+		var p interface{}
+		if err := json.Unmarshal(patch, &p); err != nil {
+			return nil, fmt.Errorf("invalid merge patch: %v", err)
+		}
+		doc = mergePatch(doc, p)
+	case api.JSONPatchType:
+		var ops []patchOperation
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return nil, fmt.Errorf("invalid json patch: %v", err)
+		}
+		for i, op := range ops {
+			var err error
+			if doc, err = op.apply(doc); err != nil {
+				return nil, fmt.Errorf("json patch operation %d (%s %s): %v", i, op.Op, op.Path, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported patch type %q", patchType)
+	}
+	return json.Marshal(doc)
+}
+
+// mergePatch merges patch into target as described by RFC 7386. Null values in
+// the patch remove the member from the target.
+func mergePatch(target, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetMap, ok := target.(map[string]interface{})
+	if !ok {
+		targetMap = map[string]interface{}{}
+	}
+	for key, value := range patchMap {
+		if value == nil {
+			delete(targetMap, key)
+			continue
+		}
+		targetMap[key] = mergePatch(targetMap[key], value)
+	}
+	return targetMap
+}
+
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+func (op patchOperation) value() (interface{}, error) {
+	if op.Value == nil {
+		return nil, fmt.Errorf("missing value")
+	}
+	var v interface{}
+	err := json.Unmarshal(*op.Value, &v)
+	return v, err
+}
+
+func (op patchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return setValue(doc, path, value, op.Op == "replace")
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if op.Op == "move" {
+			doc, value, err = removeValue(doc, from)
+		} else {
+			value, err = getValue(doc, from)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return setValue(doc, path, value, false)
+	case "test":
+		expected, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		value, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(expected, value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation")
+}
+
+// parsePointer splits a json pointer (RFC 6901) into its reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.Replace(token, "~1", "/", -1)
+		tokens[i] = strings.Replace(token, "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func getValue(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			node = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("cannot traverse into %q", token)
+		}
+	}
+	return node, nil
+}
+
+// setValue adds or replaces the value at path and returns the updated node.
+// Arrays are copied since inserting may reallocate them.
+func setValue(node interface{}, path []string, value interface{}, replace bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, last := path[0], len(path) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+		if last {
+			if replace && !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			n[token] = value
+			return n, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("member %q not found", token)
+		}
+		child, err := setValue(child, path[1:], value, replace)
+		if err != nil {
+			return nil, err
+		}
+		n[token] = child
+		return n, nil
+	case []interface{}:
+		if last && !replace {
+			if token == "-" {
+				return append(n, value), nil
+			}
+			i, err := arrayIndex(token, len(n))
+			if err != nil {
+				return nil, err
+			}
+			out := make([]interface{}, 0, len(n)+1)
+			out = append(out, n[:i]...)
+			out = append(out, value)
+			return append(out, n[i:]...), nil
+		}
+		i, err := arrayIndex(token, len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		child, err := setValue(n[i], path[1:], value, replace)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = child
+		return n, nil
+	}
+	return nil, fmt.Errorf("cannot traverse into %q", token)
+}
+
+// removeValue removes the value at path, returning the updated node and the
+// removed value
+func removeValue(node interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+	token, last := path[0], len(path) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("member %q not found", token)
+		}
+		if last {
+			delete(n, token)
+			return n, child, nil
+		}
+		child, removed, err := removeValue(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[token] = child
+		return n, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(n)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			out := make([]interface{}, 0, len(n)-1)
+			out = append(out, n[:i]...)
+			return append(out, n[i+1:]...), n[i], nil
+		}
+		child, removed, err := removeValue(n[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[i] = child
+		return n, removed, nil
+	}
+	return nil, nil, fmt.Errorf("cannot traverse into %q", token)
+}
@@ -0,0 +1,79 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/twanies/flow/api"
+)
+
+const patchOriginal = `{"name":"foo","resourceVersion":3,"addresses":["10.0.0.1"],"ports":[{"name":"a","port":80}]}`
+
+func TestMergePatch(t *testing.T) {
+	patch := `{"addresses":["10.0.0.1","10.0.0.2"],"resourceVersion":null}`
+	expected := `{"name":"foo","addresses":["10.0.0.1","10.0.0.2"],"ports":[{"name":"a","port":80}]}`
+	expectPatch(t, api.MergePatchType, patch, expected)
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		patch    string
+		expected string
+	}{
+		{
+			`[{"op":"add","path":"/addresses/-","value":"10.0.0.2"}]`,
+			`{"name":"foo","resourceVersion":3,"addresses":["10.0.0.1","10.0.0.2"],"ports":[{"name":"a","port":80}]}`,
+		},
+		{
+			`[{"op":"add","path":"/addresses/0","value":"10.0.0.2"}]`,
+			`{"name":"foo","resourceVersion":3,"addresses":["10.0.0.2","10.0.0.1"],"ports":[{"name":"a","port":80}]}`,
+		},
+		{
+			`[{"op":"test","path":"/ports/0/name","value":"a"},{"op":"replace","path":"/ports/0/port","value":8080}]`,
+			`{"name":"foo","resourceVersion":3,"addresses":["10.0.0.1"],"ports":[{"name":"a","port":8080}]}`,
+		},
+		{
+			`[{"op":"remove","path":"/addresses/0"}]`,
+			`{"name":"foo","resourceVersion":3,"addresses":[],"ports":[{"name":"a","port":80}]}`,
+		},
+		{
+			`[{"op":"copy","from":"/ports/0","path":"/ports/-"},{"op":"move","from":"/resourceVersion","path":"/version"}]`,
+			`{"name":"foo","version":3,"addresses":["10.0.0.1"],"ports":[{"name":"a","port":80},{"name":"a","port":80}]}`,
+		},
+	}
+	for _, test := range tests {
+		expectPatch(t, api.JSONPatchType, test.patch, test.expected)
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	for _, patch := range []string{
+		`[{"op":"test","path":"/name","value":"bar"}]`,
+		`[{"op":"replace","path":"/missing","value":1}]`,
+		`[{"op":"remove","path":"/addresses/5"}]`,
+		`[{"op":"add","path":"/addresses/-"}]`,
+		`[{"op":"unknown","path":"/name"}]`,
+	} {
+		if _, err := applyPatch(api.JSONPatchType, []byte(patchOriginal), []byte(patch)); err == nil {
+			t.Errorf("expected patch %s to fail", patch)
+		}
+	}
+}
+
+func expectPatch(t *testing.T, patchType, patch, expected string) {
+	out, err := applyPatch(patchType, []byte(patchOriginal), []byte(patch))
+	if err != nil {
+		t.Fatalf("patch %s failed: %v", patch, err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(expected), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("patch %s: expected %s got %s", patch, expected, out)
+	}
+}
@@ -1,23 +1,45 @@
 package apiserver
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"strings"
+	"reflect"
+	"sync"
 
 	"github.com/gorilla/mux"
 
 	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/pkg/auth"
+	"github.com/twanies/flow/pkg/labels"
 	"github.com/twanies/flow/pkg/registry"
 )
 
 const apiVersion string = "v0.0.1"
 
 type Server struct {
+	// Authenticator identifies the user of a request. When set, requests
+	// without valid credentials are rejected with 401 Unauthorized.
+	Authenticator auth.Authenticator
+
+	// Authorizer decides if the user is allowed to perform the request
+	Authorizer auth.Authorizer
+
+	// AuditLog receives a json line for every mutating request
+	AuditLog io.Writer
+	auditMu  sync.Mutex
+
+	// TLSConfig enables https on the api listener when set
+	TLSConfig *tls.Config
+
 	srv      *http.Server
 	router   *mux.Router
 	l        net.Listener
@@ -25,8 +47,12 @@ type Server struct {
 }
 
 func NewServer(addr string) *Server {
-	registry := registry.NewRegistry()
-	s := &Server{registry: registry}
+	return NewServerWithStore(addr, registry.NewRegistry())
+}
+
+// NewServerWithStore returns a server serving the objects of store
+func NewServerWithStore(addr string, store registry.Register) *Server {
+	s := &Server{registry: store}
 	r := createRouter(s)
 	s.srv = &http.Server{Addr: addr, Handler: r}
 	s.router = r
@@ -48,8 +74,13 @@ func (s *Server) ServeAPI() error {
 	if err != nil {
 		return err
 	}
+	scheme := "http"
+	if s.TLSConfig != nil {
+		s.l = tls.NewListener(s.l, s.TLSConfig)
+		scheme = "https"
+	}
 	go func() {
-		log.Printf("api available on http://localhost%s", s.srv.Addr)
+		log.Printf("api available on %s://localhost%s", scheme, s.srv.Addr)
 		if err := s.Serve(); err != nil {
 			log.Println(err)
 		}
@@ -70,13 +101,16 @@ func (s *Server) getVersion(w http.ResponseWriter, r *http.Request, vars map[str
 
 func (s *Server) postCreateService(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
-		return errors.New("missing params")
+		return apierrors.NewBadRequest("missing params")
 	}
 	svc := api.Service{}
 	if err := json.NewDecoder(r.Body).Decode(&svc); err != nil {
-		return fmt.Errorf("failed to decode the response body: %v", err)
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to decode the request body: %v", err))
 	}
 	defer r.Body.Close()
+	if err := matchNamespace(&svc.Namespace, namespaceOf(vars)); err != nil {
+		return err
+	}
 	service, err := s.registry.CreateService(&svc)
 	if err != nil {
 		return err
@@ -86,31 +120,104 @@ func (s *Server) postCreateService(w http.ResponseWriter, r *http.Request, vars
 
 func (s *Server) getService(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
-		return errors.New("missin params")
+		return apierrors.NewBadRequest("missing params")
 	}
 	name := vars["name"]
-	service, err := s.registry.GetService("/flow/services/" + name)
+	service, err := s.registry.GetService(namespaceOf(vars), name)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, service)
+}
+
+// putUpdateService replaces the service. The body must contain the
+// resourceVersion returned by GET, a stale version results in 409 Conflict.
+func (s *Server) putUpdateService(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	svc := api.Service{}
+	if err := json.NewDecoder(r.Body).Decode(&svc); err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to decode the request body: %v", err))
+	}
+	defer r.Body.Close()
+	if err := matchName(&svc.Name, vars["name"]); err != nil {
+		return err
+	}
+	if err := matchNamespace(&svc.Namespace, namespaceOf(vars)); err != nil {
+		return err
+	}
+	service, err := s.registry.UpdateService(&svc)
 	if err != nil {
 		return err
 	}
 	return writeJSON(w, http.StatusOK, service)
 }
 
+// patchService applies a json patch or json merge patch to the service. Unless
+// the patch sets the resourceVersion, the patch is retried when the service was
+// changed concurrently.
+func (s *Server) patchService(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	patchType, patch, err := readPatch(r)
+	if err != nil {
+		return err
+	}
+	namespace, name := namespaceOf(vars), vars["name"]
+	for retry := 0; ; retry++ {
+		current, err := s.registry.GetService(namespace, name)
+		if err != nil {
+			return err
+		}
+		svc := api.Service{}
+		if err := patchObject(current, &svc, patchType, patch); err != nil {
+			return err
+		}
+		if svc.Name != current.Name || svc.Namespace != current.Namespace {
+			return apierrors.NewBadRequest("the name and namespace of a service cannot be changed")
+		}
+		if reflect.DeepEqual(current, &svc) {
+			// nothing changed, there is no need to notify the watchers
+			return writeJSON(w, http.StatusOK, current)
+		}
+		service, err := s.registry.UpdateService(&svc)
+		if apierrors.IsConflict(err) && svc.ResourceVersion == current.ResourceVersion && retry < maxPatchRetries {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, service)
+	}
+}
+
+// getListServices lists the services, optionally filtered by a label selector
+// passed in the selector query parameter, e.g. "?selector=team=payments,env!=dev"
 func (s *Server) getListServices(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
-	services, err := s.registry.GetServices()
+	selector, err := parseSelector(r)
+	if err != nil {
+		return err
+	}
+	services, err := s.registry.GetServices(namespaceOf(vars))
 	if err != nil {
 		return err
 	}
-	return writeJSON(w, http.StatusOK, services)
+	out := make([]api.Service, 0, len(services))
+	for _, service := range services {
+		if selector.Matches(labels.Set(service.Labels)) {
+			out = append(out, service)
+		}
+	}
+	return writeJSON(w, http.StatusOK, out)
 }
 
 func (s *Server) postCreateEndpoints(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
-		return errors.New("missing params")
+		return apierrors.NewBadRequest("missing params")
 	}
 	endpoints := api.Endpoints{}
 	if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
-		return fmt.Errorf("failed to decode the response body: %v", err)
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to decode the request body: %v", err))
+	}
+	defer r.Body.Close()
+	if err := matchNamespace(&endpoints.Namespace, namespaceOf(vars)); err != nil {
+		return err
 	}
 	out, err := s.registry.CreateEndpoints(&endpoints)
 	if err != nil {
@@ -119,46 +226,347 @@ func (s *Server) postCreateEndpoints(w http.ResponseWriter, r *http.Request, var
 	return writeJSON(w, http.StatusOK, out)
 }
 
+// putUpdateEndpoints replaces the endpoints of a service, see putUpdateService
+func (s *Server) putUpdateEndpoints(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	endpoints := api.Endpoints{}
+	if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to decode the request body: %v", err))
+	}
+	defer r.Body.Close()
+	if err := matchName(&endpoints.Name, vars["name"]); err != nil {
+		return err
+	}
+	if err := matchNamespace(&endpoints.Namespace, namespaceOf(vars)); err != nil {
+		return err
+	}
+	out, err := s.registry.UpdateEndpoints(&endpoints)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+// patchEndpoints applies a patch to the endpoints of a service, see
+// patchService. Use a json patch to add a single address:
+//
+//	[{"op": "add", "path": "/addresses/-", "value": "10.0.0.3"}]
+func (s *Server) patchEndpoints(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	patchType, patch, err := readPatch(r)
+	if err != nil {
+		return err
+	}
+	namespace, name := namespaceOf(vars), vars["name"]
+	for retry := 0; ; retry++ {
+		current, err := s.registry.GetServiceEndpoints(namespace, name)
+		if err != nil {
+			return err
+		}
+		endpoints := api.Endpoints{}
+		if err := patchObject(current, &endpoints, patchType, patch); err != nil {
+			return err
+		}
+		if endpoints.Name != current.Name || endpoints.Namespace != current.Namespace {
+			return apierrors.NewBadRequest("the name and namespace of endpoints cannot be changed")
+		}
+		if reflect.DeepEqual(current, &endpoints) {
+			return writeJSON(w, http.StatusOK, current)
+		}
+		out, err := s.registry.UpdateEndpoints(&endpoints)
+		if apierrors.IsConflict(err) && endpoints.ResourceVersion == current.ResourceVersion && retry < maxPatchRetries {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, out)
+	}
+}
+
 func (s *Server) getServiceEndpoints(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	name := vars["name"]
-	keyspace := "/flow/endpoints/" + name
-	endpoints, err := s.registry.GetServiceEndpoints(keyspace)
+	endpoints, err := s.registry.GetServiceEndpoints(namespaceOf(vars), name)
 	if err != nil {
 		return err
 	}
 	return writeJSON(w, http.StatusOK, endpoints)
 }
 
+// getListEndpoints lists all endpoints, optionally filtered by a label selector
 func (s *Server) getListEndpoints(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
-	allEndpoints, err := s.registry.GetEndpoints()
+	selector, err := parseSelector(r)
 	if err != nil {
 		return err
 	}
-	return writeJSON(w, http.StatusOK, allEndpoints)
+	allEndpoints, err := s.registry.GetEndpoints(namespaceOf(vars))
+	if err != nil {
+		return err
+	}
+	out := make([]api.Endpoints, 0, len(allEndpoints))
+	for _, endpoints := range allEndpoints {
+		if selector.Matches(labels.Set(endpoints.Labels)) {
+			out = append(out, endpoints)
+		}
+	}
+	return writeJSON(w, http.StatusOK, out)
 }
 
 func (s *Server) deleteEndpoints(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	name := vars["name"]
-	if err := s.registry.DeleteEndpoints(name); err != nil {
+	if err := s.registry.DeleteEndpoints(namespaceOf(vars), name); err != nil {
 		return err
 	}
 	return writeJSON(w, http.StatusOK, fmt.Sprintf("%s deleted", name))
 }
 
+// putRenewEndpointLease registers the address of the lease in the endpoints
+// and extends the lease, the address is removed when the lease expires
+func (s *Server) putRenewEndpointLease(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	lease := api.EndpointLease{}
+	if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to decode the request body: %v", err))
+	}
+	defer r.Body.Close()
+	out, err := s.registry.RenewEndpointLease(namespaceOf(vars), vars["name"], &lease)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) deleteEndpointLease(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	address := vars["address"]
+	if err := s.registry.ReleaseEndpointLease(namespaceOf(vars), vars["name"], address); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, fmt.Sprintf("%s released", address))
+}
+
 func (s *Server) deleteService(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	name := vars["name"]
-	if err := s.registry.DeleteService(name); err != nil {
+	if err := s.registry.DeleteService(namespaceOf(vars), name); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, fmt.Sprintf("%s deleted", name))
+}
+
+func (s *Server) postCreateFrontend(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	frontend := api.FrontendSpec{}
+	if err := json.NewDecoder(r.Body).Decode(&frontend); err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to decode the request body: %v", err))
+	}
+	defer r.Body.Close()
+	if err := matchNamespace(&frontend.Namespace, namespaceOf(vars)); err != nil {
+		return err
+	}
+	out, err := s.registry.CreateFrontend(&frontend)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) getFrontend(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	frontend, err := s.registry.GetFrontend(namespaceOf(vars), vars["name"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, frontend)
+}
+
+func (s *Server) putUpdateFrontend(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	frontend := api.FrontendSpec{}
+	if err := json.NewDecoder(r.Body).Decode(&frontend); err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to decode the request body: %v", err))
+	}
+	defer r.Body.Close()
+	if err := matchName(&frontend.Name, vars["name"]); err != nil {
+		return err
+	}
+	if err := matchNamespace(&frontend.Namespace, namespaceOf(vars)); err != nil {
+		return err
+	}
+	out, err := s.registry.UpdateFrontend(&frontend)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) patchFrontend(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	patchType, patch, err := readPatch(r)
+	if err != nil {
+		return err
+	}
+	namespace, name := namespaceOf(vars), vars["name"]
+	for retry := 0; ; retry++ {
+		current, err := s.registry.GetFrontend(namespace, name)
+		if err != nil {
+			return err
+		}
+		frontend := api.FrontendSpec{}
+		if err := patchObject(current, &frontend, patchType, patch); err != nil {
+			return err
+		}
+		if frontend.Name != current.Name || frontend.Namespace != current.Namespace {
+			return apierrors.NewBadRequest("the name and namespace of a frontend cannot be changed")
+		}
+		if reflect.DeepEqual(current, &frontend) {
+			return writeJSON(w, http.StatusOK, current)
+		}
+		out, err := s.registry.UpdateFrontend(&frontend)
+		if apierrors.IsConflict(err) && frontend.ResourceVersion == current.ResourceVersion && retry < maxPatchRetries {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// getListFrontends lists the frontends, optionally filtered by a label selector
+func (s *Server) getListFrontends(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	selector, err := parseSelector(r)
+	if err != nil {
+		return err
+	}
+	frontends, err := s.registry.GetFrontends(namespaceOf(vars))
+	if err != nil {
+		return err
+	}
+	out := make([]api.FrontendSpec, 0, len(frontends))
+	for _, frontend := range frontends {
+		if selector.Matches(labels.Set(frontend.Labels)) {
+			out = append(out, frontend)
+		}
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) deleteFrontend(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	name := vars["name"]
+	if err := s.registry.DeleteFrontend(namespaceOf(vars), name); err != nil {
 		return err
 	}
 	return writeJSON(w, http.StatusOK, fmt.Sprintf("%s deleted", name))
 }
 
+// getListNodes lists the nodes of the cluster together with the services they
+// proxy, optionally filtered by a label selector
+func (s *Server) getListNodes(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	selector, err := parseSelector(r)
+	if err != nil {
+		return err
+	}
+	nodes, err := s.registry.GetNodes()
+	if err != nil {
+		return err
+	}
+	out := make([]api.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if selector.Matches(labels.Set(node.Labels)) {
+			out = append(out, node)
+		}
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) getNode(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	node, err := s.registry.GetNode(vars["name"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, node)
+}
+
+// parseSelector parses the label selector of a list request
+func parseSelector(r *http.Request) (labels.Selector, error) {
+	selector, err := labels.Parse(r.URL.Query().Get("selector"))
+	if err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid selector: %v", err))
+	}
+	return selector, nil
+}
+
+// maxPatchRetries is the number of times a patch is reapplied when the object
+// was modified while patching
+const maxPatchRetries = 3
+
+// readPatch reads the body of a PATCH request together with its patch type
+func readPatch(r *http.Request) (string, []byte, error) {
+	defer r.Body.Close()
+	patchType := r.Header.Get("Content-Type")
+	if patchType != api.JSONPatchType && patchType != api.MergePatchType {
+		return "", nil, apierrors.NewBadRequest(fmt.Sprintf("content type (%s) must be %s or %s", patchType, api.JSONPatchType, api.MergePatchType))
+	}
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", nil, apierrors.NewBadRequest(fmt.Sprintf("failed to read the request body: %v", err))
+	}
+	return patchType, patch, nil
+}
+
+// patchObject applies the patch on the json representation of current and
+// decodes the result into patched
+func patchObject(current, patched interface{}, patchType string, patch []byte) error {
+	original, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	b, err := applyPatch(patchType, original, patch)
+	if err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+	if err := json.Unmarshal(b, patched); err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("patched object is invalid: %v", err))
+	}
+	return nil
+}
+
+// namespaceOf returns the namespace of the request. Routes without a namespace
+// operate on the default namespace.
+func namespaceOf(vars map[string]string) string {
+	if ns := vars["namespace"]; ns != "" {
+		return ns
+	}
+	return api.NamespaceDefault
+}
+
+// matchNamespace defaults the namespace of an object in the request body to the
+// namespace of the route and fails when they differ
+func matchNamespace(namespace *string, routeNamespace string) error {
+	if *namespace == "" {
+		*namespace = routeNamespace
+	}
+	if *namespace != routeNamespace {
+		return apierrors.NewBadRequest(fmt.Sprintf("namespace %q does not match the namespace in the URL (%s)", *namespace, routeNamespace))
+	}
+	return nil
+}
+
+// matchName defaults the name of an object in the request body to the name in
+// the URL and fails when they differ
+func matchName(name *string, urlName string) error {
+	if *name == "" {
+		*name = urlName
+	}
+	if *name != urlName {
+		return apierrors.NewBadRequest(fmt.Sprintf("name %q does not match the name in the URL (%s)", *name, urlName))
+	}
+	return nil
+}
+
 func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	return json.NewEncoder(w).Encode(v)
 }
 
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	expvar.Handler().ServeHTTP(w, r)
+	return nil
+}
+
 func createRouter(s *Server) *mux.Router {
 	r := mux.NewRouter()
 	m := map[string]map[string]httpApifunc{
@@ -167,22 +575,54 @@ func createRouter(s *Server) *mux.Router {
 			"/service":          s.getListServices,
 			"/endpoints/{name}": s.getServiceEndpoints,
 			"/endpoints":        s.getListEndpoints,
+			"/frontend/{name}":  s.getFrontend,
+			"/frontend":         s.getListFrontends,
 		},
 		"POST": {
 			"/service":   s.postCreateService,
 			"/endpoints": s.postCreateEndpoints,
+			"/frontend":  s.postCreateFrontend,
+		},
+		"PUT": {
+			"/service/{name}":         s.putUpdateService,
+			"/endpoints/{name}":       s.putUpdateEndpoints,
+			"/endpoints/{name}/lease": s.putRenewEndpointLease,
+			"/frontend/{name}":        s.putUpdateFrontend,
+		},
+		"PATCH": {
+			"/service/{name}":   s.patchService,
+			"/endpoints/{name}": s.patchEndpoints,
+			"/frontend/{name}":  s.patchFrontend,
 		},
 		"DELETE": {
-			"/service/{name}":   s.deleteService,
-			"/endpoints/{name}": s.deleteEndpoints,
+			"/service/{name}":                   s.deleteService,
+			"/endpoints/{name}":                 s.deleteEndpoints,
+			"/endpoints/{name}/lease/{address}": s.deleteEndpointLease,
+			"/frontend/{name}":                  s.deleteFrontend,
 		},
 	}
 	for method, routes := range m {
 		for route, handler := range routes {
-			f := makeHttpHandler(handler)
+			f := s.makeHttpHandler(resourceForRoute(route), handler)
+			r.Path("/v{version:[0-9.]+}/namespaces/{namespace}" + route).Methods(method).Handler(f)
+			// routes without a namespace use the default namespace
 			r.Path("/v{version:[0-9.]+}" + route).Methods(method).Handler(f)
 		}
 	}
+	// nodes belong to the cluster instead of a namespace
+	nodeRoutes := map[string]httpApifunc{
+		"/nodes":        s.getListNodes,
+		"/nodes/{name}": s.getNode,
+	}
+	for route, handler := range nodeRoutes {
+		r.Path("/v{version:[0-9.]+}" + route).Methods("GET").Handler(s.makeHttpHandler("nodes", handler))
+	}
+	// metrics published by the flow components, authorized as the "metrics"
+	// resource
+	r.Path("/debug/vars").Methods("GET").Handler(s.makeHttpHandler("metrics", s.getMetrics))
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, apierrors.NewNotFound("route", r.URL.Path))
+	})
 	return r
 }
 
@@ -195,41 +635,45 @@ func isReqJson(r *http.Request) error {
 		}
 	}
 	if ct != "application/json" {
-		return fmt.Errorf("content type (%s) must be application/json", ct)
+		return apierrors.NewBadRequest(fmt.Sprintf("content type (%s) must be application/json", ct))
 	}
 	return nil
 }
 
+// httpError writes err as an api.Status. The status code is derived from the
+// type of the error, untyped errors are reported as internal errors.
 func httpError(w http.ResponseWriter, err error) {
-	if err == nil || w == nil {
-		http.Error(w, "unexpected error", http.StatusInternalServerError)
-		return
+	if err == nil {
+		err = errors.New("unexpected error")
 	}
-	statusCode := http.StatusInternalServerError
-	for description, status := range map[string]int{
-		"no results found": http.StatusNotFound,
-		"not authorized":   http.StatusForbidden,
-		"wrong parameter":  http.StatusBadRequest,
-	} {
-		if strings.Contains(err.Error(), description) {
-			statusCode = status
-		}
+	status := apierrors.StatusFor(err)
+	if status.Code == http.StatusInternalServerError {
+		log.Printf("internal error: %v", err)
 	}
-	http.Error(w, err.Error(), statusCode)
-	return
+	writeJSON(w, status.Code, status)
 }
 
-func makeHttpHandler(h httpApifunc) http.HandlerFunc {
+// makeHttpHandler wraps an api function handling requests on resource. Every
+// request is authenticated and authorized before it reaches the api function.
+func (s *Server) makeHttpHandler(resource string, h httpApifunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if r.Method == "POST" {
+		attrs := requestAttributes(r, resource, vars)
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		defer func() { s.audit(r, attrs, rec.code) }()
+
+		if err := s.authorize(r, &attrs); err != nil {
+			httpError(rec, err)
+			return
+		}
+		if r.Method == "POST" || r.Method == "PUT" {
 			if err := isReqJson(r); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				httpError(rec, err)
 				return
 			}
 		}
-		if err := h(w, r, vars); err != nil {
-			httpError(w, err)
+		if err := h(rec, r, vars); err != nil {
+			httpError(rec, err)
 			return
 		}
 	}
@@ -0,0 +1,152 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/api/validation"
+	"github.com/twanies/flow/pkg/auth"
+)
+
+func TestHttpErrorStatusCodes(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{apierrors.NewNotFound("service", "foo"), http.StatusNotFound},
+		{apierrors.NewAlreadyExists("service", "foo"), http.StatusConflict},
+		{apierrors.NewConflict("service", "foo", errors.New("version mismatch")), http.StatusConflict},
+		{apierrors.NewInvalid("service", "foo", validation.ErrorList{validation.NewRequiredError("name")}), 422},
+		{apierrors.NewBadRequest("bad"), http.StatusBadRequest},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		httpError(w, test.err)
+		if w.Code != test.code {
+			t.Errorf("expected status %d for %v got %d", test.code, test.err, w.Code)
+		}
+		status := api.Status{}
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatalf("expected a json error body: %v", err)
+		}
+		if status.Code != test.code {
+			t.Errorf("expected body code %d got %d", test.code, status.Code)
+		}
+	}
+}
+
+type fakeAuthenticator map[string]*auth.User
+
+func (f fakeAuthenticator) AuthenticateRequest(r *http.Request) (*auth.User, bool, error) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return nil, false, nil
+	}
+	user, ok := f[token]
+	if !ok {
+		return nil, false, errors.New("invalid token")
+	}
+	return user, true, nil
+}
+
+func TestAuthorizeAndAudit(t *testing.T) {
+	audit := &bytes.Buffer{}
+	s := &Server{
+		Authenticator: fakeAuthenticator{
+			"alice": &auth.User{Name: "alice"},
+			"bob":   &auth.User{Name: "bob"},
+		},
+		Authorizer: auth.Policy{{User: "alice"}},
+		AuditLog:   audit,
+	}
+	handler := s.makeHttpHandler("services", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		return writeJSON(w, http.StatusOK, "deleted")
+	})
+	tests := []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"mallory", http.StatusUnauthorized},
+		{"bob", http.StatusForbidden},
+		{"alice", http.StatusOK},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("DELETE", "/v0.0.1/service/foo", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", test.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.code {
+			t.Errorf("expected %d for token %q got %d", test.code, test.token, w.Code)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("expected %d audit events got %d", len(tests), len(lines))
+	}
+	event := auditEvent{}
+	if err := json.Unmarshal([]byte(lines[3]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.User != "alice" || event.Verb != "delete" || event.Resource != "services" || event.Code != http.StatusOK {
+		t.Fatalf("unexpected audit event %+v", event)
+	}
+}
+
+func TestMetricsAuthorized(t *testing.T) {
+	s := &Server{
+		Authenticator: fakeAuthenticator{
+			"alice": &auth.User{Name: "alice"},
+			"bob":   &auth.User{Name: "bob"},
+		},
+		Authorizer: auth.Policy{{User: "alice", Resources: []string{"metrics"}}},
+	}
+	router := createRouter(s)
+	tests := []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"bob", http.StatusForbidden},
+		{"alice", http.StatusOK},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/debug/vars", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", test.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("expected %d for token %q got %d", test.code, test.token, w.Code)
+		}
+	}
+}
+
+func TestClusterResourceAttributes(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v0.0.1/nodes/n1", nil)
+	attrs := requestAttributes(r, "nodes", map[string]string{"name": "n1"})
+	if attrs.Namespace != "" {
+		t.Fatalf("expected nodes to have no namespace got %q", attrs.Namespace)
+	}
+	policy := auth.Policy{{User: "alice", Namespaces: []string{api.NamespaceDefault}}}
+	attrs.User = &auth.User{Name: "alice"}
+	if allowed, _ := policy.Authorize(attrs); allowed {
+		t.Fatal("expected a rule of the default namespace not to allow nodes")
+	}
+	attrs = requestAttributes(r, "services", map[string]string{"name": "foo"})
+	if attrs.Namespace != api.NamespaceDefault {
+		t.Fatalf("expected services to default to the default namespace got %q", attrs.Namespace)
+	}
+}
@@ -0,0 +1,242 @@
+// Package client implements a client for the flow API server
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/pkg/version"
+)
+
+// Client talks to the flow API server. Failed requests return an
+// *errors.StatusError decoded from the response.
+type Client struct {
+	// Host is the base URL of the API server, e.g. "http://localhost:5001"
+	Host string
+
+	// Namespace the client operates in, the default namespace when empty
+	Namespace string
+
+	// Token is sent as bearer token when set
+	Token string
+
+	HTTPClient *http.Client
+}
+
+func New(host string) *Client {
+	return &Client{
+		Host:       strings.TrimSuffix(host, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// request describes a single API call
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	contentType string
+	body        interface{}
+
+	// clusterScoped requests, like nodes, are not sent to a namespace
+	clusterScoped bool
+}
+
+func (c *Client) do(req request, out interface{}) error {
+	var body io.Reader
+	if raw, ok := req.body.([]byte); ok {
+		body = bytes.NewReader(raw)
+	} else if req.body != nil {
+		b, err := json.Marshal(req.body)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	u := c.Host + "/v" + version.APIversion
+	if c.Namespace != "" && !req.clusterScoped {
+		u += "/namespaces/" + c.Namespace
+	}
+	u += req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	httpReq, err := http.NewRequest(req.method, u, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		contentType := req.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		status := api.Status{}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || status.Code == 0 {
+			return fmt.Errorf("request failed with status %s", resp.Status)
+		}
+		return &apierrors.StatusError{ErrStatus: status}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func selectorQuery(selector string) url.Values {
+	if selector == "" {
+		return nil
+	}
+	return url.Values{"selector": []string{selector}}
+}
+
+// ListServices returns the services matching the label selector, an empty
+// selector matches all services.
+func (c *Client) ListServices(selector string) ([]api.Service, error) {
+	var services []api.Service
+	err := c.do(request{method: "GET", path: "/service", query: selectorQuery(selector)}, &services)
+	return services, err
+}
+
+func (c *Client) GetService(name string) (*api.Service, error) {
+	service := &api.Service{}
+	err := c.do(request{method: "GET", path: "/service/" + name}, service)
+	return service, err
+}
+
+func (c *Client) CreateService(service *api.Service) (*api.Service, error) {
+	out := &api.Service{}
+	err := c.do(request{method: "POST", path: "/service", body: service}, out)
+	return out, err
+}
+
+func (c *Client) UpdateService(service *api.Service) (*api.Service, error) {
+	out := &api.Service{}
+	err := c.do(request{method: "PUT", path: "/service/" + service.Name, body: service}, out)
+	return out, err
+}
+
+// PatchService patches the service with a json patch or json merge patch
+// depending on patchType.
+func (c *Client) PatchService(name, patchType string, patch []byte) (*api.Service, error) {
+	out := &api.Service{}
+	err := c.do(request{method: "PATCH", path: "/service/" + name, contentType: patchType, body: patch}, out)
+	return out, err
+}
+
+func (c *Client) DeleteService(name string) error {
+	return c.do(request{method: "DELETE", path: "/service/" + name}, nil)
+}
+
+// ListEndpoints returns the endpoints matching the label selector
+func (c *Client) ListEndpoints(selector string) ([]api.Endpoints, error) {
+	var endpoints []api.Endpoints
+	err := c.do(request{method: "GET", path: "/endpoints", query: selectorQuery(selector)}, &endpoints)
+	return endpoints, err
+}
+
+func (c *Client) GetEndpoints(name string) (*api.Endpoints, error) {
+	endpoints := &api.Endpoints{}
+	err := c.do(request{method: "GET", path: "/endpoints/" + name}, endpoints)
+	return endpoints, err
+}
+
+func (c *Client) CreateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error) {
+	out := &api.Endpoints{}
+	err := c.do(request{method: "POST", path: "/endpoints", body: endpoints}, out)
+	return out, err
+}
+
+func (c *Client) UpdateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error) {
+	out := &api.Endpoints{}
+	err := c.do(request{method: "PUT", path: "/endpoints/" + endpoints.Name, body: endpoints}, out)
+	return out, err
+}
+
+func (c *Client) PatchEndpoints(name, patchType string, patch []byte) (*api.Endpoints, error) {
+	out := &api.Endpoints{}
+	err := c.do(request{method: "PATCH", path: "/endpoints/" + name, contentType: patchType, body: patch}, out)
+	return out, err
+}
+
+func (c *Client) DeleteEndpoints(name string) error {
+	return c.do(request{method: "DELETE", path: "/endpoints/" + name}, nil)
+}
+
+// RenewEndpointLease registers the address of the lease in the endpoints of
+// the service, the lease has to be renewed before it expires
+func (c *Client) RenewEndpointLease(name string, lease *api.EndpointLease) (*api.EndpointLease, error) {
+	out := &api.EndpointLease{}
+	err := c.do(request{method: "PUT", path: "/endpoints/" + name + "/lease", body: lease}, out)
+	return out, err
+}
+
+// ReleaseEndpointLease removes the address from the endpoints of the service
+func (c *Client) ReleaseEndpointLease(name, address string) error {
+	return c.do(request{method: "DELETE", path: "/endpoints/" + name + "/lease/" + address}, nil)
+}
+
+// ListFrontends returns the frontends matching the label selector
+func (c *Client) ListFrontends(selector string) ([]api.FrontendSpec, error) {
+	var frontends []api.FrontendSpec
+	err := c.do(request{method: "GET", path: "/frontend", query: selectorQuery(selector)}, &frontends)
+	return frontends, err
+}
+
+func (c *Client) GetFrontend(name string) (*api.FrontendSpec, error) {
+	frontend := &api.FrontendSpec{}
+	err := c.do(request{method: "GET", path: "/frontend/" + name}, frontend)
+	return frontend, err
+}
+
+func (c *Client) CreateFrontend(frontend *api.FrontendSpec) (*api.FrontendSpec, error) {
+	out := &api.FrontendSpec{}
+	err := c.do(request{method: "POST", path: "/frontend", body: frontend}, out)
+	return out, err
+}
+
+func (c *Client) UpdateFrontend(frontend *api.FrontendSpec) (*api.FrontendSpec, error) {
+	out := &api.FrontendSpec{}
+	err := c.do(request{method: "PUT", path: "/frontend/" + frontend.Name, body: frontend}, out)
+	return out, err
+}
+
+func (c *Client) PatchFrontend(name, patchType string, patch []byte) (*api.FrontendSpec, error) {
+	out := &api.FrontendSpec{}
+	err := c.do(request{method: "PATCH", path: "/frontend/" + name, contentType: patchType, body: patch}, out)
+	return out, err
+}
+
+func (c *Client) DeleteFrontend(name string) error {
+	return c.do(request{method: "DELETE", path: "/frontend/" + name}, nil)
+}
+
+// ListNodes returns the nodes of the cluster matching the label selector
+func (c *Client) ListNodes(selector string) ([]api.Node, error) {
+	var nodes []api.Node
+	err := c.do(request{method: "GET", path: "/nodes", query: selectorQuery(selector), clusterScoped: true}, &nodes)
+	return nodes, err
+}
+
+func (c *Client) GetNode(name string) (*api.Node, error) {
+	node := &api.Node{}
+	err := c.do(request{method: "GET", path: "/nodes/" + name, clusterScoped: true}, node)
+	return node, err
+}
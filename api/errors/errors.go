@@ -0,0 +1,143 @@
+// Package errors provides the typed errors returned by the registry and the
+// API server.
+package errors
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/api/validation"
+)
+
+// StatusError is an error that maps to an api.Status
+type StatusError struct {
+	ErrStatus api.Status
+}
+
+func (e *StatusError) Error() string {
+	return e.ErrStatus.Message
+}
+
+// Status returns the api.Status describing the error
+func (e *StatusError) Status() api.Status {
+	return e.ErrStatus
+}
+
+func newStatusError(code int, reason api.StatusReason, kind, name, msg string) *StatusError {
+	status := api.Status{
+		Code:    code,
+		Reason:  reason,
+		Message: msg,
+	}
+	if kind != "" || name != "" {
+		status.Details = &api.StatusDetails{Kind: kind, Name: name}
+	}
+	return &StatusError{status}
+}
+
+// NewNotFound returns an error indicating the object could not be found
+func NewNotFound(kind, name string) error {
+	return newStatusError(http.StatusNotFound, api.StatusReasonNotFound,
+		kind, name, fmt.Sprintf("%s %q not found", kind, name))
+}
+
+// NewAlreadyExists returns an error indicating the object already exists
+func NewAlreadyExists(kind, name string) error {
+	return newStatusError(http.StatusConflict, api.StatusReasonAlreadyExists,
+		kind, name, fmt.Sprintf("%s %q already exists", kind, name))
+}
+
+// NewConflict returns an error indicating the object could not be changed
+// because of a concurrent modification
+func NewConflict(kind, name string, err error) error {
+	return newStatusError(http.StatusConflict, api.StatusReasonConflict,
+		kind, name, fmt.Sprintf("%s %q cannot be updated: %v", kind, name, err))
+}
+
+// NewInvalid returns an error indicating the object failed validation
+func NewInvalid(kind, name string, errs validation.ErrorList) error {
+	e := newStatusError(422, api.StatusReasonInvalid,
+		kind, name, fmt.Sprintf("%s %q is invalid: %v", kind, name, errs))
+	if e.ErrStatus.Details == nil {
+		e.ErrStatus.Details = &api.StatusDetails{}
+	}
+	for _, err := range errs {
+		e.ErrStatus.Details.Causes = append(e.ErrStatus.Details.Causes, api.StatusCause{
+			Type:    string(err.Type),
+			Field:   err.Field,
+			Message: err.Error(),
+		})
+	}
+	return e
+}
+
+// NewBadRequest returns an error indicating the request itself is malformed
+func NewBadRequest(msg string) error {
+	return newStatusError(http.StatusBadRequest, api.StatusReasonBadRequest, "", "", msg)
+}
+
+// NewUnauthorized returns an error indicating the request could not be
+// authenticated
+func NewUnauthorized(msg string) error {
+	return newStatusError(http.StatusUnauthorized, api.StatusReasonUnauthorized, "", "", msg)
+}
+
+// NewForbidden returns an error indicating the user is not allowed to perform
+// the request
+func NewForbidden(kind, name, reason string) error {
+	return newStatusError(http.StatusForbidden, api.StatusReasonForbidden,
+		kind, name, fmt.Sprintf("forbidden: %s", reason))
+}
+
+// NewInternalError wraps an unexpected error
+func NewInternalError(err error) error {
+	return newStatusError(http.StatusInternalServerError, api.StatusReasonInternalError,
+		"", "", fmt.Sprintf("internal error: %v", err))
+}
+
+// StatusFor returns the api.Status of err. Errors which are not a StatusError
+// are reported as internal errors.
+func StatusFor(err error) api.Status {
+	if e, ok := err.(*StatusError); ok {
+		return e.ErrStatus
+	}
+	return NewInternalError(err).(*StatusError).ErrStatus
+}
+
+// ReasonForError returns the reason of err, or an empty reason when err is not
+// a StatusError
+func ReasonForError(err error) api.StatusReason {
+	if e, ok := err.(*StatusError); ok {
+		return e.ErrStatus.Reason
+	}
+	return ""
+}
+
+func IsNotFound(err error) bool {
+	return ReasonForError(err) == api.StatusReasonNotFound
+}
+
+func IsAlreadyExists(err error) bool {
+	return ReasonForError(err) == api.StatusReasonAlreadyExists
+}
+
+func IsConflict(err error) bool {
+	return ReasonForError(err) == api.StatusReasonConflict
+}
+
+func IsInvalid(err error) bool {
+	return ReasonForError(err) == api.StatusReasonInvalid
+}
+
+func IsBadRequest(err error) bool {
+	return ReasonForError(err) == api.StatusReasonBadRequest
+}
+
+func IsUnauthorized(err error) bool {
+	return ReasonForError(err) == api.StatusReasonUnauthorized
+}
+
+func IsForbidden(err error) bool {
+	return ReasonForError(err) == api.StatusReasonForbidden
+}
@@ -1,5 +1,21 @@
 package api
 
+import "time"
+
+// Content types of PATCH requests
+const (
+	JSONPatchType  = "application/json-patch+json"
+	MergePatchType = "application/merge-patch+json"
+)
+
+const (
+	// NamespaceDefault is the namespace of objects which do not specify one
+	NamespaceDefault = "default"
+
+	// NamespaceAll selects the objects of every namespace when listing
+	NamespaceAll = ""
+)
+
 type Version struct {
 	Version    string
 	ApiVersion string
@@ -11,22 +27,208 @@ type Service struct {
 	// to a valid proxy address.
 	Name string `json:"name"`
 
+	// Namespace scopes the name of the service, services in different
+	// namespaces can have the same name. Defaults to NamespaceDefault.
+	Namespace string `json:"namespace,omitempty"`
+
+	// ResourceVersion is the version of the stored service. It is set by the
+	// registry and must be passed back unchanged when updating the service.
+	ResourceVersion uint64 `json:"resourceVersion,omitempty"`
+
+	// Labels are used to organize and select services, e.g. "team=payments"
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations hold arbitrary non identifying metadata
+	Annotations map[string]string `json:"annotations,omitempty"`
+
 	// ports to be claimed and assigned
 	Ports []ServicePort `json:"ports"`
+
+	// Locality lets flow prefer endpoints close to the node proxying the
+	// connection. Without a policy the default of the node is used.
+	Locality *LocalityPolicy `json:"locality,omitempty"`
+
+	// Split divides the connections between subsets of the endpoints, e.g.
+	// to send a small share of the connections to a canary
+	Split *TrafficSplit `json:"split,omitempty"`
+}
+
+const (
+	// LocalityAny balances connections over all endpoints
+	LocalityAny = "Any"
+
+	// LocalityPreferLocal balances connections over the endpoints on the same
+	// node, zone or region as the proxying node, in that order
+	LocalityPreferLocal = "PreferLocal"
+)
+
+// LocalityPolicy describes how the topology of the endpoints is used
+type LocalityPolicy struct {
+	// Mode is either Any, the default, or PreferLocal
+	Mode string `json:"mode"`
+
+	// MinEndpoints is the number of healthy endpoints a locality needs to
+	// receive the connections. Connections spill over to the next locality
+	// when it has less. Defaults to 1.
+	MinEndpoints int `json:"minEndpoints,omitempty"`
+}
+
+// TrafficSplit divides the connections of a service between subsets of its
+// endpoints. Addresses which are in none of the subsets receive no
+// connections, the share of a subset without addresses goes to the other
+// subsets. When no subset with a weight has addresses every address outside of
+// the subsets with weight 0 is used.
+type TrafficSplit struct {
+	Subsets []Subset `json:"subsets"`
+}
+
+// Subset selects endpoints of a service by the labels of their addresses
+type Subset struct {
+	Name string `json:"name"`
+
+	// Selector is a label selector like "version=v2", see
+	// Endpoints.AddressLabels
+	Selector string `json:"selector"`
+
+	// Weight is the share of the connections relative to the weights of the
+	// other subsets, a subset with weight 0 receives no connections
+	Weight int `json:"weight"`
+}
+
+// Topology tells where an endpoint or a flow node runs
+type Topology struct {
+	Node   string `json:"node,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
 }
 
 type ServicePort struct {
 	// name of the port linked with the service
-	Name string
+	Name string `json:"name"`
+
+	// Port needed to be exposed for the service, flow proxies the service on
+	// this port. When zero flow assigns a port from its port range.
+	Port int `json:"port"`
 
-	// Port needed to be exposed for the service
-	Port int
+	// TargetPort is the port exposed by the actual "container or process". When
+	// set endpoints can register their addresses without ports.
+	TargetPort int `json:"targetPort"`
 
-	// TargetPort is the port exposed by the actual "container or process"
-	TargetPort int
+	// TargetPortName selects the endpoint port with this name as the target
+	// port. Without a target port the endpoint port named like the service port
+	// is used.
+	TargetPortName string `json:"targetPortName,omitempty"`
 
 	// Protocol is the IP protocol of the port. UDP" and "TCP"
-	Protocol string
+	Protocol string `json:"protocol"`
+
+	// TLS enables tls termination or sni passthrough of the port
+	TLS *ServiceTLS `json:"tls,omitempty"`
+
+	// ProxyProtocol sends a PROXY protocol header of the given version, "v1"
+	// or "v2", to the endpoints so they see the address of the client.
+	ProxyProtocol string `json:"proxyProtocol,omitempty"`
+
+	// AcceptProxyProtocol reads a PROXY protocol header from every incoming
+	// connection, for when flow itself runs behind a load balancer.
+	AcceptProxyProtocol bool `json:"acceptProxyProtocol,omitempty"`
+
+	// Limits restricts the connections proxied to the port
+	Limits *ConnectionLimits `json:"limits,omitempty"`
+
+	// Timeouts closes connections which are idle or open for too long
+	Timeouts *ConnectionTimeouts `json:"timeouts,omitempty"`
+
+	// Mirror tees the bytes clients send on a share of the connections to
+	// another service, only TCP ports without tls passthrough can be mirrored
+	Mirror *Mirror `json:"mirror,omitempty"`
+}
+
+// Mirror copies traffic to a service in the same namespace, e.g. a new version
+// under test. Mirrored traffic is sent on a best effort basis, the responses of
+// the mirror are discarded and a slow or failing mirror never delays the
+// primary service.
+type Mirror struct {
+	Service string `json:"service"`
+
+	// ServicePort is the name of the port of the mirror service, defaults to
+	// the name of the mirrored port
+	ServicePort string `json:"servicePort,omitempty"`
+
+	// Percent of the requests, or connections, which are mirrored
+	Percent int `json:"percent"`
+}
+
+// ConnectionTimeouts of a service port. A zero value disables the timeout.
+type ConnectionTimeouts struct {
+	// IdleTimeoutSeconds closes a connection when no data is sent in either
+	// direction for the duration
+	IdleTimeoutSeconds int `json:"idleTimeoutSeconds,omitempty"`
+
+	// MaxLifetimeSeconds closes a connection after the duration, whether it is
+	// in use or not
+	MaxLifetimeSeconds int `json:"maxLifetimeSeconds,omitempty"`
+}
+
+const (
+	// OverLimitReject closes connections over the limits right away
+	OverLimitReject = "Reject"
+
+	// OverLimitQueue holds connections over the limits until they fit in or
+	// the queue timeout expires
+	OverLimitQueue = "Queue"
+)
+
+// ConnectionLimits of a service port. A zero value disables the limit.
+type ConnectionLimits struct {
+	// MaxConnections is the maximum number of concurrent connections
+	MaxConnections int `json:"maxConnections,omitempty"`
+
+	// MaxConnectionsPerClient is the maximum number of concurrent connections
+	// from a single client ip
+	MaxConnectionsPerClient int `json:"maxConnectionsPerClient,omitempty"`
+
+	// ConnectionsPerSecond is the rate new connections are accepted at, Burst
+	// connections can be accepted at once. Burst defaults to the rate rounded
+	// up.
+	ConnectionsPerSecond float64 `json:"connectionsPerSecond,omitempty"`
+	Burst                int     `json:"burst,omitempty"`
+
+	// OverLimit is either Reject, the default, or Queue
+	OverLimit string `json:"overLimit,omitempty"`
+
+	// QueueTimeoutSeconds is the time a connection is queued before it is
+	// rejected, defaults to 10 seconds.
+	QueueTimeoutSeconds int `json:"queueTimeoutSeconds,omitempty"`
+}
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+const (
+	// TLSTerminate decrypts connections at flow, the endpoints receive plaintext
+	TLSTerminate = "Terminate"
+
+	// TLSPassthrough routes connections arriving at the shared sni port by
+	// their server name without decrypting them
+	TLSPassthrough = "Passthrough"
+)
+
+// ServiceTLS describes how flow handles tls connections to a service port
+type ServiceTLS struct {
+	// Mode is either Terminate or Passthrough
+	Mode string `json:"mode"`
+
+	// CertFile and KeyFile are the certificate served when terminating, the
+	// files are read on the flow nodes and reloaded when they change.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+
+	// ServerNames routed to the port in Passthrough mode. A name starting with
+	// "*." matches every name of the domain.
+	ServerNames []string `json:"serverNames,omitempty"`
 }
 
 // FrontendSpec lets us map HTTP requests to a specific service.
@@ -35,6 +237,24 @@ type ServicePort struct {
 // You can map "/v1/api" to a specific service. Flow wil handle the loadbalancing
 // between the service endpoints.
 type FrontendSpec struct {
+	// Name and Namespace identify the frontend in the registry
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+
+	// ResourceVersion is the version of the stored frontend, see
+	// Service.ResourceVersion
+	ResourceVersion uint64 `json:"resourceVersion,omitempty"`
+
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Service the requests are proxied to, in the namespace of the frontend
+	Service string `json:"service,omitempty"`
+
+	// ServicePort is the name of the service port, it can be omitted when the
+	// service has a single port
+	ServicePort string `json:"servicePort,omitempty"`
+
 	// HTTP scheme of the request that needs to be proxied. "HTTP" and "HTTPS"
 	Scheme string `json:"scheme"`
 
@@ -43,8 +263,76 @@ type FrontendSpec struct {
 	// TargetPath wil join the root "/"
 	TargetPath string `json:"targetPath"`
 
-	// Route is the request URI that wil map to the assigned servicePort
+	// Route is the request URI that wil map to the assigned servicePort, it is
+	// matched against the request path as set by PathMatch
 	Route string `json:"route"`
+
+	// PathMatch is either Prefix, the default, matching the route and the paths
+	// below it, Exact matching only the route itself or Regex matching the
+	// paths which match the route as a whole. The TargetPath of a Regex route
+	// can refer to its groups, e.g. "/users/$1", and defaults to the request
+	// path.
+	PathMatch string `json:"pathMatch,omitempty"`
+
+	// Hosts served by the frontend, matched against the Host header without
+	// its port. A host starting with "*." matches every host of the domain.
+	// A frontend without hosts serves every host.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Methods served by the frontend, e.g. "GET". A frontend without methods
+	// serves every method.
+	Methods []string `json:"methods,omitempty"`
+
+	// Headers the requests need to carry to match the frontend
+	Headers []HeaderMatch `json:"headers,omitempty"`
+
+	// RequestHeaders changes the headers sent to the endpoints and
+	// ResponseHeaders the headers returned to the client
+	RequestHeaders  *HeaderRewrite `json:"requestHeaders,omitempty"`
+	ResponseHeaders *HeaderRewrite `json:"responseHeaders,omitempty"`
+
+	// Priority picks the frontend serving a request matched by several
+	// frontends, the highest priority wins. Frontends of the same priority
+	// are ordered by
+	//  - exact hosts, then wildcard hosts, then frontends without hosts
+	//  - Exact paths, then Regex paths, then Prefix paths, longest first
+	//  - the number of methods and headers conditions, most first
+	//  - namespace and name
+	Priority int `json:"priority,omitempty"`
+
+	// Mirror sends a copy of a share of the requests to another service
+	Mirror *Mirror `json:"mirror,omitempty"`
+}
+
+const (
+	PathPrefix = "Prefix"
+	PathExact  = "Exact"
+	PathRegex  = "Regex"
+)
+
+// HeaderMatch is a header a request needs to carry
+type HeaderMatch struct {
+	Name string `json:"name"`
+
+	// Value is the value of the header, or a regular expression matching the
+	// whole value when Regex is set. Without a value any request carrying the
+	// header matches.
+	Value string `json:"value,omitempty"`
+	Regex bool   `json:"regex,omitempty"`
+}
+
+// HeaderRewrite changes the headers of a request or a response. The headers
+// are removed first, then set and finally added. Setting the "Host" header of
+// a request changes the host sent to the endpoints.
+type HeaderRewrite struct {
+	// Set replaces the values of the headers
+	Set map[string]string `json:"set,omitempty"`
+
+	// Add appends a value to the headers
+	Add map[string]string `json:"add,omitempty"`
+
+	// Remove deletes the headers
+	Remove []string `json:"remove,omitempty"`
 }
 
 type EndpointPort struct {
@@ -54,7 +342,116 @@ type EndpointPort struct {
 
 // Endpoints for a service
 type Endpoints struct {
-	Name      string         `json:"name"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+
+	// ResourceVersion is the version of the stored endpoints, see
+	// Service.ResourceVersion
+	ResourceVersion uint64 `json:"resourceVersion,omitempty"`
+
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
 	Addresses []string       `json:"addresses"`
 	Ports     []EndpointPort `json:"ports"`
+
+	// Topology of the addresses, keyed by address
+	Topology map[string]Topology `json:"topology,omitempty"`
+
+	// AddressLabels are the labels of the addresses, keyed by address, the
+	// subsets of a traffic split select addresses by them
+	AddressLabels map[string]map[string]string `json:"addressLabels,omitempty"`
+}
+
+// EndpointLease registers a single address of the endpoints of a service for
+// a limited time. The address is removed from the endpoints when the lease is
+// not renewed before it expires.
+type EndpointLease struct {
+	Address string `json:"address"`
+
+	// Ports are added to the endpoints when they are missing, a port which is
+	// registered with another port number is rejected.
+	Ports []EndpointPort `json:"ports,omitempty"`
+
+	// Topology of the address
+	Topology *Topology `json:"topology,omitempty"`
+
+	// Labels of the address, see Endpoints.AddressLabels
+	Labels map[string]string `json:"labels,omitempty"`
+
+	TTLSeconds int `json:"ttlSeconds"`
+
+	// Expires is set by the registry when the lease is renewed
+	Expires time.Time `json:"expires"`
+}
+
+// Node is a flow process taking part in the cluster. Nodes register themself
+// in the registry and keep their registration alive with heartbeats, a node
+// missing its heartbeats is removed from the cluster.
+type Node struct {
+	Name string `json:"name"`
+
+	// Address is the host clients reach the proxy ports of the node on
+	Address string `json:"address"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Topology of the node, endpoints with the same topology are preferred by
+	// services with the PreferLocal locality
+	Topology Topology `json:"topology"`
+
+	// LastHeartbeat is the time the node last renewed its registration
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+
+	// Services proxied by the node
+	Services []NodeService `json:"services"`
+}
+
+// NodeService is a service port proxied by a node
+type NodeService struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Port      string `json:"port,omitempty"`
+
+	// ProxyPort is the port the service is proxied on, it is the same on
+	// every node of the cluster
+	ProxyPort int `json:"proxyPort"`
+}
+
+// StatusReason is a machine readable description of why a request failed
+type StatusReason string
+
+const (
+	StatusReasonNotFound      StatusReason = "NotFound"
+	StatusReasonAlreadyExists StatusReason = "AlreadyExists"
+	StatusReasonConflict      StatusReason = "Conflict"
+	StatusReasonInvalid       StatusReason = "Invalid"
+	StatusReasonBadRequest    StatusReason = "BadRequest"
+	StatusReasonUnauthorized  StatusReason = "Unauthorized"
+	StatusReasonForbidden     StatusReason = "Forbidden"
+	StatusReasonInternalError StatusReason = "InternalError"
+)
+
+// Status is returned by the API when a request could not be completed
+type Status struct {
+	// HTTP status code of the response
+	Code int `json:"code"`
+
+	Reason  StatusReason   `json:"reason"`
+	Message string         `json:"message"`
+	Details *StatusDetails `json:"details,omitempty"`
+}
+
+// StatusDetails tells which object caused the failure
+type StatusDetails struct {
+	Kind   string        `json:"kind,omitempty"`
+	Name   string        `json:"name,omitempty"`
+	Causes []StatusCause `json:"causes,omitempty"`
+}
+
+// StatusCause describes a single field that failed validation
+type StatusCause struct {
+	Type    string `json:"type"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
@@ -0,0 +1,592 @@
+package validation
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/pkg/labels"
+)
+
+// ErrorType describes why a field failed validation
+type ErrorType string
+
+const (
+	ErrorTypeRequired     ErrorType = "FieldValueRequired"
+	ErrorTypeInvalid      ErrorType = "FieldValueInvalid"
+	ErrorTypeDuplicate    ErrorType = "FieldValueDuplicate"
+	ErrorTypeNotSupported ErrorType = "FieldValueNotSupported"
+)
+
+// Error is a field level validation error
+type Error struct {
+	Type     ErrorType
+	Field    string
+	BadValue interface{}
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Field, e.Type)
+	if e.Type != ErrorTypeRequired {
+		msg += fmt.Sprintf(" '%v'", e.BadValue)
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func NewRequiredError(field string) *Error {
+	return &Error{ErrorTypeRequired, field, "", ""}
+}
+
+func NewInvalidError(field string, value interface{}, detail string) *Error {
+	return &Error{ErrorTypeInvalid, field, value, detail}
+}
+
+func NewDuplicateError(field string, value interface{}) *Error {
+	return &Error{ErrorTypeDuplicate, field, value, ""}
+}
+
+func NewNotSupportedError(field string, value interface{}, supported []string) *Error {
+	detail := "supported values: " + strings.Join(supported, ", ")
+	return &Error{ErrorTypeNotSupported, field, value, detail}
+}
+
+// ErrorList holds the errors of a validated object
+type ErrorList []*Error
+
+func (list ErrorList) Error() string {
+	msgs := make([]string, len(list))
+	for i, err := range list {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Prefix prepends the field path of every error with prefix
+func (list ErrorList) Prefix(prefix string) ErrorList {
+	for _, err := range list {
+		if strings.HasPrefix(err.Field, "[") {
+			err.Field = prefix + err.Field
+		} else {
+			err.Field = prefix + "." + err.Field
+		}
+	}
+	return list
+}
+
+const dnsLabelMaxLength int = 63
+
+var (
+	dnsLabelRegexp     = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
+	dnsSubdomainRegexp = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$")
+
+	supportedProtocols = []string{"TCP", "UDP"}
+	supportedSchemes   = []string{"HTTP", "HTTPS"}
+)
+
+// IsDNSLabel tests for a string that conforms to the definition of a label in
+// DNS (RFC 1123).
+func IsDNSLabel(value string) bool {
+	return len(value) <= dnsLabelMaxLength && dnsLabelRegexp.MatchString(value)
+}
+
+// IsDNSSubdomain tests for a string that conforms to the definition of a
+// subdomain in DNS (RFC 1123).
+func IsDNSSubdomain(value string) bool {
+	return len(value) <= 253 && dnsSubdomainRegexp.MatchString(value)
+}
+
+func isValidPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func isSupported(value string, supported []string) bool {
+	for _, s := range supported {
+		if strings.ToUpper(value) == s {
+			return true
+		}
+	}
+	return false
+}
+
+func validateName(name, namespace string) ErrorList {
+	errs := ErrorList{}
+	if name == "" {
+		errs = append(errs, NewRequiredError("name"))
+	} else if !IsDNSLabel(name) {
+		errs = append(errs, NewInvalidError("name", name, "must be a DNS label"))
+	}
+	if namespace != "" && !IsDNSLabel(namespace) {
+		errs = append(errs, NewInvalidError("namespace", namespace, "must be a DNS label"))
+	}
+	return errs
+}
+
+// totalAnnotationSizeLimit is the maximum size in bytes of all annotations of
+// an object
+const totalAnnotationSizeLimit int = 64 * (1 << 10)
+
+func validateLabels(set map[string]string, field string) ErrorList {
+	errs := ErrorList{}
+	for key, value := range set {
+		if err := labels.ValidateKey(key); err != nil {
+			errs = append(errs, NewInvalidError(field, key, err.Error()))
+		}
+		if err := labels.ValidateValue(value); err != nil {
+			errs = append(errs, NewInvalidError(field+"["+key+"]", value, err.Error()))
+		}
+	}
+	return errs
+}
+
+func validateAnnotations(annotations map[string]string, field string) ErrorList {
+	errs := ErrorList{}
+	size := 0
+	for key, value := range annotations {
+		if err := labels.ValidateKey(key); err != nil {
+			errs = append(errs, NewInvalidError(field, key, err.Error()))
+		}
+		size += len(key) + len(value)
+	}
+	if size > totalAnnotationSizeLimit {
+		errs = append(errs, NewInvalidError(field, size, fmt.Sprintf("annotations may not exceed %d bytes", totalAnnotationSizeLimit)))
+	}
+	return errs
+}
+
+// ValidateService tests if the service is valid to be stored in the registry
+func ValidateService(service *api.Service) ErrorList {
+	errs := validateName(service.Name, service.Namespace)
+	errs = append(errs, validateLabels(service.Labels, "labels")...)
+	errs = append(errs, validateAnnotations(service.Annotations, "annotations")...)
+	if len(service.Ports) == 0 {
+		errs = append(errs, NewRequiredError("ports"))
+	}
+	names := map[string]bool{}
+	for i := range service.Ports {
+		portErrs := validateServicePort(&service.Ports[i], len(service.Ports) > 1, names)
+		errs = append(errs, portErrs.Prefix(fmt.Sprintf("ports[%d]", i))...)
+	}
+	if service.Locality != nil {
+		errs = append(errs, ValidateLocalityPolicy(service.Locality).Prefix("locality")...)
+	}
+	if service.Split != nil {
+		errs = append(errs, validateTrafficSplit(service.Split).Prefix("split")...)
+	}
+	return errs
+}
+
+func validateTrafficSplit(split *api.TrafficSplit) ErrorList {
+	errs := ErrorList{}
+	if len(split.Subsets) == 0 {
+		errs = append(errs, NewRequiredError("subsets"))
+	}
+	names := map[string]bool{}
+	for i, subset := range split.Subsets {
+		field := fmt.Sprintf("subsets[%d]", i)
+		if subset.Name == "" {
+			errs = append(errs, NewRequiredError(field+".name"))
+		} else if !IsDNSLabel(subset.Name) {
+			errs = append(errs, NewInvalidError(field+".name", subset.Name, "must be a DNS label"))
+		} else if names[subset.Name] {
+			errs = append(errs, NewDuplicateError(field+".name", subset.Name))
+		}
+		names[subset.Name] = true
+		if subset.Selector == "" {
+			errs = append(errs, NewRequiredError(field+".selector"))
+		} else if _, err := labels.Parse(subset.Selector); err != nil {
+			errs = append(errs, NewInvalidError(field+".selector", subset.Selector, err.Error()))
+		}
+		if subset.Weight < 0 {
+			errs = append(errs, NewInvalidError(field+".weight", subset.Weight, "cannot be negative"))
+		}
+	}
+	return errs
+}
+
+// ValidateServiceUpdate tests if the service is valid to replace the stored
+// service. Updates must carry the resource version they are based on.
+func ValidateServiceUpdate(service *api.Service) ErrorList {
+	errs := ValidateService(service)
+	if service.ResourceVersion == 0 {
+		errs = append(errs, NewRequiredError("resourceVersion"))
+	}
+	return errs
+}
+
+func validateServicePort(port *api.ServicePort, requireName bool, names map[string]bool) ErrorList {
+	errs := ErrorList{}
+	if port.Name == "" {
+		if requireName {
+			errs = append(errs, NewRequiredError("name"))
+		}
+	} else if !IsDNSLabel(port.Name) {
+		errs = append(errs, NewInvalidError("name", port.Name, "must be a DNS label"))
+	} else if names[port.Name] {
+		errs = append(errs, NewDuplicateError("name", port.Name))
+	}
+	names[port.Name] = true
+
+	// a port of zero lets flow pick the port
+	if port.Port != 0 && !isValidPort(port.Port) {
+		errs = append(errs, NewInvalidError("port", port.Port, "must be between 1 and 65535"))
+	}
+	if port.TargetPort != 0 && !isValidPort(port.TargetPort) {
+		errs = append(errs, NewInvalidError("targetPort", port.TargetPort, "must be between 1 and 65535"))
+	}
+	if port.TargetPortName != "" {
+		if port.TargetPort != 0 {
+			errs = append(errs, NewInvalidError("targetPortName", port.TargetPortName, "may not be set together with targetPort"))
+		} else if !IsDNSLabel(port.TargetPortName) {
+			errs = append(errs, NewInvalidError("targetPortName", port.TargetPortName, "must be a DNS label"))
+		}
+	}
+	if port.Protocol == "" {
+		errs = append(errs, NewRequiredError("protocol"))
+	} else if !isSupported(port.Protocol, supportedProtocols) {
+		errs = append(errs, NewNotSupportedError("protocol", port.Protocol, supportedProtocols))
+	}
+	if port.TLS != nil {
+		errs = append(errs, validateServiceTLS(port.TLS).Prefix("tls")...)
+	}
+	if port.ProxyProtocol != "" && port.ProxyProtocol != api.ProxyProtocolV1 && port.ProxyProtocol != api.ProxyProtocolV2 {
+		errs = append(errs, NewNotSupportedError("proxyProtocol", port.ProxyProtocol, supportedProxyProtocols))
+	}
+	if port.Limits != nil {
+		errs = append(errs, validateConnectionLimits(port.Limits).Prefix("limits")...)
+	}
+	if port.Timeouts != nil {
+		if port.Timeouts.IdleTimeoutSeconds < 0 {
+			errs = append(errs, NewInvalidError("timeouts.idleTimeoutSeconds", port.Timeouts.IdleTimeoutSeconds, "must be positive"))
+		}
+		if port.Timeouts.MaxLifetimeSeconds < 0 {
+			errs = append(errs, NewInvalidError("timeouts.maxLifetimeSeconds", port.Timeouts.MaxLifetimeSeconds, "must be positive"))
+		}
+	}
+	if port.Mirror != nil {
+		if !strings.EqualFold(port.Protocol, "TCP") {
+			errs = append(errs, NewInvalidError("mirror", port.Mirror.Service, "only TCP ports can be mirrored"))
+		} else if port.TLS != nil && port.TLS.Mode == api.TLSPassthrough {
+			errs = append(errs, NewInvalidError("mirror", port.Mirror.Service, "tls passthrough ports cannot be mirrored"))
+		} else {
+			errs = append(errs, validateMirror(port.Mirror).Prefix("mirror")...)
+		}
+	}
+	return errs
+}
+
+func validateMirror(mirror *api.Mirror) ErrorList {
+	errs := ErrorList{}
+	if mirror.Service == "" {
+		errs = append(errs, NewRequiredError("service"))
+	} else if !IsDNSLabel(mirror.Service) {
+		errs = append(errs, NewInvalidError("service", mirror.Service, "must be a DNS label"))
+	}
+	if mirror.ServicePort != "" && !IsDNSLabel(mirror.ServicePort) {
+		errs = append(errs, NewInvalidError("servicePort", mirror.ServicePort, "must be a DNS label"))
+	}
+	if mirror.Percent < 1 || mirror.Percent > 100 {
+		errs = append(errs, NewInvalidError("percent", mirror.Percent, "must be between 1 and 100"))
+	}
+	return errs
+}
+
+func validateConnectionLimits(limits *api.ConnectionLimits) ErrorList {
+	errs := ErrorList{}
+	if limits.MaxConnections < 0 {
+		errs = append(errs, NewInvalidError("maxConnections", limits.MaxConnections, "must be positive"))
+	}
+	if limits.MaxConnectionsPerClient < 0 {
+		errs = append(errs, NewInvalidError("maxConnectionsPerClient", limits.MaxConnectionsPerClient, "must be positive"))
+	}
+	if limits.ConnectionsPerSecond < 0 {
+		errs = append(errs, NewInvalidError("connectionsPerSecond", limits.ConnectionsPerSecond, "must be positive"))
+	}
+	if limits.Burst < 0 {
+		errs = append(errs, NewInvalidError("burst", limits.Burst, "must be positive"))
+	}
+	if limits.QueueTimeoutSeconds < 0 {
+		errs = append(errs, NewInvalidError("queueTimeoutSeconds", limits.QueueTimeoutSeconds, "must be positive"))
+	}
+	if limits.OverLimit != "" && limits.OverLimit != api.OverLimitReject && limits.OverLimit != api.OverLimitQueue {
+		errs = append(errs, NewNotSupportedError("overLimit", limits.OverLimit, supportedOverLimits))
+	}
+	return errs
+}
+
+var (
+	supportedTLSModes       = []string{api.TLSTerminate, api.TLSPassthrough}
+	supportedProxyProtocols = []string{api.ProxyProtocolV1, api.ProxyProtocolV2}
+	supportedOverLimits     = []string{api.OverLimitReject, api.OverLimitQueue}
+	supportedLocalityModes  = []string{api.LocalityAny, api.LocalityPreferLocal}
+)
+
+// ValidateLocalityPolicy tests the locality policy of a service or the default
+// policy of a node
+func ValidateLocalityPolicy(locality *api.LocalityPolicy) ErrorList {
+	errs := ErrorList{}
+	if locality.Mode != "" && locality.Mode != api.LocalityAny && locality.Mode != api.LocalityPreferLocal {
+		errs = append(errs, NewNotSupportedError("mode", locality.Mode, supportedLocalityModes))
+	}
+	if locality.MinEndpoints < 0 {
+		errs = append(errs, NewInvalidError("minEndpoints", locality.MinEndpoints, "cannot be negative"))
+	}
+	return errs
+}
+
+func validateServiceTLS(t *api.ServiceTLS) ErrorList {
+	errs := ErrorList{}
+	switch t.Mode {
+	case api.TLSTerminate:
+		if t.CertFile == "" {
+			errs = append(errs, NewRequiredError("certFile"))
+		}
+		if t.KeyFile == "" {
+			errs = append(errs, NewRequiredError("keyFile"))
+		}
+	case api.TLSPassthrough:
+		if len(t.ServerNames) == 0 {
+			errs = append(errs, NewRequiredError("serverNames"))
+		}
+		names := map[string]bool{}
+		for i, name := range t.ServerNames {
+			field := fmt.Sprintf("serverNames[%d]", i)
+			if !IsDNSSubdomain(strings.TrimPrefix(name, "*.")) {
+				errs = append(errs, NewInvalidError(field, name, "must be a DNS subdomain, optionally prefixed with *."))
+			} else if names[name] {
+				errs = append(errs, NewDuplicateError(field, name))
+			}
+			names[name] = true
+		}
+	case "":
+		errs = append(errs, NewRequiredError("mode"))
+	default:
+		errs = append(errs, NewNotSupportedError("mode", t.Mode, supportedTLSModes))
+	}
+	return errs
+}
+
+// ValidateEndpoints tests if the endpoints are valid to be stored in the
+// registry
+func ValidateEndpoints(endpoints *api.Endpoints) ErrorList {
+	errs := validateName(endpoints.Name, endpoints.Namespace)
+	errs = append(errs, validateLabels(endpoints.Labels, "labels")...)
+	errs = append(errs, validateAnnotations(endpoints.Annotations, "annotations")...)
+	addresses := map[string]bool{}
+	for i, address := range endpoints.Addresses {
+		field := fmt.Sprintf("addresses[%d]", i)
+		if address == "" {
+			errs = append(errs, NewRequiredError(field))
+		} else if net.ParseIP(address) == nil && !IsDNSSubdomain(address) {
+			errs = append(errs, NewInvalidError(field, address, "must be an IP address or a DNS name"))
+		} else if addresses[address] {
+			errs = append(errs, NewDuplicateError(field, address))
+		}
+		addresses[address] = true
+	}
+	for i, port := range endpoints.Ports {
+		field := fmt.Sprintf("ports[%d]", i)
+		if port.Name != "" && !IsDNSLabel(port.Name) {
+			errs = append(errs, NewInvalidError(field+".name", port.Name, "must be a DNS label"))
+		}
+		if !isValidPort(port.Port) {
+			errs = append(errs, NewInvalidError(field+".port", port.Port, "must be between 1 and 65535"))
+		}
+	}
+	for address := range endpoints.Topology {
+		if !addresses[address] {
+			errs = append(errs, NewInvalidError("topology", address, "must be one of the addresses"))
+		}
+	}
+	for address, set := range endpoints.AddressLabels {
+		if !addresses[address] {
+			errs = append(errs, NewInvalidError("addressLabels", address, "must be one of the addresses"))
+		}
+		errs = append(errs, validateLabels(set, "addressLabels["+address+"]")...)
+	}
+	return errs
+}
+
+// ValidateEndpointsUpdate tests if the endpoints are valid to replace the
+// stored endpoints
+func ValidateEndpointsUpdate(endpoints *api.Endpoints) ErrorList {
+	errs := ValidateEndpoints(endpoints)
+	if endpoints.ResourceVersion == 0 {
+		errs = append(errs, NewRequiredError("resourceVersion"))
+	}
+	return errs
+}
+
+// ValidateFrontendSpec tests if the frontend can be mapped to a service
+func ValidateFrontendSpec(frontend *api.FrontendSpec) ErrorList {
+	errs := ErrorList{}
+	if frontend.Scheme == "" {
+		errs = append(errs, NewRequiredError("scheme"))
+	} else if !isSupported(frontend.Scheme, supportedSchemes) {
+		errs = append(errs, NewNotSupportedError("scheme", frontend.Scheme, supportedSchemes))
+	}
+	switch frontend.PathMatch {
+	case "", api.PathPrefix, api.PathExact:
+		if frontend.Route == "" {
+			errs = append(errs, NewRequiredError("route"))
+		} else if !strings.HasPrefix(frontend.Route, "/") {
+			errs = append(errs, NewInvalidError("route", frontend.Route, "must start with /"))
+		}
+	case api.PathRegex:
+		if frontend.Route == "" {
+			errs = append(errs, NewRequiredError("route"))
+		} else if _, err := regexp.Compile(frontend.Route); err != nil {
+			errs = append(errs, NewInvalidError("route", frontend.Route, err.Error()))
+		}
+	default:
+		errs = append(errs, NewNotSupportedError("pathMatch", frontend.PathMatch, supportedPathMatches))
+	}
+	if frontend.TargetPath != "" && !strings.HasPrefix(frontend.TargetPath, "/") {
+		errs = append(errs, NewInvalidError("targetPath", frontend.TargetPath, "must start with /"))
+	}
+	hosts := map[string]bool{}
+	for i, host := range frontend.Hosts {
+		field := fmt.Sprintf("hosts[%d]", i)
+		if !IsDNSSubdomain(strings.TrimPrefix(host, "*.")) {
+			errs = append(errs, NewInvalidError(field, host, "must be a DNS subdomain, optionally prefixed with *."))
+		} else if hosts[host] {
+			errs = append(errs, NewDuplicateError(field, host))
+		}
+		hosts[host] = true
+	}
+	methods := map[string]bool{}
+	for i, method := range frontend.Methods {
+		field := fmt.Sprintf("methods[%d]", i)
+		if !httpMethodRegexp.MatchString(method) {
+			errs = append(errs, NewInvalidError(field, method, "must be an upper case HTTP method"))
+		} else if methods[method] {
+			errs = append(errs, NewDuplicateError(field, method))
+		}
+		methods[method] = true
+	}
+	for i := range frontend.Headers {
+		errs = append(errs, validateHeaderMatch(&frontend.Headers[i]).Prefix(fmt.Sprintf("headers[%d]", i))...)
+	}
+	if frontend.RequestHeaders != nil {
+		errs = append(errs, validateHeaderRewrite(frontend.RequestHeaders).Prefix("requestHeaders")...)
+	}
+	if frontend.ResponseHeaders != nil {
+		errs = append(errs, validateHeaderRewrite(frontend.ResponseHeaders).Prefix("responseHeaders")...)
+	}
+	if frontend.Mirror != nil {
+		errs = append(errs, validateMirror(frontend.Mirror).Prefix("mirror")...)
+	}
+	return errs
+}
+
+var (
+	supportedPathMatches = []string{api.PathPrefix, api.PathExact, api.PathRegex}
+
+	httpMethodRegexp = regexp.MustCompile("^[A-Z]+$")
+	headerNameRegexp = regexp.MustCompile("^[-!#$%&'*+.^_`|~0-9A-Za-z]+$")
+)
+
+func validateHeaderMatch(header *api.HeaderMatch) ErrorList {
+	errs := ErrorList{}
+	if header.Name == "" {
+		errs = append(errs, NewRequiredError("name"))
+	} else if !headerNameRegexp.MatchString(header.Name) {
+		errs = append(errs, NewInvalidError("name", header.Name, "must be an HTTP header name"))
+	}
+	if header.Regex {
+		if _, err := regexp.Compile(header.Value); err != nil {
+			errs = append(errs, NewInvalidError("value", header.Value, err.Error()))
+		}
+	}
+	return errs
+}
+
+func validateHeaderRewrite(rewrite *api.HeaderRewrite) ErrorList {
+	errs := ErrorList{}
+	for name := range rewrite.Set {
+		if !headerNameRegexp.MatchString(name) {
+			errs = append(errs, NewInvalidError("set", name, "must be an HTTP header name"))
+		}
+	}
+	for name := range rewrite.Add {
+		if !headerNameRegexp.MatchString(name) {
+			errs = append(errs, NewInvalidError("add", name, "must be an HTTP header name"))
+		}
+	}
+	for i, name := range rewrite.Remove {
+		if !headerNameRegexp.MatchString(name) {
+			errs = append(errs, NewInvalidError(fmt.Sprintf("remove[%d]", i), name, "must be an HTTP header name"))
+		}
+	}
+	return errs
+}
+
+// ValidateFrontend tests if the frontend can be stored in the registry
+func ValidateFrontend(frontend *api.FrontendSpec) ErrorList {
+	errs := validateName(frontend.Name, frontend.Namespace)
+	errs = append(errs, validateLabels(frontend.Labels, "labels")...)
+	errs = append(errs, validateAnnotations(frontend.Annotations, "annotations")...)
+	if frontend.Service == "" {
+		errs = append(errs, NewRequiredError("service"))
+	} else if !IsDNSLabel(frontend.Service) {
+		errs = append(errs, NewInvalidError("service", frontend.Service, "must be a DNS label"))
+	}
+	if frontend.ServicePort != "" && !IsDNSLabel(frontend.ServicePort) {
+		errs = append(errs, NewInvalidError("servicePort", frontend.ServicePort, "must be a DNS label"))
+	}
+	return append(errs, ValidateFrontendSpec(frontend)...)
+}
+
+// ValidateFrontendUpdate tests if the frontend is valid to replace the stored
+// frontend
+func ValidateFrontendUpdate(frontend *api.FrontendSpec) ErrorList {
+	errs := ValidateFrontend(frontend)
+	if frontend.ResourceVersion == 0 {
+		errs = append(errs, NewRequiredError("resourceVersion"))
+	}
+	return errs
+}
+
+// ValidateNode tests if the node can join the cluster
+func ValidateNode(node *api.Node) ErrorList {
+	errs := ErrorList{}
+	if node.Name == "" {
+		errs = append(errs, NewRequiredError("name"))
+	} else if !IsDNSSubdomain(strings.ToLower(node.Name)) {
+		errs = append(errs, NewInvalidError("name", node.Name, "must be a DNS subdomain"))
+	}
+	if node.Address == "" {
+		errs = append(errs, NewRequiredError("address"))
+	}
+	errs = append(errs, validateLabels(node.Labels, "labels")...)
+	return errs
+}
+
+// ValidateEndpointLease tests if the lease can register its address
+func ValidateEndpointLease(lease *api.EndpointLease) ErrorList {
+	errs := ErrorList{}
+	if lease.Address == "" {
+		errs = append(errs, NewRequiredError("address"))
+	} else if net.ParseIP(lease.Address) == nil && !IsDNSSubdomain(lease.Address) {
+		errs = append(errs, NewInvalidError("address", lease.Address, "must be an IP address or a DNS name"))
+	}
+	for i, port := range lease.Ports {
+		field := fmt.Sprintf("ports[%d]", i)
+		if port.Name != "" && !IsDNSLabel(port.Name) {
+			errs = append(errs, NewInvalidError(field+".name", port.Name, "must be a DNS label"))
+		}
+		if !isValidPort(port.Port) {
+			errs = append(errs, NewInvalidError(field+".port", port.Port, "must be between 1 and 65535"))
+		}
+	}
+	errs = append(errs, validateLabels(lease.Labels, "labels")...)
+	if lease.TTLSeconds <= 0 {
+		errs = append(errs, NewInvalidError("ttlSeconds", lease.TTLSeconds, "must be positive"))
+	}
+	return errs
+}
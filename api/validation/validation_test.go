@@ -0,0 +1,235 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/twanies/flow/api"
+)
+
+func TestValidateService(t *testing.T) {
+	service := &api.Service{
+		Name: "foo",
+		Ports: []api.ServicePort{
+			{Name: "a", Port: 80, TargetPort: 8080, Protocol: "tcp"},
+			{Name: "b", Protocol: "UDP"},
+		},
+	}
+	if errs := ValidateService(service); len(errs) != 0 {
+		t.Fatalf("expected service to be valid: %v", errs)
+	}
+}
+
+func TestValidateServiceErrors(t *testing.T) {
+	tests := map[string]struct {
+		service api.Service
+		field   string
+		errType ErrorType
+	}{
+		"missing name": {
+			api.Service{Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}}},
+			"name", ErrorTypeRequired,
+		},
+		"invalid name": {
+			api.Service{Name: "Foo_bar", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}}},
+			"name", ErrorTypeInvalid,
+		},
+		"missing ports": {
+			api.Service{Name: "foo"},
+			"ports", ErrorTypeRequired,
+		},
+		"duplicate port name": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}, {Name: "a", Protocol: "TCP"}}},
+			"ports[1].name", ErrorTypeDuplicate,
+		},
+		"unnamed port": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}, {Protocol: "TCP"}}},
+			"ports[1].name", ErrorTypeRequired,
+		},
+		"port out of range": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Port: 70000, Protocol: "TCP"}}},
+			"ports[0].port", ErrorTypeInvalid,
+		},
+		"target port out of range": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", TargetPort: -1, Protocol: "TCP"}}},
+			"ports[0].targetPort", ErrorTypeInvalid,
+		},
+		"target port and target port name": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", TargetPort: 80, TargetPortName: "http", Protocol: "TCP"}}},
+			"ports[0].targetPortName", ErrorTypeInvalid,
+		},
+		"invalid label": {
+			api.Service{Name: "foo", Labels: map[string]string{"team": "pay ments"}, Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}}},
+			"labels[team]", ErrorTypeInvalid,
+		},
+		"invalid annotation key": {
+			api.Service{Name: "foo", Annotations: map[string]string{"-owner": "x"}, Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}}},
+			"annotations", ErrorTypeInvalid,
+		},
+		"unknown protocol": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "SCTP"}}},
+			"ports[0].protocol", ErrorTypeNotSupported,
+		},
+		"tls without certificate": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP", TLS: &api.ServiceTLS{Mode: api.TLSTerminate, KeyFile: "key.pem"}}}},
+			"ports[0].tls.certFile", ErrorTypeRequired,
+		},
+		"tls invalid server name": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP", TLS: &api.ServiceTLS{Mode: api.TLSPassthrough, ServerNames: []string{"*.example.com", "foo..com"}}}}},
+			"ports[0].tls.serverNames[1]", ErrorTypeInvalid,
+		},
+		"tls unknown mode": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP", TLS: &api.ServiceTLS{Mode: "Reencrypt"}}}},
+			"ports[0].tls.mode", ErrorTypeNotSupported,
+		},
+		"unknown proxy protocol": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP", ProxyProtocol: "v3"}}},
+			"ports[0].proxyProtocol", ErrorTypeNotSupported,
+		},
+		"negative connection limit": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP", Limits: &api.ConnectionLimits{MaxConnections: -1}}}},
+			"ports[0].limits.maxConnections", ErrorTypeInvalid,
+		},
+		"unknown over limit behavior": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP", Limits: &api.ConnectionLimits{OverLimit: "Drop"}}}},
+			"ports[0].limits.overLimit", ErrorTypeNotSupported,
+		},
+		"negative idle timeout": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP", Timeouts: &api.ConnectionTimeouts{IdleTimeoutSeconds: -5}}}},
+			"ports[0].timeouts.idleTimeoutSeconds", ErrorTypeInvalid,
+		},
+		"unknown locality mode": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}}, Locality: &api.LocalityPolicy{Mode: "Nearest"}},
+			"locality.mode", ErrorTypeNotSupported,
+		},
+		"mirror of a udp port": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "UDP", Mirror: &api.Mirror{Service: "bar", Percent: 10}}}},
+			"ports[0].mirror", ErrorTypeInvalid,
+		},
+		"mirror percent out of range": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP", Mirror: &api.Mirror{Service: "bar", Percent: 101}}}},
+			"ports[0].mirror.percent", ErrorTypeInvalid,
+		},
+		"duplicate subset": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}}, Split: &api.TrafficSplit{Subsets: []api.Subset{
+				{Name: "v1", Selector: "version=v1", Weight: 95}, {Name: "v1", Selector: "version=v2", Weight: 5}}}},
+			"split.subsets[1].name", ErrorTypeDuplicate,
+		},
+		"invalid subset selector": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}}, Split: &api.TrafficSplit{Subsets: []api.Subset{
+				{Name: "v1", Selector: "version in v1", Weight: 95}}}},
+			"split.subsets[0].selector", ErrorTypeInvalid,
+		},
+		"negative subset weight": {
+			api.Service{Name: "foo", Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}}, Split: &api.TrafficSplit{Subsets: []api.Subset{
+				{Name: "v1", Selector: "version=v1", Weight: -1}}}},
+			"split.subsets[0].weight", ErrorTypeInvalid,
+		},
+	}
+	for name, test := range tests {
+		errs := ValidateService(&test.service)
+		if len(errs) != 1 {
+			t.Errorf("%s: expected 1 error got %v", name, errs)
+			continue
+		}
+		if errs[0].Field != test.field || errs[0].Type != test.errType {
+			t.Errorf("%s: expected %s on %s got %s on %s", name, test.errType, test.field, errs[0].Type, errs[0].Field)
+		}
+	}
+}
+
+func TestValidateEndpoints(t *testing.T) {
+	endpoints := &api.Endpoints{
+		Name:      "foo",
+		Addresses: []string{"10.0.0.1", "10.0.0.1", "not a host"},
+		Ports:     []api.EndpointPort{{Name: "a", Port: 0}},
+		Topology:  map[string]api.Topology{"10.0.0.2": {Zone: "a"}},
+
+		AddressLabels: map[string]map[string]string{"10.0.0.1": {"version": "v 2"}},
+	}
+	errs := ValidateEndpoints(endpoints)
+	expected := []string{"addresses[1]", "addresses[2]", "ports[0].port", "topology", "addressLabels[10.0.0.1][version]"}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors got %v", len(expected), errs)
+	}
+	for i, field := range expected {
+		if errs[i].Field != field {
+			t.Errorf("expected error on %s got %s", field, errs[i].Field)
+		}
+	}
+}
+
+func TestValidateFrontendSpec(t *testing.T) {
+	frontend := &api.FrontendSpec{Scheme: "ftp", Route: "v1/api", TargetPath: "/"}
+	errs := ValidateFrontendSpec(frontend)
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors got %v", errs)
+	}
+	frontend = &api.FrontendSpec{Scheme: "http", Route: "/v1/api"}
+	if errs := ValidateFrontendSpec(frontend); len(errs) != 0 {
+		t.Fatalf("expected frontend to be valid: %v", errs)
+	}
+	frontend.Mirror = &api.Mirror{Percent: 0}
+	if errs := ValidateFrontendSpec(frontend); len(errs) != 2 || errs[0].Field != "mirror.service" || errs[1].Field != "mirror.percent" {
+		t.Fatalf("expected the mirror service and percent to be invalid got %v", errs)
+	}
+
+	frontend = &api.FrontendSpec{
+		Scheme:    "http",
+		Route:     "/users/([0-9]+)",
+		PathMatch: api.PathRegex,
+		Hosts:     []string{"example.com", "*.example.com"},
+		Methods:   []string{"GET", "HEAD"},
+		Headers: []api.HeaderMatch{
+			{Name: "X-Canary"},
+			{Name: "User-Agent", Value: ".*Mobile.*", Regex: true},
+		},
+		RequestHeaders:  &api.HeaderRewrite{Set: map[string]string{"Host": "api.internal"}, Remove: []string{"Cookie"}},
+		ResponseHeaders: &api.HeaderRewrite{Add: map[string]string{"X-Served-By": "flow"}},
+		TargetPath:      "/v2/users/$1",
+	}
+	if errs := ValidateFrontendSpec(frontend); len(errs) != 0 {
+		t.Fatalf("expected frontend to be valid: %v", errs)
+	}
+	frontend = &api.FrontendSpec{
+		Scheme:          "http",
+		Route:           "/users/(",
+		PathMatch:       api.PathRegex,
+		Hosts:           []string{"Example.com", "*.example.com", "*.example.com"},
+		Methods:         []string{"get"},
+		Headers:         []api.HeaderMatch{{Value: "1"}, {Name: "X-Id", Value: "[", Regex: true}},
+		RequestHeaders:  &api.HeaderRewrite{Remove: []string{"bad header"}},
+		ResponseHeaders: &api.HeaderRewrite{Set: map[string]string{"": "x"}},
+	}
+	errs = ValidateFrontendSpec(frontend)
+	expected := []string{"route", "hosts[0]", "hosts[2]", "methods[0]", "headers[0].name", "headers[1].value", "requestHeaders.remove[0]", "responseHeaders.set"}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors got %v", len(expected), errs)
+	}
+	for i, field := range expected {
+		if errs[i].Field != field {
+			t.Errorf("expected error on %s got %s", field, errs[i].Field)
+		}
+	}
+	frontend = &api.FrontendSpec{Scheme: "http", Route: "/", PathMatch: "Suffix"}
+	if errs := ValidateFrontendSpec(frontend); len(errs) != 1 || errs[0].Field != "pathMatch" {
+		t.Fatalf("expected the path match to be unsupported got %v", errs)
+	}
+}
+
+func TestValidateFrontend(t *testing.T) {
+	frontend := &api.FrontendSpec{Name: "web", Service: "api", Scheme: "http", Route: "/"}
+	if errs := ValidateFrontend(frontend); len(errs) != 0 {
+		t.Fatalf("expected frontend to be valid: %v", errs)
+	}
+	frontend = &api.FrontendSpec{Scheme: "http", Route: "/"}
+	errs := ValidateFrontend(frontend)
+	expected := []string{"name", "service"}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors got %v", len(expected), errs)
+	}
+	for i, field := range expected {
+		if errs[i].Field != field {
+			t.Errorf("expected error on %s got %s", field, errs[i].Field)
+		}
+	}
+}
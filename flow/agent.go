@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/api/client"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/pkg/tlsutil"
+)
+
+const agentUsage = `usage: flow agent -service name [-port port | -check url] [flags]
+
+Registers the address of the local process in the endpoints of a service and
+keeps it registered while the process is healthy. The address is removed on
+SIGTERM or SIGINT, and by the flow nodes when the agent stops renewing its
+lease.
+
+flags:
+`
+
+// leaseClient registers the address of the agent, it is implemented by the
+// api client
+type leaseClient interface {
+	RenewEndpointLease(name string, lease *api.EndpointLease) (*api.EndpointLease, error)
+	ReleaseEndpointLease(name, address string) error
+}
+
+// agent keeps the lease of a local endpoint while its health check passes
+type agent struct {
+	client  leaseClient
+	service string
+	lease   api.EndpointLease
+	check   func() error
+
+	// renewed is the last time the lease was renewed, zero when the address
+	// is not registered
+	renewed time.Time
+	now     func() time.Time
+}
+
+func runAgent(args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, agentUsage)
+		fs.PrintDefaults()
+	}
+	host := fs.String("host", "http://localhost:5001", "address of the flow API server")
+	namespace := fs.String("n", api.NamespaceDefault, "namespace of the service")
+	token := fs.String("token", "", "bearer token used to authenticate")
+	caFile := fs.String("cacert", "", "CA used to verify the API server certificate")
+	certFile := fs.String("cert", "", "client certificate used to authenticate")
+	keyFile := fs.String("key", "", "key of the client certificate")
+	service := fs.String("service", "", "name of the service the process implements")
+	address := fs.String("address", "", "address of the process, defaults to the address used to reach the API server")
+	port := fs.Int("port", 0, "port of the process, can be left out when the service sets a target port")
+	portName := fs.String("portname", "", "name of the endpoint port, matching the service port or its target port name")
+	check := fs.String("check", "", "health check, http://host:port/path or tcp://host:port, defaults to connecting to the port")
+	interval := fs.Duration("interval", 5*time.Second, "time between two health checks")
+	ttl := fs.Duration("ttl", 30*time.Second, "time the address stays registered without renewal")
+	node := fs.String("node", "", "node the process runs on")
+	zone := fs.String("zone", "", "zone the process runs in")
+	region := fs.String("region", "", "region the process runs in")
+	addressLabels := fs.String("labels", "", "comma separated labels of the address, e.g. version=v2, selected by traffic splits")
+	fs.Parse(args)
+
+	if *service == "" || (*port == 0 && *check == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *ttl < time.Second || *interval <= 0 || *interval >= *ttl {
+		return errors.New("the interval must be positive and shorter than the ttl of at least 1s")
+	}
+	c := client.New(*host)
+	c.Namespace = *namespace
+	c.Token = *token
+	if *caFile != "" || *certFile != "" {
+		config, err := tlsutil.ClientConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			return err
+		}
+		c.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+	if *address == "" {
+		var err error
+		if *address, err = localAddress(*host); err != nil {
+			return err
+		}
+	}
+	if *check == "" {
+		*check = fmt.Sprintf("tcp://%s", net.JoinHostPort("127.0.0.1", fmt.Sprint(*port)))
+	}
+	healthCheck, err := newHealthCheck(*check, *interval)
+	if err != nil {
+		return err
+	}
+
+	a := &agent{
+		client:  c,
+		service: *service,
+		lease: api.EndpointLease{
+			Address:    *address,
+			TTLSeconds: int(*ttl / time.Second),
+		},
+		check: healthCheck,
+		now:   time.Now,
+	}
+	if *port != 0 {
+		a.lease.Ports = []api.EndpointPort{{Name: *portName, Port: *port}}
+	}
+	if *addressLabels != "" {
+		if a.lease.Labels, err = parseLabels(*addressLabels); err != nil {
+			return err
+		}
+	}
+	if *node != "" || *zone != "" || *region != "" {
+		a.lease.Topology = &api.Topology{Node: *node, Zone: *zone, Region: *region}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := a.sync(); err != nil {
+			log.Printf("agent %s/%s: %v", *service, *address, err)
+		}
+		select {
+		case <-ticker.C:
+		case s := <-sig:
+			log.Printf("received %s, deregistering %s from %s", s, *address, *service)
+			return a.deregister()
+		}
+	}
+}
+
+// sync registers the address while the health check passes and renews the
+// lease when a third of its ttl passed. A failing process is withdrawn until
+// it passes its health check again.
+func (a *agent) sync() error {
+	if err := a.check(); err != nil {
+		if a.renewed.IsZero() {
+			return fmt.Errorf("health check failed: %v", err)
+		}
+		log.Printf("health check of %s failed, withdrawing it from %s: %v", a.lease.Address, a.service, err)
+		return a.deregister()
+	}
+	ttl := time.Duration(a.lease.TTLSeconds) * time.Second
+	if !a.renewed.IsZero() && a.now().Sub(a.renewed) < ttl/3 {
+		return nil
+	}
+	if _, err := a.client.RenewEndpointLease(a.service, &a.lease); err != nil {
+		return err
+	}
+	if a.renewed.IsZero() {
+		log.Printf("registered %s in %s", a.lease.Address, a.service)
+	}
+	a.renewed = a.now()
+	return nil
+}
+
+// deregister removes the address from the endpoints of the service
+func (a *agent) deregister() error {
+	if a.renewed.IsZero() {
+		return nil
+	}
+	if err := a.client.ReleaseEndpointLease(a.service, a.lease.Address); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	a.renewed = time.Time{}
+	return nil
+}
+
+// newHealthCheck returns a check for http:// and https:// urls, passing on a
+// 2xx or 3xx response, and for tcp:// addresses, passing when a connection can
+// be made
+func newHealthCheck(check string, timeout time.Duration) (func() error, error) {
+	u, err := url.Parse(check)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		c := &http.Client{Timeout: timeout}
+		return func() error {
+			resp, err := c.Get(check)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+				return fmt.Errorf("%s returned %s", check, resp.Status)
+			}
+			return nil
+		}, nil
+	case "tcp":
+		return func() error {
+			conn, err := net.DialTimeout("tcp", u.Host, timeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported health check %q, expected an http, https or tcp url", check)
+}
+
+// parseLabels parses labels like "version=v2,track=canary"
+func parseLabels(s string) (map[string]string, error) {
+	set := map[string]string{}
+	for _, label := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(label), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", label)
+		}
+		set[parts[0]] = parts[1]
+	}
+	return set, nil
+}
+
+// localAddress returns the local address used to reach the API server
+func localAddress(host string) (string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", err
+	}
+	hostPort := u.Host
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(hostPort, "80")
+	}
+	conn, err := net.Dial("udp", hostPort)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
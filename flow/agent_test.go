@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+type fakeLeaseClient struct {
+	renewed  int
+	released int
+}
+
+func (c *fakeLeaseClient) RenewEndpointLease(name string, lease *api.EndpointLease) (*api.EndpointLease, error) {
+	c.renewed++
+	return lease, nil
+}
+
+func (c *fakeLeaseClient) ReleaseEndpointLease(name, address string) error {
+	c.released++
+	return nil
+}
+
+func TestAgentSync(t *testing.T) {
+	client := &fakeLeaseClient{}
+	now := time.Unix(1000, 0)
+	var healthErr error
+	a := &agent{
+		client:  client,
+		service: "echo",
+		lease:   api.EndpointLease{Address: "10.0.0.1", TTLSeconds: 30},
+		check:   func() error { return healthErr },
+		now:     func() time.Time { return now },
+	}
+
+	steps := []struct {
+		name     string
+		advance  time.Duration
+		health   error
+		renewed  int
+		released int
+	}{
+		{"register", 0, nil, 1, 0},
+		{"within a third of the ttl", 5 * time.Second, nil, 1, 0},
+		{"renew", 6 * time.Second, nil, 2, 0},
+		{"withdraw", time.Second, errors.New("down"), 2, 1},
+		{"still failing", time.Second, errors.New("down"), 2, 1},
+		{"recover", time.Second, nil, 3, 1},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		healthErr = step.health
+		err := a.sync()
+		if step.health == nil && err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if client.renewed != step.renewed || client.released != step.released {
+			t.Errorf("%s: expected %d renewals and %d releases, got %d and %d",
+				step.name, step.renewed, step.released, client.renewed, client.released)
+		}
+	}
+
+	if err := a.deregister(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.deregister(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.released != 2 {
+		t.Errorf("expected the lease to be released once more, got %d releases", client.released)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	check, err := newHealthCheck(server.URL+"/health", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := check(); err != nil {
+		t.Errorf("expected the check to pass, got %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := check(); err == nil {
+		t.Errorf("expected the check to fail on %d", status)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	check, err = newHealthCheck("tcp://"+listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := check(); err != nil {
+		t.Errorf("expected the check to pass, got %v", err)
+	}
+	listener.Close()
+	if err := check(); err == nil {
+		t.Errorf("expected the check to fail on a closed port")
+	}
+
+	if _, err := newHealthCheck("udp://127.0.0.1:53", time.Second); err == nil {
+		t.Errorf("expected an unsupported check to fail")
+	}
+}
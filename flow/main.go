@@ -1,42 +1,426 @@
 package main
 
 import (
+	"expvar"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/twanies/flow/api"
 	"github.com/twanies/flow/api/apiserver"
+	"github.com/twanies/flow/pkg/auth"
+	"github.com/twanies/flow/pkg/cluster"
+	"github.com/twanies/flow/pkg/config"
+	"github.com/twanies/flow/pkg/discovery"
+	"github.com/twanies/flow/pkg/frontend"
 	"github.com/twanies/flow/pkg/proxy"
+	"github.com/twanies/flow/pkg/registry"
+	"github.com/twanies/flow/pkg/tlsutil"
 	"github.com/twanies/flow/pkg/watch"
 )
 
+var defaults = config.Default()
+
 var (
-	listen       = flag.String("listen", ":9999", "")
-	listenAPI    = flag.String("listenapi", ":5001", "")
-	etcdMachines = flag.String("machines", "h", "")
+	configFile   = flag.String("config", "", "yaml or toml config file, flags set on the command line override it")
+	listen       = flag.String("listen", defaults.Listen.Frontend, "")
+	listenAPI    = flag.String("listenapi", defaults.Listen.API, "")
+	etcdMachines = flag.String("machines", strings.Join(defaults.Store.Machines, ","), "comma separated etcd machines")
+	watchWindow  = flag.Duration("watchwindow", watch.DefaultWindow, "quiet period before a burst of registry changes is applied")
+	watchDelay   = flag.Duration("watchmaxdelay", watch.DefaultMaxDelay, "maximum delay of a registry change while a burst is ongoing")
+	tokenFile    = flag.String("tokenfile", "", "csv file with bearer tokens (token,user,groups...), enables authentication")
+	policyFile   = flag.String("policyfile", "", "file with json authorization rules, one per line")
+	auditLog     = flag.String("auditlog", "", "file where mutating API requests are logged")
+	tlsCert      = flag.String("tlscert", "", "certificate of the api server, enables https")
+	tlsKey       = flag.String("tlskey", "", "key of the api server certificate")
+	clientCA     = flag.String("clientca", "", "CA used to verify client certificates of the api server")
+	etcdCert     = flag.String("etcdcert", "", "client certificate presented to etcd")
+	etcdKey      = flag.String("etcdkey", "", "key of the etcd client certificate")
+	etcdCA       = flag.String("etcdca", "", "CA used to verify the etcd certificate")
+	listenSNI    = flag.String("listensni", "", "shared port routing tls connections to passthrough services by server name")
+	sniProxyProt = flag.Bool("sniproxyprotocol", false, "expect a PROXY protocol header on connections to the sni port")
+	portRange    = flag.String("portrange", fmt.Sprintf("%d-%d", proxy.DefaultPortMin, proxy.DefaultPortMax), "range of the ports assigned to services, min-max with max excluded")
+	logFile      = flag.String("logfile", "", "file the logs are appended to instead of stderr")
+	nodeName     = flag.String("nodename", defaults.Cluster.NodeName, "name of the node in the cluster")
+	nodeAddress  = flag.String("nodeaddress", "", "address clients reach the proxy ports of the node on, defaults to the node name")
+	zone         = flag.String("zone", "", "zone of the node, services preferring local endpoints use the endpoints in the zone")
+	region       = flag.String("region", "", "region of the node")
+	preferLocal  = flag.Bool("preferlocal", false, "prefer local endpoints for services without a locality policy")
+	dockerSocket = flag.String("dockersocket", "", "docker engine API socket, enables the registration of containers with flow labels")
+	discoverFile = flag.String("discoveryfile", "", "file or directory with services and endpoints, runs a standalone proxy without etcd")
 )
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		if err := runAgent(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	flag.Parse()
-	os.Setenv("FLOW_MACHINES", *etcdMachines)
 
-	apiServer := apiserver.NewServer(*listenAPI)
-	apiServer.ServeAPI()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setupLog(cfg.Log); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Discovery.File != "" {
+		if err := runStandalone(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	serviceWatcher := watch.NewServiceWatcher()
-	endpointWatcher := watch.NewEndpointWatcher()
-	loadBalancer := proxy.NewServiceBalancer()
-	proxier := proxy.NewProxier(loadBalancer)
+	store, err := registry.NewRegistryConfig(registry.Config{
+		Machines: cfg.Store.Machines,
+		CertFile: cfg.Store.CertFile,
+		KeyFile:  cfg.Store.KeyFile,
+		CAFile:   cfg.Store.CAFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := config.Reconcile(store, &cfg.Static); err != nil {
+		log.Fatal(err)
+	}
+	go reloadOnHangup(store)
+	go expireLeases(store)
+
+	apiServer := apiserver.NewServerWithStore(cfg.Listen.API, store)
+	if err := setupAuth(apiServer, cfg.Auth, cfg.TLS); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.TLS.CertFile != "" {
+		apiServer.TLSConfig, err = tlsutil.ServerConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := apiServer.ServeAPI(); err != nil {
+		log.Fatal(err)
+	}
+
+	serviceWatcher := watch.NewServiceWatcherWithStore(store)
+	endpointWatcher := watch.NewEndpointWatcherWithStore(store)
+	serviceWatcher.Window, serviceWatcher.MaxDelay = cfg.Watch.Window.Duration, cfg.Watch.MaxDelay.Duration
+	endpointWatcher.Window, endpointWatcher.MaxDelay = cfg.Watch.Window.Duration, cfg.Watch.MaxDelay.Duration
+	expvar.Publish("watch.services", expvar.Func(func() interface{} {
+		return serviceWatcher.Stats()
+	}))
+	expvar.Publish("watch.endpoints", expvar.Func(func() interface{} {
+		return endpointWatcher.Stats()
+	}))
+	frontendWatcher := watch.NewFrontendWatcherWithStore(store)
+	frontendWatcher.Window, frontendWatcher.MaxDelay = cfg.Watch.Window.Duration, cfg.Watch.MaxDelay.Duration
+	expvar.Publish("watch.frontends", expvar.Func(func() interface{} {
+		return frontendWatcher.Stats()
+	}))
+	topology := topologyOf(cfg)
+	loadBalancer, proxier, err := setupProxy(cfg, store)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// register proxier and loadbalancer to the watchers so they can start
 	// watching for changes and update them.
 	serviceWatcher.RegisterHandler(proxier)
 	endpointWatcher.RegisterHandler(loadBalancer)
 
-	// block forever.. for now.
-	select {}
+	router := frontend.NewRouter(loadBalancer)
+	frontendWatcher.RegisterHandler(router)
+	if cfg.Listen.Frontend != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(cfg.Listen.Frontend, router))
+		}()
+	}
+
+	node := api.Node{
+		Name:     cfg.Cluster.NodeName,
+		Address:  cfg.Cluster.Address,
+		Labels:   cfg.Cluster.Labels,
+		Topology: topology,
+	}
+	if node.Address == "" {
+		node.Address = node.Name
+	}
+	member := cluster.NewMember(store, node, proxier)
+	member.Interval = cfg.Cluster.HeartbeatInterval.Duration
+	if err := member.Join(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("node %s joined the cluster", node.Name)
+
+	var docker *discovery.Docker
+	if cfg.Discovery.Docker.Socket != "" {
+		docker = discovery.NewDocker(cfg.Discovery.Docker.Socket, store)
+		docker.Interval = cfg.Discovery.Docker.Interval.Duration
+		docker.Address = node.Address
+		docker.Topology = &topology
+		if err := docker.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// leave the cluster right away on shutdown instead of waiting for the
+	// registration to expire
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	<-sig
+	if docker != nil {
+		if err := docker.Stop(); err != nil {
+			log.Printf("failed to remove the docker containers: %v", err)
+		}
+	}
+	if err := member.Leave(); err != nil {
+		log.Printf("failed to leave the cluster: %v", err)
+	}
+}
+
+// runStandalone proxies the services of the discovery file until flow is
+// stopped, the registry is not used
+func runStandalone(cfg *config.Config) error {
+	loadBalancer, proxier, err := setupProxy(cfg, nil)
+	if err != nil {
+		return err
+	}
+	file := discovery.NewFile(cfg.Discovery.File, proxier, loadBalancer)
+	if err := file.Start(); err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	<-sig
+	return file.Stop()
+}
+
+// balancer picks the endpoints of the services and follows their changes
+type balancer interface {
+	proxy.LoadBalancer
+	watch.EndpointUpdateHandler
+}
+
+// setupProxy returns the load balancer and the proxier of the services. The
+// proxy ports are claimed in store unless it is nil.
+func setupProxy(cfg *config.Config, store proxy.PortStore) (balancer, *proxy.Proxier, error) {
+	loadBalancer := proxy.NewServiceBalancer()
+	loadBalancer.Topology = topologyOf(cfg)
+	loadBalancer.DefaultLocality = cfg.Balancing.Locality
+	proxier := proxy.NewProxierWithPorts(loadBalancer, proxy.NewPortAllocator(cfg.Ports.Min, cfg.Ports.Max), store)
+	proxier.DefaultLimits = cfg.Balancing.Limits
+	proxier.DefaultTimeouts = cfg.Balancing.Timeouts
+	expvar.Publish("proxy.services", expvar.Func(func() interface{} {
+		return proxier.Stats()
+	}))
+	if cfg.Listen.SNI != "" {
+		if err := proxier.ListenSNI(cfg.Listen.SNI, cfg.Listen.SNIProxyProtocol); err != nil {
+			return nil, nil, err
+		}
+	}
+	return loadBalancer, proxier, nil
+}
+
+// topologyOf returns the topology of the node, the node defaults to the node
+// name
+func topologyOf(cfg *config.Config) api.Topology {
+	topology := cfg.Cluster.Topology
+	if topology.Node == "" {
+		topology.Node = cfg.Cluster.NodeName
+	}
+	return topology
+}
+
+// loadConfig reads the config file, when given, and applies the flags set on
+// the command line on top of it
+func loadConfig() (*config.Config, error) {
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen.Frontend = *listen
+		case "listenapi":
+			cfg.Listen.API = *listenAPI
+		case "machines":
+			cfg.Store.Machines = strings.Split(*etcdMachines, ",")
+		case "watchwindow":
+			cfg.Watch.Window.Duration = *watchWindow
+		case "watchmaxdelay":
+			cfg.Watch.MaxDelay.Duration = *watchDelay
+		case "tokenfile":
+			cfg.Auth.TokenFile = *tokenFile
+		case "policyfile":
+			cfg.Auth.PolicyFile = *policyFile
+		case "auditlog":
+			cfg.Auth.AuditLog = *auditLog
+		case "tlscert":
+			cfg.TLS.CertFile = *tlsCert
+		case "tlskey":
+			cfg.TLS.KeyFile = *tlsKey
+		case "clientca":
+			cfg.TLS.ClientCAFile = *clientCA
+		case "etcdcert":
+			cfg.Store.CertFile = *etcdCert
+		case "etcdkey":
+			cfg.Store.KeyFile = *etcdKey
+		case "etcdca":
+			cfg.Store.CAFile = *etcdCA
+		case "listensni":
+			cfg.Listen.SNI = *listenSNI
+		case "sniproxyprotocol":
+			cfg.Listen.SNIProxyProtocol = *sniProxyProt
+		case "portrange":
+			cfg.Ports.Min, cfg.Ports.Max, err = parsePortRange(*portRange)
+		case "logfile":
+			cfg.Log.File = *logFile
+		case "nodename":
+			cfg.Cluster.NodeName = *nodeName
+		case "nodeaddress":
+			cfg.Cluster.Address = *nodeAddress
+		case "zone":
+			cfg.Cluster.Topology.Zone = *zone
+		case "region":
+			cfg.Cluster.Topology.Region = *region
+		case "discoveryfile":
+			cfg.Discovery.File = *discoverFile
+		case "dockersocket":
+			cfg.Discovery.Docker.Socket = *dockerSocket
+		case "preferlocal":
+			cfg.Balancing.Locality = &api.LocalityPolicy{Mode: api.LocalityAny}
+			if *preferLocal {
+				cfg.Balancing.Locality.Mode = api.LocalityPreferLocal
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// reloadOnHangup reconciles the static objects of the config file again on
+// SIGHUP. Other settings only take effect after a restart.
+func reloadOnHangup(store registry.Register) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if *configFile == "" {
+			log.Println("no config file to reload")
+			continue
+		}
+		cfg, err := loadConfig()
+		if err != nil {
+			log.Printf("failed to reload %s: %v", *configFile, err)
+			continue
+		}
+		if err := config.Reconcile(store, &cfg.Static); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("reloaded the static objects of %s", *configFile)
+	}
+}
+
+// leaseCheckInterval is the time between two checks for expired endpoint
+// leases
+const leaseCheckInterval = 5 * time.Second
+
+// expireLeases removes the addresses of agents which stopped renewing their
+// lease
+func expireLeases(store registry.Register) {
+	for now := range time.Tick(leaseCheckInterval) {
+		if err := store.ExpireEndpointLeases(now); err != nil {
+			log.Printf("failed to expire endpoint leases: %v", err)
+		}
+	}
+}
+
+// setupLog sends the logs to the configured file
+func setupLog(c config.Log) error {
+	if c.Timestamps {
+		log.SetFlags(log.LstdFlags)
+	}
+	if c.File == "" {
+		return nil
+	}
+	f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
+
+// setupAuth configures authentication, authorization and audit logging of the
+// api server. Clients authenticate with a certificate signed by the client CA
+// of t or with a token of the token file, whichever are configured.
+func setupAuth(s *apiserver.Server, c config.Auth, t config.TLS) error {
+	var authenticators []auth.Authenticator
+	if t.ClientCAFile != "" {
+		authenticators = append(authenticators, auth.X509{})
+	}
+	if c.TokenFile != "" {
+		tokens, err := auth.NewTokenFile(c.TokenFile)
+		if err != nil {
+			return err
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if len(authenticators) > 0 {
+		s.Authenticator = auth.NewUnionAuthenticator(authenticators...)
+	}
+	if c.PolicyFile != "" {
+		policy, err := auth.NewPolicyFile(c.PolicyFile)
+		if err != nil {
+			return err
+		}
+		s.Authorizer = policy
+	}
+	if c.AuditLog != "" {
+		f, err := os.OpenFile(c.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		s.AuditLog = f
+	}
+	return nil
+}
+
+// parsePortRange parses a port range like "2000-3000"
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected min-max", s)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	if min < 1 || max > 65536 || min >= max {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return min, max, nil
 }
 
 func init() {
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/api/client"
+	"github.com/twanies/flow/pkg/labels"
+	"github.com/twanies/flow/pkg/tlsutil"
+)
+
+var (
+	host      = flag.String("host", "http://localhost:5001", "address of the flow API server")
+	namespace = flag.String("n", api.NamespaceDefault, "namespace of the objects")
+	token     = flag.String("token", os.Getenv("FLOW_TOKEN"), "bearer token used to authenticate, defaults to $FLOW_TOKEN")
+	caFile    = flag.String("cacert", "", "CA certificate used to verify an https API server")
+	certFile  = flag.String("cert", "", "client certificate used to authenticate")
+	keyFile   = flag.String("key", "", "key of the client certificate")
+)
+
+const usage = `usage: flowctl [-host url] [-n namespace] [-token token] [-cacert file] [-cert file -key file] <command> [args]
+
+commands:
+  get services [-l selector] [-o json]     list services
+  get service <name> [-o json]             show a single service
+  get endpoints [-l selector] [-o json]    list endpoints
+  get endpoints <name> [-o json]           show the endpoints of a service
+  get nodes [-l selector] [-o json]        list the nodes of the cluster
+  create service|endpoints -f <file>       create an object from a json file
+  delete service|endpoints <name>          delete an object
+  split <service> <subset>=<weight>...     change the weights of the traffic split of a service
+
+flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c := client.New(*host)
+	c.Namespace = *namespace
+	c.Token = *token
+	if *caFile != "" || *certFile != "" {
+		config, err := tlsutil.ClientConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "flowctl: %v\n", err)
+			os.Exit(1)
+		}
+		c.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "get":
+		err = get(c, flag.Arg(1), flag.Args()[2:])
+	case "create":
+		err = create(c, flag.Arg(1), flag.Args()[2:])
+	case "delete":
+		err = remove(c, flag.Arg(1), flag.Args()[2:])
+	case "split":
+		err = split(c, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "flowctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func get(c *client.Client, resource string, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	selector := fs.String("l", "", "label selector, e.g. team=payments,env!=dev")
+	output := fs.String("o", "", "output format, json prints the raw objects")
+	fs.Parse(args)
+	if _, err := labels.Parse(*selector); err != nil {
+		return err
+	}
+
+	var out interface{}
+	var err error
+	switch resource {
+	case "service", "services":
+		if fs.NArg() > 0 {
+			var service *api.Service
+			service, err = c.GetService(fs.Arg(0))
+			out = []api.Service{*service}
+		} else {
+			out, err = c.ListServices(*selector)
+		}
+	case "endpoints":
+		if fs.NArg() > 0 {
+			var endpoints *api.Endpoints
+			endpoints, err = c.GetEndpoints(fs.Arg(0))
+			out = []api.Endpoints{*endpoints}
+		} else {
+			out, err = c.ListEndpoints(*selector)
+		}
+	case "node", "nodes":
+		if fs.NArg() > 0 {
+			var node *api.Node
+			node, err = c.GetNode(fs.Arg(0))
+			out = []api.Node{*node}
+		} else {
+			out, err = c.ListNodes(*selector)
+		}
+	default:
+		return fmt.Errorf("unknown resource %q", resource)
+	}
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	return printTable(out)
+}
+
+func create(c *client.Client, resource string, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	file := fs.String("f", "", "json file describing the object")
+	fs.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("missing -f flag")
+	}
+	b, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	switch resource {
+	case "service":
+		service := &api.Service{}
+		if err := json.Unmarshal(b, service); err != nil {
+			return err
+		}
+		if _, err := c.CreateService(service); err != nil {
+			return err
+		}
+		fmt.Printf("service %s created\n", service.Name)
+	case "endpoints":
+		endpoints := &api.Endpoints{}
+		if err := json.Unmarshal(b, endpoints); err != nil {
+			return err
+		}
+		if _, err := c.CreateEndpoints(endpoints); err != nil {
+			return err
+		}
+		fmt.Printf("endpoints %s created\n", endpoints.Name)
+	default:
+		return fmt.Errorf("unknown resource %q", resource)
+	}
+	return nil
+}
+
+func remove(c *client.Client, resource string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("delete %s expects a single name", resource)
+	}
+	var err error
+	switch resource {
+	case "service":
+		err = c.DeleteService(args[0])
+	case "endpoints":
+		err = c.DeleteEndpoints(args[0])
+	default:
+		return fmt.Errorf("unknown resource %q", resource)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s deleted\n", resource, args[0])
+	return nil
+}
+
+// split changes the weights of the subsets of the traffic split of a service,
+// e.g. "split api stable=95 canary=5". The subsets have to exist.
+func split(c *client.Client, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("split expects a service and at least one subset=weight")
+	}
+	weights := map[string]int{}
+	for _, arg := range args[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid weight %q, expected subset=weight", arg)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid weight %q: %v", arg, err)
+		}
+		weights[parts[0]] = weight
+	}
+	service, err := c.GetService(args[0])
+	if err != nil {
+		return err
+	}
+	if service.Split == nil {
+		return fmt.Errorf("service %s has no traffic split", service.Name)
+	}
+	var subsets []string
+	for i := range service.Split.Subsets {
+		subset := &service.Split.Subsets[i]
+		if weight, ok := weights[subset.Name]; ok {
+			subset.Weight = weight
+			delete(weights, subset.Name)
+		}
+		subsets = append(subsets, fmt.Sprintf("%s=%d", subset.Name, subset.Weight))
+	}
+	for name := range weights {
+		return fmt.Errorf("service %s has no subset %q", service.Name, name)
+	}
+	// the resource version makes the patch fail when the split changed since
+	patch, err := json.Marshal(map[string]interface{}{
+		"resourceVersion": service.ResourceVersion,
+		"split":           service.Split,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.PatchService(service.Name, api.MergePatchType, patch); err != nil {
+		return err
+	}
+	fmt.Printf("service %s split %s\n", service.Name, strings.Join(subsets, ","))
+	return nil
+}
+
+func printTable(objects interface{}) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	switch objects := objects.(type) {
+	case []api.Service:
+		fmt.Fprintln(w, "NAME\tPORTS\tLABELS")
+		for _, service := range objects {
+			var ports []string
+			for _, port := range service.Ports {
+				ports = append(ports, fmt.Sprintf("%s:%d/%s", port.Name, port.Port, port.Protocol))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", service.Name, join(ports), labels.Set(service.Labels))
+		}
+	case []api.Endpoints:
+		fmt.Fprintln(w, "NAME\tADDRESSES\tPORTS\tLABELS")
+		for _, endpoints := range objects {
+			var ports []string
+			for _, port := range endpoints.Ports {
+				ports = append(ports, fmt.Sprintf("%s:%d", port.Name, port.Port))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", endpoints.Name, join(endpoints.Addresses), join(ports), labels.Set(endpoints.Labels))
+		}
+	case []api.Node:
+		fmt.Fprintln(w, "NAME\tADDRESS\tLAST HEARTBEAT\tSERVICES")
+		for _, node := range objects {
+			var services []string
+			for _, service := range node.Services {
+				services = append(services, fmt.Sprintf("%s/%s:%s=%d", service.Namespace, service.Name, service.Port, service.ProxyPort))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", node.Name, node.Address, node.LastHeartbeat.Format(time.RFC3339), join(services))
+		}
+	}
+	return nil
+}
+
+func join(values []string) string {
+	if len(values) == 0 {
+		return "<none>"
+	}
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "flowauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokenFile(t *testing.T) {
+	path := writeTempFile(t, "# token,user,groups\nabc,alice,ops,payments\n\ndef, bob\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	tokens, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	if _, ok, err := tokens.AuthenticateRequest(r); ok || err != nil {
+		t.Fatal("expected a request without token not to be recognized")
+	}
+	r.Header.Set("Authorization", "Bearer abc")
+	user, ok, err := tokens.AuthenticateRequest(r)
+	if !ok || err != nil {
+		t.Fatalf("expected the token to authenticate: %v", err)
+	}
+	if user.Name != "alice" || !user.InGroup("payments") {
+		t.Fatalf("unexpected user %+v", user)
+	}
+	r.Header.Set("Authorization", "Bearer xyz")
+	if _, _, err := tokens.AuthenticateRequest(r); err == nil {
+		t.Fatal("expected an invalid token to fail")
+	}
+}
+
+func TestTokenFileErrors(t *testing.T) {
+	for _, content := range []string{"abc\n", "abc,alice\nabc,bob\n"} {
+		path := writeTempFile(t, content)
+		if _, err := NewTokenFile(path); err == nil {
+			t.Errorf("expected token file %q to fail", content)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	path := writeTempFile(t, `
+# ops can do everything
+{"group": "ops"}
+{"user": "alice", "namespaces": ["payments"], "verbs": ["get", "list", "update"], "resources": ["services"]}
+{"user": "*", "verbs": ["list"]}
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	policy, err := NewPolicyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &User{Name: "alice"}
+	bob := &User{Name: "bob", Groups: []string{"ops"}}
+	tests := []struct {
+		attrs   Attributes
+		allowed bool
+	}{
+		{Attributes{User: alice, Verb: "update", Namespace: "payments", Resource: "services"}, true},
+		{Attributes{User: alice, Verb: "delete", Namespace: "payments", Resource: "services"}, false},
+		{Attributes{User: alice, Verb: "update", Namespace: "default", Resource: "services"}, false},
+		{Attributes{User: alice, Verb: "list", Namespace: "default", Resource: "endpoints"}, true},
+		{Attributes{User: bob, Verb: "delete", Namespace: "default", Resource: "endpoints"}, true},
+		{Attributes{User: Anonymous(), Verb: "get", Namespace: "default", Resource: "services"}, false},
+		// namespaced rules do not match the resources of the cluster
+		{Attributes{User: alice, Verb: "get", Resource: "services"}, false},
+		{Attributes{User: bob, Verb: "get", Resource: "nodes"}, true},
+	}
+	for _, test := range tests {
+		if allowed, reason := policy.Authorize(test.attrs); allowed != test.allowed {
+			t.Errorf("expected %+v allowed to be %v: %s", test.attrs, test.allowed, reason)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package auth authenticates API requests and authorizes them against a
+// policy.
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// AnonymousUser is the user of requests which carry no credentials
+	AnonymousUser = "system:anonymous"
+
+	// UnauthenticatedGroup is the group of anonymous requests
+	UnauthenticatedGroup = "system:unauthenticated"
+)
+
+// User is the identity of an authenticated request
+type User struct {
+	Name   string
+	Groups []string
+}
+
+// Anonymous returns the user of requests without credentials
+func Anonymous() *User {
+	return &User{Name: AnonymousUser, Groups: []string{UnauthenticatedGroup}}
+}
+
+// InGroup tests if the user is a member of group
+func (u *User) InGroup(group string) bool {
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates a request. It returns false when the request
+// carries no credentials it understands, and an error when the credentials are
+// invalid.
+type Authenticator interface {
+	AuthenticateRequest(r *http.Request) (*User, bool, error)
+}
+
+// unionAuthenticator tries each authenticator in order
+type unionAuthenticator []Authenticator
+
+// NewUnionAuthenticator returns an authenticator which authenticates a request
+// with the first authenticator that recognizes its credentials
+func NewUnionAuthenticator(authenticators ...Authenticator) Authenticator {
+	return unionAuthenticator(authenticators)
+}
+
+func (union unionAuthenticator) AuthenticateRequest(r *http.Request) (*User, bool, error) {
+	for _, a := range union {
+		user, ok, err := a.AuthenticateRequest(r)
+		if err != nil || ok {
+			return user, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+// TokenFile authenticates requests by a static bearer token
+type TokenFile struct {
+	tokens map[string]*User
+}
+
+// NewTokenFile loads the tokens of a csv file. Each line holds a token, the
+// user name and optionally the groups of the user:
+//
+//	# token,user,groups...
+//	31ada4fd-adec-460c-809a-9e56ceb75269,alice,ops,payments
+//
+// Empty lines and lines starting with # are ignored.
+func NewTokenFile(path string) (*TokenFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := map[string]*User{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected token,user[,groups...]", path, n)
+		}
+		if _, exists := tokens[fields[0]]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, n)
+		}
+		tokens[fields[0]] = &User{Name: fields[1], Groups: fields[2:]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &TokenFile{tokens}, nil
+}
+
+func (a *TokenFile) AuthenticateRequest(r *http.Request) (*User, bool, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, false, nil
+	}
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return nil, false, nil
+	}
+	user, ok := a.tokens[strings.TrimSpace(parts[1])]
+	if !ok {
+		return nil, false, fmt.Errorf("invalid bearer token")
+	}
+	return user, true, nil
+}
+
+// X509 authenticates requests by their verified TLS client certificate. The
+// common name of the certificate is the user name and the organizations are
+// the groups of the user. The server must verify client certificates against a
+// client CA for this authenticator to recognize any request.
+type X509 struct{}
+
+func (X509) AuthenticateRequest(r *http.Request) (*User, bool, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil, false, fmt.Errorf("client certificate without common name")
+	}
+	return &User{
+		Name:   cert.Subject.CommonName,
+		Groups: cert.Subject.Organization,
+	}, true, nil
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Attributes describe the action a request wants to perform
+type Attributes struct {
+	User *User
+
+	// Verb is one of get, list, create, update, patch or delete
+	Verb string
+
+	// Namespace is empty for resources of the cluster, like nodes
+	Namespace string
+	Resource  string
+	Name      string
+}
+
+// ReadOnly tests if the request does not modify any object
+func (a Attributes) ReadOnly() bool {
+	return a.Verb == "get" || a.Verb == "list"
+}
+
+// Authorizer decides if a request is allowed
+type Authorizer interface {
+	Authorize(a Attributes) (allowed bool, reason string)
+}
+
+// Rule grants a user or group the verbs on resources in a namespace. Empty
+// lists and "*" match everything. Rules limited to namespaces do not match the
+// resources of the cluster.
+type Rule struct {
+	User       string   `json:"user,omitempty"`
+	Group      string   `json:"group,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Verbs      []string `json:"verbs,omitempty"`
+	Resources  []string `json:"resources,omitempty"`
+}
+
+func matches(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches tests if the rule allows the request
+func (rule Rule) Matches(a Attributes) bool {
+	if a.User == nil {
+		return false
+	}
+	if rule.User != "" && rule.User != "*" && rule.User != a.User.Name {
+		return false
+	}
+	if rule.Group != "" && rule.Group != "*" && !a.User.InGroup(rule.Group) {
+		return false
+	}
+	return matches(rule.Namespaces, a.Namespace) &&
+		matches(rule.Verbs, a.Verb) &&
+		matches(rule.Resources, a.Resource)
+}
+
+// Policy is a list of rules, a request is allowed when any rule matches
+type Policy []Rule
+
+// NewPolicyFile loads a policy from a file with a json rule per line:
+//
+//	{"group": "ops"}
+//	{"user": "alice", "namespaces": ["payments"], "verbs": ["*"], "resources": ["services", "endpoints"]}
+//	{"user": "*", "verbs": ["get", "list"]}
+//
+// Empty lines and lines starting with # are ignored.
+func NewPolicyFile(path string) (Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var policy Policy
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := Rule{}
+		if err := json.Unmarshal([]byte(line), &rule); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if rule.User == "" && rule.Group == "" {
+			return nil, fmt.Errorf("%s:%d: a rule needs a user or a group", path, n)
+		}
+		policy = append(policy, rule)
+	}
+	return policy, scanner.Err()
+}
+
+func (p Policy) Authorize(a Attributes) (bool, string) {
+	for _, rule := range p {
+		if rule.Matches(a) {
+			return true, ""
+		}
+	}
+	user := AnonymousUser
+	if a.User != nil {
+		user = a.User.Name
+	}
+	if a.Namespace == "" {
+		return false, fmt.Sprintf("user %q cannot %s %s", user, a.Verb, a.Resource)
+	}
+	return false, fmt.Sprintf("user %q cannot %s %s in namespace %q", user, a.Verb, a.Resource, a.Namespace)
+}
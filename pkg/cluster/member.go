@@ -0,0 +1,117 @@
+// Package cluster lets flow nodes join a cluster through the registry.
+//
+// Every node registers itself with a heartbeat, a registration which is not
+// renewed expires and the node drops out of the cluster. Proxy ports are
+// claimed in the registry as well, see registry.ClaimProxyPort, so every node
+// proxies a service on the same port and clients can use any node.
+package cluster
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+// DefaultHeartbeatInterval is the time between two heartbeats of a node
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// missedHeartbeats is the number of heartbeats a node can miss before it is
+// removed from the cluster
+const missedHeartbeats = 3
+
+// NodeStore stores the registration of the nodes
+type NodeStore interface {
+	RegisterNode(node *api.Node, ttl time.Duration) error
+	DeleteNode(name string) error
+}
+
+// ServiceLister lists the services proxied by a node, it is implemented by
+// the proxier
+type ServiceLister interface {
+	Services() []api.NodeService
+}
+
+// Member is the registration of the local node in the cluster
+type Member struct {
+	// Interval between two heartbeats, defaults to DefaultHeartbeatInterval
+	Interval time.Duration
+
+	node     api.Node
+	store    NodeStore
+	services ServiceLister
+	now      func() time.Time
+
+	mu   sync.Mutex // protects following
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMember returns the membership of the node. services can be nil for a
+// node which does not proxy.
+func NewMember(store NodeStore, node api.Node, services ServiceLister) *Member {
+	return &Member{
+		Interval: DefaultHeartbeatInterval,
+		node:     node,
+		store:    store,
+		services: services,
+		now:      time.Now,
+	}
+}
+
+// Join registers the node and keeps sending heartbeats until Leave is called
+func (m *Member) Join() error {
+	if err := m.heartbeat(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return nil
+	}
+	m.stop, m.done = make(chan struct{}), make(chan struct{})
+	go m.run(m.stop, m.done)
+	return nil
+}
+
+// Leave stops the heartbeats and removes the node from the cluster
+func (m *Member) Leave() error {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return m.store.DeleteNode(m.node.Name)
+}
+
+func (m *Member) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.heartbeat(); err != nil {
+				log.Printf("failed to send the heartbeat of node %s: %v", m.node.Name, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// heartbeat renews the registration of the node together with the services
+// it proxies
+func (m *Member) heartbeat() error {
+	node := m.node
+	node.LastHeartbeat = m.now().UTC()
+	node.Services = []api.NodeService{}
+	if m.services != nil {
+		node.Services = m.services.Services()
+	}
+	return m.store.RegisterNode(&node, missedHeartbeats*m.Interval)
+}
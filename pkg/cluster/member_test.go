@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+type fakeNodeStore struct {
+	mu    sync.Mutex
+	nodes map[string]api.Node
+	ttl   time.Duration
+	beats int
+}
+
+func (f *fakeNodeStore) RegisterNode(node *api.Node, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[node.Name] = *node
+	f.ttl = ttl
+	f.beats++
+	return nil
+}
+
+func (f *fakeNodeStore) DeleteNode(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.nodes, name)
+	return nil
+}
+
+func (f *fakeNodeStore) heartbeats() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.beats
+}
+
+func (f *fakeNodeStore) node(name string) (api.Node, time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.nodes[name]
+	return node, f.ttl, ok
+}
+
+type fakeServices []api.NodeService
+
+func (f fakeServices) Services() []api.NodeService { return f }
+
+func TestMember(t *testing.T) {
+	store := &fakeNodeStore{nodes: map[string]api.Node{}}
+	services := fakeServices{{Namespace: "default", Name: "api", Port: "http", ProxyPort: 2001}}
+	m := NewMember(store, api.Node{Name: "node-a", Address: "10.0.0.1"}, services)
+	m.Interval = 10 * time.Millisecond
+	if err := m.Join(); err != nil {
+		t.Fatal(err)
+	}
+	node, ttl, ok := store.node("node-a")
+	if !ok {
+		t.Fatal("expected the node to be registered when joining")
+	}
+	if node.LastHeartbeat.IsZero() || len(node.Services) != 1 || node.Services[0].ProxyPort != 2001 {
+		t.Fatalf("expected a heartbeat with the proxied services got %+v", node)
+	}
+	if ttl != 3*m.Interval {
+		t.Fatalf("expected the registration to expire after 3 heartbeats got %v", ttl)
+	}
+	deadline := time.Now().Add(time.Second)
+	for store.heartbeats() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the member to keep sending heartbeats")
+		}
+		time.Sleep(m.Interval)
+	}
+	if err := m.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := store.node("node-a"); ok {
+		t.Fatal("expected the node to be removed when leaving")
+	}
+	beats := store.heartbeats()
+	time.Sleep(3 * m.Interval)
+	if store.heartbeats() != beats {
+		t.Fatal("expected no heartbeats after leaving")
+	}
+}
@@ -0,0 +1,292 @@
+// Package config loads the configuration of the flow daemon from a YAML, TOML
+// or JSON file.
+//
+// The file uses the same field names as the API, so static services,
+// endpoints and frontends are declared exactly like they are posted to the
+// API server:
+//
+//	store:
+//	  machines: ["https://10.0.0.1:4001"]
+//	  caFile: /etc/flow/etcd-ca.pem
+//	ports:
+//	  min: 2000
+//	  max: 3000
+//	static:
+//	  services:
+//	  - name: api
+//	    ports:
+//	    - name: http
+//	      targetPort: 8080
+//	      protocol: TCP
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/api/validation"
+	"github.com/twanies/flow/pkg/cluster"
+	"github.com/twanies/flow/pkg/discovery"
+	"github.com/twanies/flow/pkg/proxy"
+	"github.com/twanies/flow/pkg/util/yamljson"
+	"github.com/twanies/flow/pkg/watch"
+)
+
+// Config of the flow daemon
+type Config struct {
+	Store     Store     `json:"store"`
+	Listen    Listen    `json:"listen"`
+	Ports     Ports     `json:"ports"`
+	Balancing Balancing `json:"balancing"`
+	TLS       TLS       `json:"tls"`
+	Auth      Auth      `json:"auth"`
+	Log       Log       `json:"log"`
+	Watch     Watch     `json:"watch"`
+	Cluster   Cluster   `json:"cluster"`
+	Discovery Discovery `json:"discovery"`
+
+	// Static objects are reconciled into the registry, see Reconcile
+	Static Static `json:"static"`
+}
+
+// Store describes how to connect to etcd
+type Store struct {
+	Machines []string `json:"machines"`
+	CertFile string   `json:"certFile"`
+	KeyFile  string   `json:"keyFile"`
+	CAFile   string   `json:"caFile"`
+}
+
+// Listen holds the addresses flow listens on
+type Listen struct {
+	API      string `json:"api"`
+	Frontend string `json:"frontend"`
+
+	// SNI is the shared port of the tls passthrough services
+	SNI              string `json:"sni"`
+	SNIProxyProtocol bool   `json:"sniProxyProtocol"`
+}
+
+// Ports is the range of the ports assigned to services, max excluded
+type Ports struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Balancing holds the defaults of service ports which do not set their own
+type Balancing struct {
+	Limits   *api.ConnectionLimits   `json:"limits"`
+	Timeouts *api.ConnectionTimeouts `json:"timeouts"`
+	Locality *api.LocalityPolicy     `json:"locality"`
+}
+
+// TLS of the API server
+type TLS struct {
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+	ClientCAFile string `json:"clientCAFile"`
+}
+
+// Auth of the API server
+type Auth struct {
+	TokenFile  string `json:"tokenFile"`
+	PolicyFile string `json:"policyFile"`
+	AuditLog   string `json:"auditLog"`
+}
+
+// Log configures the output of the daemon, logs go to stderr when File is
+// empty.
+type Log struct {
+	File       string `json:"file"`
+	Timestamps bool   `json:"timestamps"`
+}
+
+// Watch configures the coalescing of registry changes
+type Watch struct {
+	Window   Duration `json:"window"`
+	MaxDelay Duration `json:"maxDelay"`
+}
+
+// Cluster describes how the node joins the cluster
+type Cluster struct {
+	// NodeName identifies the node, defaults to the hostname
+	NodeName string `json:"nodeName"`
+
+	// Address clients reach the proxy ports of the node on, defaults to the
+	// node name
+	Address string            `json:"address"`
+	Labels  map[string]string `json:"labels"`
+
+	// Topology of the node, the node defaults to the node name
+	Topology api.Topology `json:"topology"`
+
+	HeartbeatInterval Duration `json:"heartbeatInterval"`
+}
+
+// Discovery configures the sources registering endpoints automatically
+type Discovery struct {
+	Docker Docker `json:"docker"`
+
+	// File, or directory, the services and endpoints are read from instead
+	// of the registry, see discovery.File. Flow runs as a standalone proxy
+	// without the API server and the cluster when it is set.
+	File string `json:"file"`
+}
+
+// Docker discovery registers the containers with flow labels, see
+// discovery.Docker
+type Docker struct {
+	// Socket of the Docker Engine API, the discovery is disabled when empty
+	Socket   string   `json:"socket"`
+	Interval Duration `json:"interval"`
+}
+
+// Static objects declared in the config file
+type Static struct {
+	Services  []api.Service      `json:"services"`
+	Endpoints []api.Endpoints    `json:"endpoints"`
+	Frontends []api.FrontendSpec `json:"frontends"`
+}
+
+// Duration is a time.Duration written like "100ms" or "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string like \"100ms\"", b)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// Default returns the configuration used for settings missing from the file
+func Default() *Config {
+	return &Config{
+		Store:  Store{Machines: []string{"http://localhost:4001"}},
+		Listen: Listen{API: ":5001", Frontend: ":9999"},
+		Ports:  Ports{Min: proxy.DefaultPortMin, Max: proxy.DefaultPortMax},
+		Watch: Watch{
+			Window:   Duration{watch.DefaultWindow},
+			MaxDelay: Duration{watch.DefaultMaxDelay},
+		},
+		Cluster: Cluster{
+			NodeName:          hostname(),
+			HeartbeatInterval: Duration{cluster.DefaultHeartbeatInterval},
+		},
+		Discovery: Discovery{
+			Docker: Docker{Interval: Duration{discovery.DefaultDockerInterval}},
+		},
+	}
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+// Load reads the config file. The format follows the extension of the file,
+// ".toml" for TOML and YAML otherwise, which includes JSON.
+func Load(file string) (*Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config, err := Parse(b, strings.ToLower(filepath.Ext(file)) == ".toml")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return config, nil
+}
+
+// Parse decodes a YAML, or TOML when isTOML is set, config on top of the
+// defaults. Unknown fields are rejected so typos do not go unnoticed. The
+// settings are not validated since they can still be overridden, see Validate.
+func Parse(b []byte, isTOML bool) (*Config, error) {
+	var raw interface{}
+	if isTOML {
+		m := map[string]interface{}{}
+		if _, err := toml.Decode(string(b), &m); err != nil {
+			return nil, err
+		}
+		raw = m
+	} else {
+		if err := yaml.Unmarshal(b, &raw); err != nil {
+			return nil, err
+		}
+	}
+	// both formats are converted to json, this way the json field names of
+	// the api types are used for the static objects
+	b, err := yamljson.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	config := Default()
+	if raw == nil {
+		return config, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the settings of the config. Static objects are validated
+// when they are reconciled.
+func (c *Config) Validate() error {
+	if len(c.Store.Machines) == 0 {
+		return fmt.Errorf("store.machines: at least one machine is required")
+	}
+	if (c.Store.CertFile == "") != (c.Store.KeyFile == "") {
+		return fmt.Errorf("store: a client certificate requires both certFile and keyFile")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: requires both certFile and keyFile")
+	}
+	if c.Ports.Min < 1 || c.Ports.Max > 65536 || c.Ports.Min >= c.Ports.Max {
+		return fmt.Errorf("ports: invalid range %d-%d", c.Ports.Min, c.Ports.Max)
+	}
+	if c.Watch.Window.Duration < 0 || c.Watch.MaxDelay.Duration < 0 {
+		return fmt.Errorf("watch: durations cannot be negative")
+	}
+	if c.Cluster.NodeName == "" {
+		return fmt.Errorf("cluster.nodeName: a node name is required")
+	}
+	if c.Cluster.HeartbeatInterval.Duration < time.Second {
+		return fmt.Errorf("cluster.heartbeatInterval: must be at least 1s")
+	}
+	if c.Discovery.Docker.Socket != "" && c.Discovery.Docker.Interval.Duration < time.Second {
+		return fmt.Errorf("discovery.docker.interval: must be at least 1s")
+	}
+	if c.Balancing.Locality != nil {
+		if errs := validation.ValidateLocalityPolicy(c.Balancing.Locality); len(errs) > 0 {
+			return fmt.Errorf("balancing.locality: %v", errs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+const yamlConfig = `
+store:
+  machines: ["http://10.0.0.1:4001", "http://10.0.0.2:4001"]
+listen:
+  api: ":6001"
+ports:
+  min: 4000
+  max: 4100
+balancing:
+  timeouts:
+    idleTimeoutSeconds: 300
+watch:
+  window: 250ms
+static:
+  services:
+  - name: api
+    ports:
+    - name: http
+      targetPort: 8080
+      protocol: TCP
+  endpoints:
+  - name: api
+    addresses: ["10.0.1.1"]
+`
+
+const tomlConfig = `
+[store]
+machines = ["http://10.0.0.1:4001", "http://10.0.0.2:4001"]
+
+[listen]
+api = ":6001"
+
+[ports]
+min = 4000
+max = 4100
+
+[balancing.timeouts]
+idleTimeoutSeconds = 300
+
+[watch]
+window = "250ms"
+
+[[static.services]]
+name = "api"
+
+  [[static.services.ports]]
+  name = "http"
+  targetPort = 8080
+  protocol = "TCP"
+
+[[static.endpoints]]
+name = "api"
+addresses = ["10.0.1.1"]
+`
+
+func TestParse(t *testing.T) {
+	expected := Default()
+	expected.Store.Machines = []string{"http://10.0.0.1:4001", "http://10.0.0.2:4001"}
+	expected.Listen.API = ":6001"
+	expected.Ports = Ports{Min: 4000, Max: 4100}
+	expected.Balancing.Timeouts = &api.ConnectionTimeouts{IdleTimeoutSeconds: 300}
+	expected.Watch.Window = Duration{250 * time.Millisecond}
+	expected.Static = Static{
+		Services: []api.Service{{
+			Name:  "api",
+			Ports: []api.ServicePort{{Name: "http", TargetPort: 8080, Protocol: "TCP"}},
+		}},
+		Endpoints: []api.Endpoints{{Name: "api", Addresses: []string{"10.0.1.1"}}},
+	}
+
+	for format, test := range map[string]struct {
+		config string
+		isTOML bool
+	}{
+		"yaml": {yamlConfig, false},
+		"toml": {tomlConfig, true},
+	} {
+		config, err := Parse([]byte(test.config), test.isTOML)
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: expected %+v got %+v", format, expected, config)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":   "listen:\n  apii: \":6001\"\n",
+		"invalid range":   "ports:\n  min: 3000\n  max: 2000\n",
+		"no machines":     "store:\n  machines: []\n",
+		"invalid window":  "watch:\n  window: 10\n",
+		"half a tls cert": "tls:\n  certFile: cert.pem\n",
+		"docker interval": "discovery:\n  docker:\n    socket: /var/run/docker.sock\n    interval: 10ms\n",
+	}
+	for name, config := range tests {
+		c, err := Parse([]byte(config), false)
+		if err == nil {
+			err = c.Validate()
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "flow.toml")
+	if err := ioutil.WriteFile(file, []byte(tomlConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen.API != ":6001" || config.Listen.Frontend != Default().Listen.Frontend {
+		t.Fatalf("expected the file on top of the defaults got %+v", config.Listen)
+	}
+	empty := filepath.Join(dir, "flow.yaml")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := Load(empty); err != nil || !reflect.DeepEqual(config, Default()) {
+		t.Fatalf("expected the defaults for an empty file got %+v, %v", config, err)
+	}
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/pkg/registry"
+)
+
+// StaticAnnotation marks the objects created from the config file. Objects
+// carrying it are deleted when they are removed from the file, objects created
+// through the API are never deleted by a reconcile.
+const StaticAnnotation = "flow/static"
+
+// StaticAddressesAnnotation lists the addresses static endpoints got from the
+// config file. Addresses added to the endpoints otherwise, e.g. by leases, are
+// kept by a reconcile, the ones removed from the file are dropped.
+const StaticAddressesAnnotation = "flow/static-addresses"
+
+// Reconcile makes the registry match the static objects. Missing objects are
+// created, changed objects updated and objects removed from the file deleted.
+// Static endpoints keep the addresses registered by leases, see
+// StaticAddressesAnnotation. It keeps going when an object fails and returns
+// all the failures at once.
+func Reconcile(store registry.Register, static *Static) error {
+	errs := reconcileServices(store, static.Services)
+	errs = append(errs, reconcileEndpoints(store, static.Endpoints)...)
+	errs = append(errs, reconcileFrontends(store, static.Frontends)...)
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("reconciling static objects: %s", strings.Join(msgs, "; "))
+}
+
+func reconcileServices(store registry.Register, services []api.Service) []error {
+	var errs []error
+	desired := map[string]bool{}
+	for i := range services {
+		service := services[i]
+		service.Namespace = defaultNamespace(service.Namespace)
+		service.Annotations = staticAnnotations(service.Annotations)
+		desired[path.Join(service.Namespace, service.Name)] = true
+
+		current, err := store.GetService(service.Namespace, service.Name)
+		switch {
+		case apierrors.IsNotFound(err):
+			_, err = store.CreateService(&service)
+		case err == nil:
+			service.ResourceVersion = current.ResourceVersion
+			if !reflect.DeepEqual(current, &service) {
+				_, err = store.UpdateService(&service)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s/%s: %v", service.Namespace, service.Name, err))
+		}
+	}
+	stored, err := store.GetServices(api.NamespaceAll)
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, service := range stored {
+		if isStatic(service.Annotations) && !desired[path.Join(service.Namespace, service.Name)] {
+			if err := store.DeleteService(service.Namespace, service.Name); err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("service %s/%s: %v", service.Namespace, service.Name, err))
+			}
+		}
+	}
+	return errs
+}
+
+func reconcileEndpoints(store registry.Register, allEndpoints []api.Endpoints) []error {
+	var errs []error
+	desired := map[string]bool{}
+	for i := range allEndpoints {
+		endpoints := allEndpoints[i]
+		endpoints.Namespace = defaultNamespace(endpoints.Namespace)
+		endpoints.Annotations = staticAnnotations(endpoints.Annotations)
+		endpoints.Annotations[StaticAddressesAnnotation] = strings.Join(endpoints.Addresses, ",")
+		desired[path.Join(endpoints.Namespace, endpoints.Name)] = true
+
+		current, err := store.GetServiceEndpoints(endpoints.Namespace, endpoints.Name)
+		switch {
+		case apierrors.IsNotFound(err):
+			_, err = store.CreateEndpoints(&endpoints)
+		case err == nil:
+			merged := mergeEndpoints(&endpoints, current)
+			if !reflect.DeepEqual(current, merged) {
+				_, err = store.UpdateEndpoints(merged)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("endpoints %s/%s: %v", endpoints.Namespace, endpoints.Name, err))
+		}
+	}
+	stored, err := store.GetEndpoints(api.NamespaceAll)
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, endpoints := range stored {
+		if isStatic(endpoints.Annotations) && !desired[path.Join(endpoints.Namespace, endpoints.Name)] {
+			if err := store.DeleteEndpoints(endpoints.Namespace, endpoints.Name); err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("endpoints %s/%s: %v", endpoints.Namespace, endpoints.Name, err))
+			}
+		}
+	}
+	return errs
+}
+
+func reconcileFrontends(store registry.Register, frontends []api.FrontendSpec) []error {
+	var errs []error
+	desired := map[string]bool{}
+	for i := range frontends {
+		frontend := frontends[i]
+		frontend.Namespace = defaultNamespace(frontend.Namespace)
+		frontend.Annotations = staticAnnotations(frontend.Annotations)
+		desired[path.Join(frontend.Namespace, frontend.Name)] = true
+
+		current, err := store.GetFrontend(frontend.Namespace, frontend.Name)
+		switch {
+		case apierrors.IsNotFound(err):
+			_, err = store.CreateFrontend(&frontend)
+		case err == nil:
+			frontend.ResourceVersion = current.ResourceVersion
+			if !reflect.DeepEqual(current, &frontend) {
+				_, err = store.UpdateFrontend(&frontend)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("frontend %s/%s: %v", frontend.Namespace, frontend.Name, err))
+		}
+	}
+	stored, err := store.GetFrontends(api.NamespaceAll)
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, frontend := range stored {
+		if isStatic(frontend.Annotations) && !desired[path.Join(frontend.Namespace, frontend.Name)] {
+			if err := store.DeleteFrontend(frontend.Namespace, frontend.Name); err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("frontend %s/%s: %v", frontend.Namespace, frontend.Name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// mergeEndpoints returns the static endpoints together with the addresses of
+// the stored endpoints which did not come from the config file. Ports missing
+// from the file are kept as long as such addresses are left.
+func mergeEndpoints(static, current *api.Endpoints) *api.Endpoints {
+	merged := *static
+	merged.ResourceVersion = current.ResourceVersion
+	// appending copies the slices of the file
+	merged.Addresses = static.Addresses[:len(static.Addresses):len(static.Addresses)]
+	merged.Ports = static.Ports[:len(static.Ports):len(static.Ports)]
+	merged.Topology = copyTopology(static.Topology)
+	merged.AddressLabels = copyAddressLabels(static.AddressLabels)
+
+	fromFile := map[string]bool{}
+	for _, address := range strings.Split(current.Annotations[StaticAddressesAnnotation], ",") {
+		fromFile[address] = true
+	}
+	for _, address := range static.Addresses {
+		fromFile[address] = true
+	}
+	added := 0
+	for _, address := range current.Addresses {
+		if fromFile[address] {
+			continue
+		}
+		added++
+		merged.Addresses = append(merged.Addresses, address)
+		if topology, ok := current.Topology[address]; ok {
+			if merged.Topology == nil {
+				merged.Topology = map[string]api.Topology{}
+			}
+			merged.Topology[address] = topology
+		}
+		if labels, ok := current.AddressLabels[address]; ok {
+			if merged.AddressLabels == nil {
+				merged.AddressLabels = map[string]map[string]string{}
+			}
+			merged.AddressLabels[address] = labels
+		}
+	}
+	if added == 0 {
+		return &merged
+	}
+	for _, port := range current.Ports {
+		found := false
+		for _, existing := range static.Ports {
+			if existing.Name == port.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Ports = append(merged.Ports, port)
+		}
+	}
+	return &merged
+}
+
+func copyTopology(topology map[string]api.Topology) map[string]api.Topology {
+	if topology == nil {
+		return nil
+	}
+	out := make(map[string]api.Topology, len(topology))
+	for address, t := range topology {
+		out[address] = t
+	}
+	return out
+}
+
+func copyAddressLabels(labels map[string]map[string]string) map[string]map[string]string {
+	if labels == nil {
+		return nil
+	}
+	out := make(map[string]map[string]string, len(labels))
+	for address, l := range labels {
+		out[address] = l
+	}
+	return out
+}
+
+// staticAnnotations returns a copy of annotations marked as static
+func staticAnnotations(annotations map[string]string) map[string]string {
+	out := map[string]string{StaticAnnotation: "true"}
+	for key, value := range annotations {
+		out[key] = value
+	}
+	return out
+}
+
+func isStatic(annotations map[string]string) bool {
+	return annotations[StaticAnnotation] == "true"
+}
+
+func defaultNamespace(namespace string) string {
+	if namespace == "" {
+		return api.NamespaceDefault
+	}
+	return namespace
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/pkg/registry"
+)
+
+func TestReconcile(t *testing.T) {
+	store := registry.NewRegistry()
+	const ns = "flowtest-config"
+	defer func() {
+		store.DeleteService(ns, "api")
+		store.DeleteService(ns, "web")
+		store.DeleteService(ns, "manual")
+		store.DeleteEndpoints(ns, "api")
+		store.DeleteFrontend(ns, "api")
+	}()
+	if _, err := store.CreateService(&api.Service{
+		Name:      "manual",
+		Namespace: ns,
+		Ports:     []api.ServicePort{{Name: "a", Protocol: "TCP"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	static := &Static{
+		Services: []api.Service{
+			{Name: "api", Namespace: ns, Ports: []api.ServicePort{{Name: "http", TargetPort: 8080, Protocol: "TCP"}}},
+			{Name: "web", Namespace: ns, Ports: []api.ServicePort{{Name: "http", TargetPort: 80, Protocol: "TCP"}}},
+		},
+		Endpoints: []api.Endpoints{{Name: "api", Namespace: ns, Addresses: []string{"10.0.1.1"}}},
+		Frontends: []api.FrontendSpec{{Name: "api", Namespace: ns, Service: "api", Scheme: "http", Route: "/api"}},
+	}
+	if err := Reconcile(store, static); err != nil {
+		t.Fatal(err)
+	}
+	service, err := store.GetService(ns, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isStatic(service.Annotations) {
+		t.Fatalf("expected the service to be marked static got %v", service.Annotations)
+	}
+	if _, err := store.GetFrontend(ns, "api"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unchanged file does not touch the registry
+	if err := Reconcile(store, static); err != nil {
+		t.Fatal(err)
+	}
+	unchanged, err := store.GetService(ns, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged.ResourceVersion != service.ResourceVersion {
+		t.Fatal("expected an unchanged service to keep its resource version")
+	}
+
+	// addresses registered by leases survive a reconcile
+	if _, err := store.RenewEndpointLease(ns, "api", &api.EndpointLease{Address: "10.0.1.2", TTLSeconds: 60}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.ReleaseEndpointLease(ns, "api", "10.0.1.2")
+	if err := Reconcile(store, static); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := store.GetServiceEndpoints(ns, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.0.1.1", "10.0.1.2"}; !reflect.DeepEqual(endpoints.Addresses, expected) {
+		t.Fatalf("expected the addresses %v got %v", expected, endpoints.Addresses)
+	}
+
+	static.Services = static.Services[:1]
+	static.Services[0].Ports[0].TargetPort = 9090
+	static.Frontends = nil
+	if err := Reconcile(store, static); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := store.GetService(ns, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Ports[0].TargetPort != 9090 {
+		t.Fatalf("expected the service to be updated got %+v", updated.Ports)
+	}
+	if _, err := store.GetService(ns, "web"); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the removed service to be deleted got %v", err)
+	}
+	if _, err := store.GetFrontend(ns, "api"); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the removed frontend to be deleted got %v", err)
+	}
+	if _, err := store.GetService(ns, "manual"); err != nil {
+		t.Fatalf("expected the service created through the api to be kept got %v", err)
+	}
+}
+
+func TestMergeEndpoints(t *testing.T) {
+	current := &api.Endpoints{
+		Name:            "api",
+		ResourceVersion: 7,
+		Annotations:     map[string]string{StaticAnnotation: "true", StaticAddressesAnnotation: "10.0.1.1,10.0.1.2"},
+		Addresses:       []string{"10.0.1.1", "10.0.1.2", "10.0.2.1"},
+		Ports:           []api.EndpointPort{{Name: "http", Port: 80}, {Name: "admin", Port: 9000}},
+		Topology:        map[string]api.Topology{"10.0.2.1": {Zone: "b"}},
+		AddressLabels:   map[string]map[string]string{"10.0.2.1": {"version": "v2"}},
+	}
+	static := &api.Endpoints{
+		Name:        "api",
+		Annotations: map[string]string{StaticAnnotation: "true", StaticAddressesAnnotation: "10.0.1.1,10.0.1.3"},
+		Addresses:   []string{"10.0.1.1", "10.0.1.3"},
+		Ports:       []api.EndpointPort{{Name: "http", Port: 8080}},
+	}
+	// the address removed from the file is dropped, the leased address and
+	// its port are kept
+	expected := &api.Endpoints{
+		Name:            "api",
+		ResourceVersion: 7,
+		Annotations:     static.Annotations,
+		Addresses:       []string{"10.0.1.1", "10.0.1.3", "10.0.2.1"},
+		Ports:           []api.EndpointPort{{Name: "http", Port: 8080}, {Name: "admin", Port: 9000}},
+		Topology:        map[string]api.Topology{"10.0.2.1": {Zone: "b"}},
+		AddressLabels:   map[string]map[string]string{"10.0.2.1": {"version": "v2"}},
+	}
+	if merged := mergeEndpoints(static, current); !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("expected %+v got %+v", expected, merged)
+	}
+	if len(static.Addresses) != 2 || static.Topology != nil {
+		t.Fatalf("expected the static endpoints to be left alone got %+v", static)
+	}
+
+	// without leased addresses the endpoints are the ones of the file
+	current.Addresses = current.Addresses[:2]
+	expected = &api.Endpoints{
+		Name:            "api",
+		ResourceVersion: 7,
+		Annotations:     static.Annotations,
+		Addresses:       static.Addresses,
+		Ports:           static.Ports,
+	}
+	if merged := mergeEndpoints(static, current); !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("expected %+v got %+v", expected, merged)
+	}
+}
@@ -0,0 +1,18 @@
+// Package discovery finds services and endpoints outside of the API.
+//
+// The containers of the local Docker daemon are registered with an endpoint
+// lease, see registry.RenewEndpointLease, so the addresses of a node which
+// stops renewing them expire like the ones of a flow agent. Discovery files
+// bypass the registry, their objects are passed to the proxy directly.
+package discovery
+
+import (
+	"github.com/twanies/flow/api"
+)
+
+// EndpointRegistry adds and removes the discovered addresses, it is
+// implemented by the registry
+type EndpointRegistry interface {
+	RenewEndpointLease(namespace, name string, lease *api.EndpointLease) (*api.EndpointLease, error)
+	ReleaseEndpointLease(namespace, name, address string) error
+}
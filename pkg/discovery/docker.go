@@ -0,0 +1,330 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/api/validation"
+)
+
+// Labels of the containers which are registered as endpoints
+const (
+	// LabelService is the name of the service the container implements, only
+	// containers with this label are registered
+	LabelService = "flow.service"
+
+	// LabelNamespace of the service, defaults to the default namespace
+	LabelNamespace = "flow.namespace"
+
+	// LabelPort is the port the container listens on, it can be left out
+	// when the service sets a target port
+	LabelPort = "flow.port"
+
+	// LabelPortName is the name of the endpoint port
+	LabelPortName = "flow.portname"
+
+	// LabelNetwork is the Docker network of the registered address, defaults
+	// to the first network of the container by name
+	LabelNetwork = "flow.network"
+)
+
+// DefaultDockerSocket is the unix socket of the Docker Engine API
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// DefaultDockerInterval is the time between two full syncs of the containers
+const DefaultDockerInterval = 10 * time.Second
+
+// missedSyncs is the number of syncs which can fail before the addresses of
+// the containers expire
+const missedSyncs = 3
+
+// Docker registers the running containers of the local Docker daemon which
+// have a LabelService label. The containers are synced when one starts or
+// dies and every Interval.
+type Docker struct {
+	// Interval between two full syncs, defaults to DefaultDockerInterval
+	Interval time.Duration
+
+	// Address registered for containers without an ip address of their own,
+	// like the ones on the host network
+	Address string
+
+	// Topology of the node the containers run on
+	Topology *api.Topology
+
+	client   *http.Client
+	registry EndpointRegistry
+
+	// registered addresses keyed by container id, only used by the sync loop
+	registered map[string]containerEndpoint
+
+	mu   sync.Mutex // protects following
+	stop chan struct{}
+	done chan struct{}
+}
+
+// containerEndpoint is the address a container is registered with
+type containerEndpoint struct {
+	namespace string
+	name      string
+	address   string
+}
+
+// dockerContainer is the part of a container of the Docker list containers
+// API used for discovery
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerEvent is an event of the Docker events API
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	ID     string `json:"id"`
+}
+
+// NewDocker returns the discovery of the containers of the Docker daemon
+// listening on the unix socket
+func NewDocker(socket string, registry EndpointRegistry) *Docker {
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}
+	return &Docker{
+		Interval:   DefaultDockerInterval,
+		client:     &http.Client{Transport: transport},
+		registry:   registry,
+		registered: map[string]containerEndpoint{},
+	}
+}
+
+// Start registers the running containers and keeps them in sync until Stop is
+// called
+func (d *Docker) Start() error {
+	if err := d.sync(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		return nil
+	}
+	d.stop, d.done = make(chan struct{}), make(chan struct{})
+	go d.run(d.stop, d.done)
+	return nil
+}
+
+// Stop stops the sync and removes the addresses of the containers
+func (d *Docker) Stop() error {
+	d.mu.Lock()
+	stop, done := d.stop, d.done
+	d.stop, d.done = nil, nil
+	d.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	var err error
+	for id, endpoint := range d.registered {
+		if e := d.registry.ReleaseEndpointLease(endpoint.namespace, endpoint.name, endpoint.address); e != nil {
+			err = e
+			continue
+		}
+		delete(d.registered, id)
+	}
+	return err
+}
+
+func (d *Docker) run(stop, done chan struct{}) {
+	defer close(done)
+	changed := make(chan struct{}, 1)
+	go d.watchEvents(changed, stop)
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-changed:
+		case <-stop:
+			return
+		}
+		if err := d.sync(); err != nil {
+			log.Printf("failed to sync the docker containers: %v", err)
+		}
+	}
+}
+
+// watchEvents signals changed when a container with a service label starts or
+// dies. The events are watched again after a failure.
+func (d *Docker) watchEvents(changed chan<- struct{}, stop <-chan struct{}) {
+	filters := `{"type":["container"],"event":["start","die"],"label":["` + LabelService + `"]}`
+	for {
+		err := d.get("/events?filters="+url.QueryEscape(filters), stop, func(resp *http.Response) error {
+			decoder := json.NewDecoder(resp.Body)
+			for {
+				event := dockerEvent{}
+				if err := decoder.Decode(&event); err != nil {
+					return err
+				}
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		})
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("watching docker events failed, retrying in %s: %v", d.Interval, err)
+		select {
+		case <-time.After(d.Interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sync renews the leases of the running containers and releases the ones of
+// containers which are gone
+func (d *Docker) sync() error {
+	var containers []dockerContainer
+	filters := `{"label":["` + LabelService + `"]}`
+	err := d.get("/containers/json?filters="+url.QueryEscape(filters), nil, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&containers)
+	})
+	if err != nil {
+		return err
+	}
+
+	ttl := int((missedSyncs*d.Interval + time.Second - 1) / time.Second)
+	registered := make(map[string]containerEndpoint, len(containers))
+	addresses := map[containerEndpoint]bool{}
+	for i := range containers {
+		container := &containers[i]
+		namespace, name, lease, err := d.leaseOf(container)
+		if err != nil {
+			log.Printf("skipping container %s: %v", shortID(container.ID), err)
+			continue
+		}
+		lease.TTLSeconds = ttl
+		if _, err := d.registry.RenewEndpointLease(namespace, name, lease); err != nil {
+			log.Printf("failed to register container %s in %s/%s: %v", shortID(container.ID), namespace, name, err)
+			continue
+		}
+		endpoint := containerEndpoint{namespace, name, lease.Address}
+		if previous, ok := d.registered[container.ID]; !ok || previous != endpoint {
+			log.Printf("registered container %s as %s in %s/%s", shortID(container.ID), lease.Address, namespace, name)
+		}
+		registered[container.ID] = endpoint
+		addresses[endpoint] = true
+	}
+
+	// release the containers which are gone and the previous address of the
+	// containers which moved
+	for id, endpoint := range d.registered {
+		if current, ok := registered[id]; (ok && current == endpoint) || addresses[endpoint] {
+			continue
+		}
+		if err := d.registry.ReleaseEndpointLease(endpoint.namespace, endpoint.name, endpoint.address); err != nil {
+			// released on the next sync, or expired by the nodes when the
+			// container is tracked by its new address
+			log.Printf("failed to remove container %s as %s from %s/%s: %v", shortID(id), endpoint.address, endpoint.namespace, endpoint.name, err)
+			if _, ok := registered[id]; !ok {
+				registered[id] = endpoint
+			}
+			continue
+		}
+		log.Printf("removed container %s as %s from %s/%s", shortID(id), endpoint.address, endpoint.namespace, endpoint.name)
+	}
+	d.registered = registered
+	return nil
+}
+
+// leaseOf returns the service and the lease of a container from its labels
+func (d *Docker) leaseOf(container *dockerContainer) (string, string, *api.EndpointLease, error) {
+	name := container.Labels[LabelService]
+	namespace := container.Labels[LabelNamespace]
+	if namespace == "" {
+		namespace = api.NamespaceDefault
+	}
+	if !validation.IsDNSLabel(name) || !validation.IsDNSLabel(namespace) {
+		return "", "", nil, fmt.Errorf("invalid service %s/%s", namespace, name)
+	}
+	lease := &api.EndpointLease{Address: d.Address, Topology: d.Topology}
+	networks := container.NetworkSettings.Networks
+	if network, ok := container.Labels[LabelNetwork]; ok {
+		if networks[network].IPAddress == "" {
+			return "", "", nil, fmt.Errorf("the container has no ip address on network %q", network)
+		}
+		lease.Address = networks[network].IPAddress
+	} else {
+		// the map of networks has no order, the address of a container on
+		// several networks has to be the same on every sync
+		names := make([]string, 0, len(networks))
+		for name := range networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if networks[name].IPAddress != "" {
+				lease.Address = networks[name].IPAddress
+				break
+			}
+		}
+	}
+	if lease.Address == "" {
+		return "", "", nil, fmt.Errorf("the container has no ip address")
+	}
+	if value, ok := container.Labels[LabelPort]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid %s label %q", LabelPort, value)
+		}
+		lease.Ports = []api.EndpointPort{{Name: container.Labels[LabelPortName], Port: port}}
+	}
+	return namespace, name, lease, nil
+}
+
+// get calls the Docker API and passes the response to read. The request is
+// canceled when cancel is closed.
+func (d *Docker) get(path string, cancel <-chan struct{}, read func(*http.Response) error) error {
+	req, err := http.NewRequest("GET", "http://docker"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = cancel
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker returned %s for %s", resp.Status, path)
+	}
+	return read(resp)
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
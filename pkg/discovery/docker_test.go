@@ -0,0 +1,242 @@
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+// fakeDocker serves the list containers and events API of the Docker daemon
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []dockerContainer
+	events     chan dockerEvent
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/containers/json":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(f.containers)
+	case "/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-f.events:
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeDocker) setContainers(containers ...dockerContainer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers = containers
+}
+
+func newContainer(id, ip string, labels map[string]string) dockerContainer {
+	c := dockerContainer{ID: id, Labels: labels}
+	c.NetworkSettings.Networks = map[string]struct {
+		IPAddress string `json:"IPAddress"`
+	}{"bridge": {IPAddress: ip}}
+	return c
+}
+
+// fakeEndpointRegistry records the registered addresses by service
+type fakeEndpointRegistry struct {
+	mu        sync.Mutex
+	addresses map[string]map[string]*api.EndpointLease
+}
+
+func (r *fakeEndpointRegistry) RenewEndpointLease(namespace, name string, lease *api.EndpointLease) (*api.EndpointLease, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := namespace + "/" + name
+	if r.addresses[key] == nil {
+		r.addresses[key] = map[string]*api.EndpointLease{}
+	}
+	r.addresses[key][lease.Address] = lease
+	return lease, nil
+}
+
+func (r *fakeEndpointRegistry) ReleaseEndpointLease(namespace, name, address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.addresses[namespace+"/"+name], address)
+	return nil
+}
+
+func (r *fakeEndpointRegistry) list(service string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := []string{}
+	for address := range r.addresses[service] {
+		out = append(out, address)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (r *fakeEndpointRegistry) lease(service, address string) *api.EndpointLease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addresses[service][address]
+}
+
+func startFakeDocker(t *testing.T, docker *fakeDocker) (string, func()) {
+	dir, err := ioutil.TempDir("", "flow-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: docker}
+	go server.Serve(listener)
+	return socket, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDockerDiscovery(t *testing.T) {
+	fake := &fakeDocker{events: make(chan dockerEvent)}
+	fake.setContainers(
+		newContainer("aaaaaaaaaaaaaaaa", "172.17.0.2", map[string]string{LabelService: "api", LabelPort: "8080", LabelPortName: "http"}),
+		newContainer("bbbbbbbbbbbbbbbb", "172.17.0.3", map[string]string{LabelService: "worker", LabelNamespace: "jobs"}),
+		newContainer("cccccccccccccccc", "172.17.0.4", map[string]string{LabelService: "api", LabelPort: "http"}),
+	)
+	socket, stop := startFakeDocker(t, fake)
+	defer stop()
+
+	registry := &fakeEndpointRegistry{addresses: map[string]map[string]*api.EndpointLease{}}
+	d := NewDocker(socket, registry)
+	// only the events trigger a sync during the test
+	d.Interval = time.Hour
+	d.Topology = &api.Topology{Node: "node1"}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := registry.list("default/api"); !reflect.DeepEqual(got, []string{"172.17.0.2"}) {
+		t.Errorf("expected the api container with a valid port to be registered, got %v", got)
+	}
+	if got := registry.list("jobs/worker"); !reflect.DeepEqual(got, []string{"172.17.0.3"}) {
+		t.Errorf("expected the worker to be registered in its namespace, got %v", got)
+	}
+	lease := registry.lease("default/api", "172.17.0.2")
+	expected := &api.EndpointLease{
+		Address:    "172.17.0.2",
+		Ports:      []api.EndpointPort{{Name: "http", Port: 8080}},
+		Topology:   &api.Topology{Node: "node1"},
+		TTLSeconds: int(missedSyncs * time.Hour / time.Second),
+	}
+	if !reflect.DeepEqual(lease, expected) {
+		t.Errorf("expected lease %+v, got %+v", expected, lease)
+	}
+
+	// a container starts and the worker dies
+	fake.setContainers(
+		newContainer("aaaaaaaaaaaaaaaa", "172.17.0.2", map[string]string{LabelService: "api", LabelPort: "8080", LabelPortName: "http"}),
+		newContainer("dddddddddddddddd", "172.17.0.5", map[string]string{LabelService: "api", LabelPort: "8080", LabelPortName: "http"}),
+	)
+	fake.events <- dockerEvent{Type: "container", Action: "start", ID: "dddddddddddddddd"}
+	waitFor(t, "the containers to sync", func() bool {
+		return reflect.DeepEqual(registry.list("default/api"), []string{"172.17.0.2", "172.17.0.5"}) &&
+			len(registry.list("jobs/worker")) == 0
+	})
+
+	// a restarted container gets another address
+	fake.setContainers(
+		newContainer("aaaaaaaaaaaaaaaa", "172.17.0.6", map[string]string{LabelService: "api", LabelPort: "8080", LabelPortName: "http"}),
+		newContainer("dddddddddddddddd", "172.17.0.5", map[string]string{LabelService: "api", LabelPort: "8080", LabelPortName: "http"}),
+	)
+	fake.events <- dockerEvent{Type: "container", Action: "start", ID: "aaaaaaaaaaaaaaaa"}
+	waitFor(t, "the previous address to be released", func() bool {
+		return reflect.DeepEqual(registry.list("default/api"), []string{"172.17.0.5", "172.17.0.6"})
+	})
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := registry.list("default/api"); len(got) != 0 {
+		t.Errorf("expected the containers to be removed on stop, got %v", got)
+	}
+}
+
+func TestDockerAddress(t *testing.T) {
+	d := NewDocker(DefaultDockerSocket, nil)
+	d.Address = "10.0.0.1"
+	hostNetwork := dockerContainer{ID: "host", Labels: map[string]string{LabelService: "api"}}
+	_, _, lease, err := d.leaseOf(&hostNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Address != "10.0.0.1" {
+		t.Errorf("expected a container without an ip to use the node address, got %s", lease.Address)
+	}
+
+	d.Address = ""
+	if _, _, _, err := d.leaseOf(&hostNetwork); err == nil {
+		t.Errorf("expected an error for a container without an address")
+	}
+	multiple := newContainer("id", "172.17.0.2", map[string]string{LabelService: "api"})
+	multiple.NetworkSettings.Networks["backend"] = struct {
+		IPAddress string `json:"IPAddress"`
+	}{IPAddress: "172.18.0.2"}
+	for i := 0; i < 10; i++ {
+		_, _, lease, err := d.leaseOf(&multiple)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.Address != "172.18.0.2" {
+			t.Fatalf("expected the address of the first network by name, got %s", lease.Address)
+		}
+	}
+	multiple.Labels[LabelNetwork] = "bridge"
+	if _, _, lease, err := d.leaseOf(&multiple); err != nil || lease.Address != "172.17.0.2" {
+		t.Errorf("expected the address of the labeled network, got %v %v", lease, err)
+	}
+
+	for _, labels := range []map[string]string{
+		{LabelService: "api", LabelNetwork: "missing"},
+		{LabelService: "Not_A_Label"},
+		{LabelService: "api", LabelNamespace: "a/b"},
+		{LabelService: "api", LabelPort: "http"},
+	} {
+		c := newContainer("id", "172.17.0.2", labels)
+		if _, _, _, err := d.leaseOf(&c); err == nil {
+			t.Errorf("expected an error for labels %v", labels)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/api/validation"
+	"github.com/twanies/flow/pkg/util/yamljson"
+	"github.com/twanies/flow/pkg/watch"
+)
+
+// fileReloadDelay is the time the file discovery waits after a change, so a
+// file which is written in several steps is read once
+const fileReloadDelay = 100 * time.Millisecond
+
+// File reads services and endpoints from a JSON or YAML file, or from the
+// .json, .yaml and .yml files of a directory, and passes them to the same
+// handlers as the registry watchers. The files are read again when they
+// change. A file looks like:
+//
+//	services:
+//	- name: api
+//	  ports:
+//	  - name: http
+//	    port: 2000
+//	    protocol: TCP
+//	endpoints:
+//	- name: api
+//	  addresses: ["10.0.1.1", "10.0.1.2"]
+//	  ports:
+//	  - name: http
+//	    port: 8080
+type File struct {
+	path      string
+	services  watch.ServiceUpdateHandler
+	endpoints watch.EndpointUpdateHandler
+
+	// the objects last passed to the handlers, only used by the watch loop
+	last fileObjects
+
+	mu      sync.Mutex // protects following
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// fileObjects are the objects declared in a discovery file
+type fileObjects struct {
+	Services  []api.Service   `json:"services"`
+	Endpoints []api.Endpoints `json:"endpoints"`
+}
+
+// NewFile returns the discovery of the objects in path, a file or a directory
+func NewFile(path string, services watch.ServiceUpdateHandler, endpoints watch.EndpointUpdateHandler) *File {
+	return &File{
+		path:      path,
+		services:  services,
+		endpoints: endpoints,
+	}
+}
+
+// Start reads the files, passes their objects to the handlers and watches the
+// files for changes until Stop is called. Files which can not be read after a
+// change are logged and the previous objects are kept.
+func (f *File) Start() error {
+	objects, err := readObjects(f.path)
+	if err != nil {
+		return err
+	}
+	f.update(objects)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.watcher != nil {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// a file is watched through its directory, editors often replace a file
+	// instead of writing it
+	dir := f.path
+	if info, err := os.Stat(f.path); err == nil && !info.IsDir() {
+		dir = filepath.Dir(f.path)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	f.watcher, f.done = watcher, make(chan struct{})
+	go f.run(watcher, f.done)
+	return nil
+}
+
+// Stop stops watching the files
+func (f *File) Stop() error {
+	f.mu.Lock()
+	watcher, done := f.watcher, f.done
+	f.watcher, f.done = nil, nil
+	f.mu.Unlock()
+	if watcher == nil {
+		return nil
+	}
+	err := watcher.Close()
+	<-done
+	return err
+}
+
+func (f *File) run(watcher *fsnotify.Watcher, done chan struct{}) {
+	defer close(done)
+	reload := time.NewTimer(fileReloadDelay)
+	reload.Stop()
+	defer reload.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if f.relevant(event.Name) {
+				reload.Reset(fileReloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("failed to watch %s: %v", f.path, err)
+		case <-reload.C:
+			objects, err := readObjects(f.path)
+			if err != nil {
+				log.Printf("failed to reload %s, keeping the previous objects: %v", f.path, err)
+				continue
+			}
+			f.update(objects)
+		}
+	}
+}
+
+// relevant reports if a change of name affects the discovered objects
+func (f *File) relevant(name string) bool {
+	if filepath.Clean(name) == filepath.Clean(f.path) {
+		return true
+	}
+	return filepath.Dir(name) == filepath.Clean(f.path) && isObjectFile(name)
+}
+
+// update passes the objects to the handlers when they changed
+func (f *File) update(objects fileObjects) {
+	if !reflect.DeepEqual(objects.Services, f.last.Services) {
+		f.services.Update(objects.Services)
+	}
+	if !reflect.DeepEqual(objects.Endpoints, f.last.Endpoints) {
+		f.endpoints.Update(objects.Endpoints)
+	}
+	f.last = objects
+	log.Printf("discovered %d services and %d endpoints in %s", len(objects.Services), len(objects.Endpoints), f.path)
+}
+
+// readObjects reads the objects of the file, or of every file in the
+// directory, sorted by namespace and name
+func readObjects(path string) (fileObjects, error) {
+	objects := fileObjects{Services: []api.Service{}, Endpoints: []api.Endpoints{}}
+	files := []string{path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return objects, err
+	}
+	if info.IsDir() {
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return objects, err
+		}
+		files = files[:0]
+		for _, info := range infos {
+			if !info.IsDir() && isObjectFile(info.Name()) {
+				files = append(files, filepath.Join(path, info.Name()))
+			}
+		}
+	}
+
+	services := map[string]bool{}
+	endpoints := map[string]bool{}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return objects, err
+		}
+		decoded, err := decodeObjects(b)
+		if err != nil {
+			return objects, fmt.Errorf("%s: %v", file, err)
+		}
+		for i := range decoded.Services {
+			service := &decoded.Services[i]
+			if service.Namespace == "" {
+				service.Namespace = api.NamespaceDefault
+			}
+			if errs := validation.ValidateService(service); len(errs) > 0 {
+				return objects, fmt.Errorf("%s: service %s: %v", file, service.Name, errs)
+			}
+			key := service.Namespace + "/" + service.Name
+			if services[key] {
+				return objects, fmt.Errorf("%s: service %s is declared twice", file, key)
+			}
+			services[key] = true
+			objects.Services = append(objects.Services, *service)
+		}
+		for i := range decoded.Endpoints {
+			endpoint := &decoded.Endpoints[i]
+			if endpoint.Namespace == "" {
+				endpoint.Namespace = api.NamespaceDefault
+			}
+			if errs := validation.ValidateEndpoints(endpoint); len(errs) > 0 {
+				return objects, fmt.Errorf("%s: endpoints %s: %v", file, endpoint.Name, errs)
+			}
+			key := endpoint.Namespace + "/" + endpoint.Name
+			if endpoints[key] {
+				return objects, fmt.Errorf("%s: endpoints %s are declared twice", file, key)
+			}
+			endpoints[key] = true
+			objects.Endpoints = append(objects.Endpoints, *endpoint)
+		}
+	}
+	sort.Sort(servicesByName(objects.Services))
+	sort.Sort(endpointsByName(objects.Endpoints))
+	return objects, nil
+}
+
+// decodeObjects decodes a YAML, or JSON, file. The YAML is converted to json
+// so the json field names of the api types apply.
+func decodeObjects(b []byte) (fileObjects, error) {
+	objects := fileObjects{}
+	var raw interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return objects, err
+	}
+	if raw == nil {
+		return objects, nil
+	}
+	b, err := yamljson.Marshal(raw)
+	if err != nil {
+		return objects, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&objects)
+	return objects, err
+}
+
+func isObjectFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return !strings.HasPrefix(filepath.Base(name), ".")
+	}
+	return false
+}
+
+type servicesByName []api.Service
+
+func (s servicesByName) Len() int      { return len(s) }
+func (s servicesByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s servicesByName) Less(i, j int) bool {
+	if s[i].Namespace != s[j].Namespace {
+		return s[i].Namespace < s[j].Namespace
+	}
+	return s[i].Name < s[j].Name
+}
+
+type endpointsByName []api.Endpoints
+
+func (e endpointsByName) Len() int      { return len(e) }
+func (e endpointsByName) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e endpointsByName) Less(i, j int) bool {
+	if e[i].Namespace != e[j].Namespace {
+		return e[i].Namespace < e[j].Namespace
+	}
+	return e[i].Name < e[j].Name
+}
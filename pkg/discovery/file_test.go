@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/twanies/flow/api"
+)
+
+// fakeHandlers records the last update of services and endpoints
+type fakeHandlers struct {
+	mu        sync.Mutex
+	services  []api.Service
+	endpoints []api.Endpoints
+}
+
+func (h *fakeHandlers) Update(services []api.Service) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.services = services
+}
+
+type fakeEndpointHandler struct {
+	*fakeHandlers
+}
+
+func (h fakeEndpointHandler) Update(endpoints []api.Endpoints) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.endpoints = endpoints
+}
+
+func (h *fakeHandlers) names() ([]string, []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	services, endpoints := []string{}, []string{}
+	for _, service := range h.services {
+		services = append(services, service.Namespace+"/"+service.Name)
+	}
+	for _, endpoint := range h.endpoints {
+		endpoints = append(endpoints, endpoint.Namespace+"/"+endpoint.Name)
+	}
+	return services, endpoints
+}
+
+const apiObjects = `
+services:
+- name: api
+  ports:
+  - name: http
+    port: 2000
+    protocol: TCP
+endpoints:
+- name: api
+  addresses: ["10.0.1.1"]
+  ports:
+  - name: http
+    port: 8080
+`
+
+const jobsObjects = `{
+  "services": [{"name": "worker", "namespace": "jobs", "ports": [{"name": "http", "port": 2001, "protocol": "TCP"}]}]
+}`
+
+func writeFile(t *testing.T, file, content string) {
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "api.yaml"), apiObjects)
+	writeFile(t, filepath.Join(dir, "README"), "not an object file")
+
+	handlers := &fakeHandlers{}
+	f := NewFile(dir, handlers, fakeEndpointHandler{handlers})
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	services, endpoints := handlers.names()
+	if !reflect.DeepEqual(services, []string{"default/api"}) || !reflect.DeepEqual(endpoints, []string{"default/api"}) {
+		t.Fatalf("expected the api service and endpoints, got %v and %v", services, endpoints)
+	}
+	handlers.mu.Lock()
+	port := handlers.endpoints[0].Ports
+	handlers.mu.Unlock()
+	if !reflect.DeepEqual(port, []api.EndpointPort{{Name: "http", Port: 8080}}) {
+		t.Errorf("expected the endpoint port to be decoded, got %+v", port)
+	}
+
+	// a new file is picked up
+	writeFile(t, filepath.Join(dir, "jobs.json"), jobsObjects)
+	waitFor(t, "the new file", func() bool {
+		services, _ := handlers.names()
+		return reflect.DeepEqual(services, []string{"default/api", "jobs/worker"})
+	})
+
+	// an invalid file keeps the previous objects
+	writeFile(t, filepath.Join(dir, "jobs.json"), `{"services": [{"name": "Worker"}]}`)
+	writeFile(t, filepath.Join(dir, "api.yaml"), "services: []\n")
+	if _, err := readObjects(dir); err == nil {
+		t.Fatal("expected the invalid file to fail")
+	}
+	writeFile(t, filepath.Join(dir, "jobs.json"), jobsObjects)
+	waitFor(t, "the removed service", func() bool {
+		services, endpoints := handlers.names()
+		return reflect.DeepEqual(services, []string{"jobs/worker"}) && len(endpoints) == 0
+	})
+}
+
+func TestReadObjectsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := map[string]string{
+		"unknown field":    "service:\n- name: api\n",
+		"invalid endpoint": "endpoints:\n- name: api\n  addresses: [\"not an address\"]\n",
+		"duplicate":        "services:\n- name: api\n  ports: [{name: http, port: 2000, protocol: TCP}]\n- name: api\n  ports: [{name: http, port: 2001, protocol: TCP}]\n",
+	}
+	for name, content := range tests {
+		file := filepath.Join(dir, "objects.yaml")
+		writeFile(t, file, content)
+		if _, err := readObjects(file); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := readObjects(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,454 @@
+// Package frontend routes HTTP requests to services by the frontends stored in
+// the registry.
+//
+// A frontend maps the requests below its route to a service port, e.g. the
+// route "/v1/api" with target path "/" sends "/v1/api/users" to "/users" on an
+// endpoint of the service. Frontends can further narrow the requests they
+// serve by host, method and headers, the request is served by the first
+// matching frontend in the order described at api.FrontendSpec.Priority. The
+// endpoints are picked by the load balancer of the proxy.
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/pkg/proxy"
+)
+
+const (
+	// maxMirrorBody is the size of the largest request body which is mirrored,
+	// requests with a larger or unknown body are not mirrored
+	maxMirrorBody = 64 << 10
+
+	// maxMirrorRequests is the number of mirrored requests in flight, requests
+	// are not mirrored while the mirrors are this far behind
+	maxMirrorRequests = 100
+
+	// mirrorTimeout is the time a mirrored request can take
+	mirrorTimeout = 10 * time.Second
+)
+
+// Router proxies HTTP requests to the service of the first frontend matching
+// the request
+type Router struct {
+	balancer  proxy.LoadBalancer
+	transport http.RoundTripper
+
+	// mirrors limits the mirrored requests in flight
+	mirrors      chan struct{}
+	mirrorClient *http.Client
+
+	mu     sync.RWMutex // protects following
+	routes []*route
+}
+
+// route matches the requests of a frontend for one of its hosts
+type route struct {
+	frontend api.FrontendSpec
+
+	// host is the host served by the route, a wildcard or empty for every
+	// host
+	host string
+
+	// prefix is the route of Prefix and Exact frontends, regex the route of
+	// Regex frontends
+	prefix  string
+	regex   *regexp.Regexp
+	headers []headerMatch
+
+	// mirrored is shared by the routes of a frontend
+	mirrored *proxy.Sampler
+}
+
+// headerMatch is a header a request needs to carry, value is nil when any
+// value matches
+type headerMatch struct {
+	name  string
+	value *regexp.Regexp
+}
+
+// NewRouter returns a router sending requests to the endpoints picked by
+// balancer
+func NewRouter(balancer proxy.LoadBalancer) *Router {
+	return &Router{
+		balancer:     balancer,
+		transport:    http.DefaultTransport,
+		mirrors:      make(chan struct{}, maxMirrorRequests),
+		mirrorClient: &http.Client{Timeout: mirrorTimeout},
+	}
+}
+
+// Update replaces the frontends of the router
+func (r *Router) Update(frontends []api.FrontendSpec) {
+	routes := make([]*route, 0, len(frontends))
+	for _, frontend := range frontends {
+		if frontend.Namespace == "" {
+			frontend.Namespace = api.NamespaceDefault
+		}
+		frontendRoutes, err := newRoutes(frontend)
+		if err != nil {
+			log.Printf("ignoring frontend %s/%s: %v", frontend.Namespace, frontend.Name, err)
+			continue
+		}
+		routes = append(routes, frontendRoutes...)
+	}
+	sort.Sort(byPriority(routes))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = routes
+}
+
+// ServeHTTP proxies the request to an endpoint of the matching frontend
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rt := r.match(req)
+	if rt == nil {
+		http.NotFound(w, req)
+		return
+	}
+	service, err := r.servicePort(rt.frontend.Namespace, rt.frontend.Service, rt.frontend.ServicePort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	endpoint, err := r.balancer.NextEndpoint(service)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("no endpoint for %s: %v", service, err), http.StatusServiceUnavailable)
+		return
+	}
+	scheme := strings.ToLower(rt.frontend.Scheme)
+	path := rt.rewrite(req.URL.Path)
+	if rt.frontend.RequestHeaders != nil {
+		rewriteHeaders(req.Header, rt.frontend.RequestHeaders)
+		// the host of the request is not part of its headers
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host
+			req.Header.Del("Host")
+		}
+	}
+	if rt.frontend.Mirror != nil && rt.mirrored.Sample(rt.frontend.Mirror.Percent) {
+		r.mirror(req, proxy.MirrorService(service, rt.frontend.Mirror), scheme, path)
+	}
+
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = scheme
+			out.URL.Host = endpoint
+			out.URL.Path = path
+			out.URL.RawPath = ""
+		},
+		Transport: r.transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			r.balancer.ReportFailure(service, endpoint)
+			log.Printf("failed to proxy %s to %s: %v", req.URL.Path, service, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	if rewrite := rt.frontend.ResponseHeaders; rewrite != nil {
+		reverseProxy.ModifyResponse = func(resp *http.Response) error {
+			rewriteHeaders(resp.Header, rewrite)
+			return nil
+		}
+	}
+	reverseProxy.ServeHTTP(w, req)
+}
+
+// match returns the first route matching the request
+func (r *Router) match(req *http.Request) *route {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rt := range r.routes {
+		if rt.matches(req, host) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// newRoutes returns the routes of a frontend, one for each of its hosts
+func newRoutes(frontend api.FrontendSpec) ([]*route, error) {
+	template := route{frontend: frontend, mirrored: &proxy.Sampler{}}
+	switch frontend.PathMatch {
+	case api.PathExact:
+		template.prefix = frontend.Route
+	case api.PathRegex:
+		regex, err := regexp.Compile("^(?:" + frontend.Route + ")$")
+		if err != nil {
+			return nil, err
+		}
+		template.regex = regex
+	default:
+		template.prefix = strings.TrimSuffix(frontend.Route, "/")
+	}
+	for _, header := range frontend.Headers {
+		match := headerMatch{name: http.CanonicalHeaderKey(header.Name)}
+		if header.Regex {
+			value, err := regexp.Compile("^(?:" + header.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			match.value = value
+		} else if header.Value != "" {
+			match.value = regexp.MustCompile("^" + regexp.QuoteMeta(header.Value) + "$")
+		}
+		template.headers = append(template.headers, match)
+	}
+
+	if len(frontend.Hosts) == 0 {
+		return []*route{&template}, nil
+	}
+	routes := make([]*route, 0, len(frontend.Hosts))
+	for _, host := range frontend.Hosts {
+		rt := template
+		rt.host = strings.ToLower(host)
+		routes = append(routes, &rt)
+	}
+	return routes, nil
+}
+
+// matches reports if the route serves the request, host is the lower case
+// host of the request without its port
+func (rt *route) matches(req *http.Request, host string) bool {
+	if rt.host != "" && rt.host != host {
+		i := strings.Index(host, ".")
+		if i <= 0 || !strings.HasPrefix(rt.host, "*.") || rt.host[1:] != host[i:] {
+			return false
+		}
+	}
+
+	path := req.URL.Path
+	switch {
+	case rt.regex != nil:
+		if !rt.regex.MatchString(path) {
+			return false
+		}
+	case rt.frontend.PathMatch == api.PathExact:
+		if path != rt.prefix {
+			return false
+		}
+	default:
+		if path != rt.prefix && !strings.HasPrefix(path, rt.prefix+"/") {
+			return false
+		}
+	}
+
+	if len(rt.frontend.Methods) > 0 {
+		allowed := false
+		for _, method := range rt.frontend.Methods {
+			if method == req.Method {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	for _, header := range rt.headers {
+		values, ok := req.Header[header.name]
+		if !ok {
+			return false
+		}
+		if header.value == nil {
+			continue
+		}
+		matched := false
+		for _, value := range values {
+			if header.value.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// servicePort returns the service port of a frontend, a frontend without a
+// port uses the only port of the service
+func (r *Router) servicePort(namespace, name, port string) (proxy.ServicePortName, error) {
+	service := proxy.ServicePortName{Namespace: namespace, Name: name, Port: port}
+	if port != "" {
+		return service, nil
+	}
+	ports := r.balancer.ServicePorts(namespace, name)
+	if len(ports) != 1 {
+		return service, fmt.Errorf("service %s/%s has %d ports, the frontend has to select one", namespace, name, len(ports))
+	}
+	service.Port = ports[0]
+	return service, nil
+}
+
+// rewrite replaces the route of the path with the target path, the target
+// path of a regex route expands the groups of the route
+func (rt *route) rewrite(path string) string {
+	target := rt.frontend.TargetPath
+	if rt.regex != nil {
+		if target == "" {
+			return path
+		}
+		return rt.regex.ReplaceAllString(path, target)
+	}
+	if target == "" {
+		target = "/"
+	}
+	rest := strings.TrimPrefix(path, rt.prefix)
+	if rest == "" || rest == "/" {
+		return target
+	}
+	return strings.TrimSuffix(target, "/") + rest
+}
+
+// mirror sends a copy of the request to an endpoint of mirror in the
+// background. The body of the request is buffered, requests are dropped
+// instead of mirrored when they can not be copied or too many mirrored
+// requests are in flight.
+func (r *Router) mirror(req *http.Request, mirror proxy.ServicePortName, scheme, path string) {
+	if req.ContentLength < 0 || req.ContentLength > maxMirrorBody {
+		return
+	}
+	select {
+	case r.mirrors <- struct{}{}:
+	default:
+		return
+	}
+	var body []byte
+	if req.ContentLength > 0 {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+		// the primary request reads the buffered body first
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		if err != nil {
+			<-r.mirrors
+			return
+		}
+	}
+	header := make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		header[key] = append([]string(nil), values...)
+	}
+	method, host, query := req.Method, req.Host, req.URL.RawQuery
+
+	go func() {
+		defer func() { <-r.mirrors }()
+		endpoint, err := r.balancer.NextEndpoint(mirror)
+		if err != nil {
+			return
+		}
+		out, err := http.NewRequest(method, scheme+"://"+endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		out.URL.RawQuery = query
+		out.Header = header
+		out.Host = host
+		resp, err := r.mirrorClient.Do(out)
+		if err != nil {
+			r.balancer.ReportFailure(mirror, endpoint)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// rewriteHeaders removes, sets and adds the headers of rewrite
+func rewriteHeaders(header http.Header, rewrite *api.HeaderRewrite) {
+	for _, name := range rewrite.Remove {
+		header.Del(name)
+	}
+	for name, value := range rewrite.Set {
+		header.Set(name, value)
+	}
+	for name, value := range rewrite.Add {
+		header.Add(name, value)
+	}
+}
+
+// byPriority sorts the routes in the order they are matched, see
+// api.FrontendSpec.Priority
+type byPriority []*route
+
+func (b byPriority) Len() int      { return len(b) }
+func (b byPriority) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPriority) Less(i, j int) bool {
+	x, y := b[i], b[j]
+	if x.frontend.Priority != y.frontend.Priority {
+		return x.frontend.Priority > y.frontend.Priority
+	}
+	if hostRank(x.host) != hostRank(y.host) {
+		return hostRank(x.host) > hostRank(y.host)
+	}
+	if len(x.host) != len(y.host) {
+		return len(x.host) > len(y.host)
+	}
+	if pathRank(x) != pathRank(y) {
+		return pathRank(x) > pathRank(y)
+	}
+	if len(x.frontend.Route) != len(y.frontend.Route) {
+		return len(x.frontend.Route) > len(y.frontend.Route)
+	}
+	if conditions(x) != conditions(y) {
+		return conditions(x) > conditions(y)
+	}
+	if x.frontend.Namespace != y.frontend.Namespace {
+		return x.frontend.Namespace < y.frontend.Namespace
+	}
+	if x.frontend.Name != y.frontend.Name {
+		return x.frontend.Name < y.frontend.Name
+	}
+	return x.host < y.host
+}
+
+func hostRank(host string) int {
+	switch {
+	case host == "":
+		return 0
+	case strings.HasPrefix(host, "*."):
+		return 1
+	}
+	return 2
+}
+
+func pathRank(rt *route) int {
+	switch {
+	case rt.frontend.PathMatch == api.PathExact:
+		return 2
+	case rt.regex != nil:
+		return 1
+	}
+	return 0
+}
+
+// conditions is the number of method and header conditions of a route
+func conditions(rt *route) int {
+	n := len(rt.headers)
+	if len(rt.frontend.Methods) > 0 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,285 @@
+package frontend
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/pkg/proxy"
+)
+
+// fakeBalancer sends the service ports to test servers
+type fakeBalancer struct {
+	mu        sync.Mutex
+	endpoints map[proxy.ServicePortName]string
+	ports     map[string][]string
+	failures  []string
+}
+
+func newFakeBalancer() *fakeBalancer {
+	return &fakeBalancer{
+		endpoints: map[proxy.ServicePortName]string{},
+		ports:     map[string][]string{},
+	}
+}
+
+// add serves the port of the service with server
+func (f *fakeBalancer) add(name, port string, server *httptest.Server) {
+	u, _ := url.Parse(server.URL)
+	f.endpoints[proxy.ServicePortName{Namespace: api.NamespaceDefault, Name: name, Port: port}] = u.Host
+	f.ports[name] = append(f.ports[name], port)
+}
+
+func (f *fakeBalancer) AddService(service proxy.ServicePortName) {}
+
+func (f *fakeBalancer) UpdateServices(services []api.Service) {}
+
+func (f *fakeBalancer) NextEndpoint(service proxy.ServicePortName) (string, error) {
+	endpoint, ok := f.endpoints[service]
+	if !ok {
+		return "", errors.New("no endpoints")
+	}
+	return endpoint, nil
+}
+
+func (f *fakeBalancer) ReportFailure(service proxy.ServicePortName, endpoint string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, endpoint)
+}
+
+func (f *fakeBalancer) ServicePorts(namespace, name string) []string {
+	return f.ports[name]
+}
+
+// echoServer answers with its name and the path of the request
+func echoServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + r.URL.Path))
+	}))
+}
+
+func get(t *testing.T, router *Router, path string) (int, string) {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	return w.Code, string(body)
+}
+
+func TestRouter(t *testing.T) {
+	api1, api2 := echoServer("api"), echoServer("web")
+	defer api1.Close()
+	defer api2.Close()
+	balancer := newFakeBalancer()
+	balancer.add("api", "http", api1)
+	balancer.add("web", "http", api2)
+	balancer.add("multi", "a", api2)
+	balancer.add("multi", "b", api2)
+
+	router := NewRouter(balancer)
+	router.Update([]api.FrontendSpec{
+		{Name: "web", Service: "web", Scheme: "HTTP", Route: "/"},
+		{Name: "api", Service: "api", ServicePort: "http", Scheme: "http", Route: "/v1/api/", TargetPath: "/internal"},
+		{Name: "multi", Service: "multi", Scheme: "http", Route: "/multi"},
+		{Name: "gone", Service: "gone", ServicePort: "http", Scheme: "http", Route: "/gone"},
+	})
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{path: "/v1/api", code: http.StatusOK, body: "api /internal"},
+		{path: "/v1/api/users/1", code: http.StatusOK, body: "api /internal/users/1"},
+		{path: "/v1/apis", code: http.StatusOK, body: "web /v1/apis"},
+		{path: "/index.html", code: http.StatusOK, body: "web /index.html"},
+		{path: "/multi", code: http.StatusServiceUnavailable},
+		{path: "/gone/x", code: http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		code, body := get(t, router, test.path)
+		if code != test.code {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.code, code)
+			continue
+		}
+		if test.body != "" && body != test.body {
+			t.Errorf("%s: expected %q, got %q", test.path, test.body, body)
+		}
+	}
+
+	router.Update(nil)
+	if code, _ := get(t, router, "/index.html"); code != http.StatusNotFound {
+		t.Errorf("expected status %d without frontends, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestRouterMirror(t *testing.T) {
+	primary := echoServer("primary")
+	defer primary.Close()
+	var (
+		mu       sync.Mutex
+		mirrored []string
+	)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		mirrored = append(mirrored, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		mu.Unlock()
+		<-release
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	balancer := newFakeBalancer()
+	balancer.add("api", "http", primary)
+	balancer.add("shadow", "http", shadow)
+	router := NewRouter(balancer)
+	router.Update([]api.FrontendSpec{{
+		Name: "api", Service: "api", Scheme: "http", Route: "/api",
+		Mirror: &api.Mirror{Service: "shadow", Percent: 50},
+	}})
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/orders?dry=1", strings.NewReader("order")))
+		if w.Code != http.StatusOK || w.Body.String() != "primary /orders" {
+			t.Fatalf("expected the primary response, got %d %q", w.Code, w.Body.String())
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the slow mirror delayed the requests by %v", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := append([]string(nil), mirrored...)
+		mu.Unlock()
+		if len(got) == 5 {
+			for _, request := range got {
+				if request != "POST /orders?dry=1 order" {
+					t.Fatalf("unexpected mirrored request %q", request)
+				}
+			}
+			return
+		}
+		if len(got) > 5 || time.Now().After(deadline) {
+			t.Fatalf("expected 5 mirrored requests, got %d", len(got))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	balancer := newFakeBalancer()
+	for _, name := range []string{"web", "www", "wild", "users", "health", "admin", "canary", "override"} {
+		server := echoServer(name)
+		defer server.Close()
+		balancer.add(name, "http", server)
+	}
+
+	router := NewRouter(balancer)
+	router.Update([]api.FrontendSpec{
+		{Name: "web", Service: "web", Scheme: "http", Route: "/"},
+		{Name: "www", Service: "www", Scheme: "http", Route: "/", Hosts: []string{"www.example.com"}},
+		{Name: "wild", Service: "wild", Scheme: "http", Route: "/", Hosts: []string{"*.example.com"}},
+		{Name: "users", Service: "users", Scheme: "http", Route: "/users/([0-9]+)", PathMatch: api.PathRegex, TargetPath: "/v2/users/$1/profile"},
+		{Name: "health", Service: "health", Scheme: "http", Route: "/users/0", PathMatch: api.PathExact, TargetPath: "/healthz"},
+		{Name: "admin", Service: "admin", Scheme: "http", Route: "/admin", Methods: []string{"POST", "DELETE"}},
+		{Name: "canary", Service: "canary", Scheme: "http", Route: "/", Headers: []api.HeaderMatch{
+			{Name: "x-canary"},
+			{Name: "User-Agent", Value: ".*Mobile.*", Regex: true},
+		}},
+		{Name: "override", Service: "override", Scheme: "http", Route: "/maintenance", Priority: 10, Hosts: []string{"www.example.com"}},
+	})
+
+	tests := []struct {
+		method string
+		host   string
+		path   string
+		header http.Header
+		body   string
+	}{
+		{host: "other.org", path: "/index.html", body: "web /index.html"},
+		{host: "WWW.example.com:8080", path: "/index.html", body: "www /index.html"},
+		{host: "shop.example.com", path: "/index.html", body: "wild /index.html"},
+		{host: "a.shop.example.com", path: "/index.html", body: "web /index.html"},
+		{host: "example.com", path: "/index.html", body: "web /index.html"},
+		{host: "other.org", path: "/users/42", body: "users /v2/users/42/profile"},
+		{host: "other.org", path: "/users/42/orders", body: "web /users/42/orders"},
+		{host: "other.org", path: "/users/0", body: "health /healthz"},
+		// exact hosts are matched before paths
+		{host: "www.example.com", path: "/users/42", body: "www /users/42"},
+		{method: "POST", host: "other.org", path: "/admin/users", body: "admin /users"},
+		{method: "GET", host: "other.org", path: "/admin/users", body: "web /admin/users"},
+		{host: "other.org", path: "/index.html", header: http.Header{"X-Canary": {"1"}, "User-Agent": {"Mobile Safari"}}, body: "canary /index.html"},
+		{host: "other.org", path: "/index.html", header: http.Header{"X-Canary": {"1"}, "User-Agent": {"curl"}}, body: "web /index.html"},
+		{host: "www.example.com", path: "/maintenance", body: "override /"},
+	}
+	for _, test := range tests {
+		method := test.method
+		if method == "" {
+			method = "GET"
+		}
+		req := httptest.NewRequest(method, test.path, nil)
+		req.Host = test.host
+		for key, values := range test.header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Body.String() != test.body {
+			t.Errorf("%s %s%s: expected %q, got %d %q", method, test.host, test.path, test.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRouterHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Powered-By", "php")
+		w.Write([]byte(r.Host + " " + r.Header.Get("Cookie") + " " + strings.Join(r.Header["X-Forwarded-Proto"], ",")))
+	}))
+	defer server.Close()
+	balancer := newFakeBalancer()
+	balancer.add("api", "http", server)
+
+	router := NewRouter(balancer)
+	router.Update([]api.FrontendSpec{{
+		Name: "api", Service: "api", Scheme: "http", Route: "/",
+		RequestHeaders: &api.HeaderRewrite{
+			Set:    map[string]string{"Host": "api.internal"},
+			Add:    map[string]string{"X-Forwarded-Proto": "https"},
+			Remove: []string{"Cookie"},
+		},
+		ResponseHeaders: &api.HeaderRewrite{
+			Set:    map[string]string{"Server": "flow"},
+			Remove: []string{"X-Powered-By"},
+		},
+	}})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "www.example.com"
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Forwarded-Proto", "http")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if got, want := w.Body.String(), "api.internal  http,https"; got != want {
+		t.Errorf("expected the endpoint to receive %q, got %q", want, got)
+	}
+	if got := w.Header().Get("Server"); got != "flow" {
+		t.Errorf("expected the server header to be set, got %q", got)
+	}
+	if _, ok := w.Header()["X-Powered-By"]; ok {
+		t.Error("expected the X-Powered-By header to be removed")
+	}
+}
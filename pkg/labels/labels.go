@@ -0,0 +1,264 @@
+// Package labels implements label sets and the selectors used to query
+// services and endpoints by their labels.
+package labels
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Set is a map of label keys to values
+type Set map[string]string
+
+// String returns the set as a selector string, sorted by key
+func (s Set) String() string {
+	pairs := make([]string, 0, len(s))
+	for key, value := range s {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Selector matches label sets
+type Selector interface {
+	Matches(labels Set) bool
+	Empty() bool
+	String() string
+}
+
+// Operator is the relation a requirement tests for
+type Operator string
+
+const (
+	Equals       Operator = "="
+	DoubleEquals Operator = "=="
+	NotEquals    Operator = "!="
+	In           Operator = "in"
+	NotIn        Operator = "notin"
+	Exists       Operator = "exists"
+	DoesNotExist Operator = "!"
+)
+
+// Requirement is a single condition of a selector
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+func (r Requirement) hasValue(value string) bool {
+	for _, v := range r.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches tests if the label set satisfies the requirement
+func (r Requirement) Matches(labels Set) bool {
+	value, exists := labels[r.Key]
+	switch r.Operator {
+	case Equals, DoubleEquals, In:
+		return exists && r.hasValue(value)
+	case NotEquals, NotIn:
+		return !exists || !r.hasValue(value)
+	case Exists:
+		return exists
+	case DoesNotExist:
+		return !exists
+	}
+	return false
+}
+
+func (r Requirement) String() string {
+	switch r.Operator {
+	case Exists:
+		return r.Key
+	case DoesNotExist:
+		return "!" + r.Key
+	case In, NotIn:
+		return fmt.Sprintf("%s %s (%s)", r.Key, r.Operator, strings.Join(r.Values, ","))
+	}
+	return r.Key + string(r.Operator) + r.Values[0]
+}
+
+// requirements is a selector that matches when all requirements match
+type requirements []Requirement
+
+func (rs requirements) Matches(labels Set) bool {
+	for _, r := range rs {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rs requirements) Empty() bool {
+	return len(rs) == 0
+}
+
+func (rs requirements) String() string {
+	out := make([]string, len(rs))
+	for i, r := range rs {
+		out[i] = r.String()
+	}
+	return strings.Join(out, ",")
+}
+
+// Everything returns a selector that matches all label sets
+func Everything() Selector {
+	return requirements{}
+}
+
+// SelectorFromSet returns a selector matching label sets that contain all the
+// labels of set
+func SelectorFromSet(set Set) Selector {
+	rs := requirements{}
+	for key, value := range set {
+		rs = append(rs, Requirement{key, Equals, []string{value}})
+	}
+	sort.Sort(byKey(rs))
+	return rs
+}
+
+type byKey requirements
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool { return b[i].Key < b[j].Key }
+
+// Parse parses a comma separated list of requirements, e.g.
+//
+//	team=payments,env!=dev,tier in (web,api),canary,!legacy
+func Parse(selector string) (Selector, error) {
+	rs := requirements{}
+	for _, part := range splitRequirements(selector) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// splitRequirements splits the selector on the commas which are not part of a
+// value list
+func splitRequirements(selector string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+func parseRequirement(s string) (Requirement, error) {
+	if strings.HasPrefix(s, "!") && !strings.ContainsAny(s, "=()") {
+		key := strings.TrimSpace(s[1:])
+		return newRequirement(key, DoesNotExist, nil)
+	}
+	for _, op := range []Operator{NotEquals, DoubleEquals, Equals} {
+		if i := strings.Index(s, string(op)); i >= 0 {
+			key := strings.TrimSpace(s[:i])
+			value := strings.TrimSpace(s[i+len(op):])
+			return newRequirement(key, op, []string{value})
+		}
+	}
+	if i := strings.Index(s, "("); i >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return Requirement{}, fmt.Errorf("missing closing parenthesis in %q", s)
+		}
+		fields := strings.Fields(s[:i])
+		if len(fields) != 2 || (fields[1] != string(In) && fields[1] != string(NotIn)) {
+			return Requirement{}, fmt.Errorf("invalid set requirement %q", s)
+		}
+		var values []string
+		for _, v := range strings.Split(s[i+1:len(s)-1], ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+		return newRequirement(fields[0], Operator(fields[1]), values)
+	}
+	return newRequirement(s, Exists, nil)
+}
+
+func newRequirement(key string, op Operator, values []string) (Requirement, error) {
+	if err := ValidateKey(key); err != nil {
+		return Requirement{}, err
+	}
+	for _, v := range values {
+		if err := ValidateValue(v); err != nil {
+			return Requirement{}, err
+		}
+	}
+	return Requirement{key, op, values}, nil
+}
+
+const qualifiedNameMaxLength int = 63
+
+func isNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_' || c == '.'
+}
+
+func isAlphaNum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// validName tests for names of at most 63 characters made up of alphanumeric
+// characters, '-', '_' or '.', starting and ending with an alphanumeric
+// character.
+func validName(name string) bool {
+	if len(name) > qualifiedNameMaxLength {
+		return false
+	}
+	for _, c := range name {
+		if !isNameChar(c) {
+			return false
+		}
+	}
+	return name == "" || isAlphaNum(name[0]) && isAlphaNum(name[len(name)-1])
+}
+
+// ValidateKey tests if key is a valid label key, a name optionally prefixed by
+// a DNS subdomain and a slash, e.g. "flow.io/team".
+func ValidateKey(key string) error {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		if prefix == "" || len(prefix) > 253 || !validName(prefix) {
+			return fmt.Errorf("invalid label key prefix %q", prefix)
+		}
+		name = key[i+1:]
+	}
+	if name == "" || !validName(name) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	return nil
+}
+
+// ValidateValue tests if value is a valid label value, values may be empty
+func ValidateValue(value string) error {
+	if !validName(value) {
+		return fmt.Errorf("invalid label value %q", value)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package labels
+
+import "testing"
+
+func TestParseSelector(t *testing.T) {
+	labels := Set{"team": "payments", "env": "prod", "tier": "api"}
+	tests := map[string]bool{
+		"":                               true,
+		"team=payments":                  true,
+		"team==payments,env!=dev":        true,
+		"team=payments,env=dev":          false,
+		"tier in (web, api)":             true,
+		"tier notin (web,api),env=prod":  false,
+		"team,!legacy":                   true,
+		"legacy":                         false,
+		"!team":                          false,
+		"version!=v2":                    true,
+		" team = payments , env != dev ": true,
+	}
+	for selector, expected := range tests {
+		s, err := Parse(selector)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", selector, err)
+			continue
+		}
+		if s.Matches(labels) != expected {
+			t.Errorf("expected %q matching %v to be %v", selector, labels, expected)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, selector := range []string{
+		"team=pay ments",
+		"tier in (web",
+		"tier within (web)",
+		"=payments",
+		"-team=payments",
+	} {
+		if _, err := Parse(selector); err == nil {
+			t.Errorf("expected %q to fail parsing", selector)
+		}
+	}
+}
+
+func TestSelectorString(t *testing.T) {
+	s, err := Parse("team=payments,tier in (web,api),!legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.String() != "team=payments,tier in (web,api),!legacy" {
+		t.Fatalf("unexpected selector string %s", s)
+	}
+	if SelectorFromSet(Set{"b": "2", "a": "1"}).String() != "a=1,b=2" {
+		t.Fatal("expected selector to be sorted by key")
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	for key, valid := range map[string]bool{
+		"team":         true,
+		"flow.io/team": true,
+		"/team":        false,
+		"flow.io/":     false,
+		"team-":        false,
+		"a_b.c":        true,
+	} {
+		if (ValidateKey(key) == nil) != valid {
+			t.Errorf("expected key %q valid to be %v", key, valid)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+// defaultQueueTimeout is the time a connection over the limits is queued when
+// the service does not set a timeout
+const defaultQueueTimeout = 10 * time.Second
+
+var errOverLimit = errors.New("connection over the service limits")
+
+// tokenBucket allows rate events per second with bursts of burst events
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Ceil(rate)
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(tb.last).Seconds(); elapsed > 0 {
+		tb.tokens = math.Min(tb.burst, tb.tokens+elapsed*tb.rate)
+	}
+	tb.last = now
+}
+
+// take takes a token from the bucket, when there is none it returns the time
+// until the next token is available.
+func (tb *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	tb.refill(now)
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	return false, wait
+}
+
+// LimitStats are the connection counters of a proxied service
+type LimitStats struct {
+	Active   int64  `json:"active"`
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	Queued   uint64 `json:"queued"`
+}
+
+// connLimiter enforces the connection limits of a service. A limiter without
+// limits only counts connections.
+type connLimiter struct {
+	limits api.ConnectionLimits
+	now    func() time.Time
+
+	mu        sync.Mutex // protects following
+	active    int
+	perClient map[string]int
+	bucket    *tokenBucket
+	released  chan struct{} // closed and replaced when a connection is released
+
+	accepted uint64
+	rejected uint64
+	queued   uint64
+}
+
+func newConnLimiter(limits *api.ConnectionLimits) *connLimiter {
+	l := &connLimiter{
+		now:       time.Now,
+		perClient: make(map[string]int),
+		released:  make(chan struct{}),
+	}
+	l.setLimits(limits)
+	return l
+}
+
+// setLimits replaces the limits, the connections admitted before stay counted
+// and queued connections are retried against the new limits
+func (l *connLimiter) setLimits(limits *api.ConnectionLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = api.ConnectionLimits{}
+	if limits != nil {
+		l.limits = *limits
+	}
+	l.bucket = nil
+	if l.limits.ConnectionsPerSecond > 0 {
+		l.bucket = newTokenBucket(l.limits.ConnectionsPerSecond, l.limits.Burst, l.now())
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// tryAcquire admits a connection from client if it fits in the limits, when
+// the rate limit is hit it returns the time until the next connection is
+// allowed. Assumes the lock is held.
+func (l *connLimiter) tryAcquire(client string) (bool, time.Duration) {
+	if l.limits.MaxConnections > 0 && l.active >= l.limits.MaxConnections {
+		return false, 0
+	}
+	if l.limits.MaxConnectionsPerClient > 0 && l.perClient[client] >= l.limits.MaxConnectionsPerClient {
+		return false, 0
+	}
+	if l.bucket != nil {
+		if ok, wait := l.bucket.take(l.now()); !ok {
+			return false, wait
+		}
+	}
+	l.active++
+	l.perClient[client]++
+	return true, 0
+}
+
+// acquire admits a connection from client. Connections over the limits are
+// rejected or, when the service queues them, wait until they fit in.
+func (l *connLimiter) acquire(client string) error {
+	l.mu.Lock()
+	ok, wait := l.tryAcquire(client)
+	released, limits := l.released, l.limits
+	l.mu.Unlock()
+	if ok {
+		atomic.AddUint64(&l.accepted, 1)
+		return nil
+	}
+	if limits.OverLimit != api.OverLimitQueue {
+		atomic.AddUint64(&l.rejected, 1)
+		return errOverLimit
+	}
+
+	atomic.AddUint64(&l.queued, 1)
+	timeout := defaultQueueTimeout
+	if limits.QueueTimeoutSeconds > 0 {
+		timeout = time.Duration(limits.QueueTimeoutSeconds) * time.Second
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		// a zero wait means a connection has to be released first
+		var retry <-chan time.Time
+		if wait > 0 {
+			retry = time.After(wait)
+		}
+		select {
+		case <-released:
+		case <-retry:
+		case <-deadline.C:
+			atomic.AddUint64(&l.rejected, 1)
+			return errOverLimit
+		}
+		l.mu.Lock()
+		ok, wait = l.tryAcquire(client)
+		released = l.released
+		l.mu.Unlock()
+		if ok {
+			atomic.AddUint64(&l.accepted, 1)
+			return nil
+		}
+	}
+}
+
+// release frees the connection of client admitted by acquire
+func (l *connLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.perClient[client]--; l.perClient[client] <= 0 {
+		delete(l.perClient, client)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *connLimiter) stats() LimitStats {
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+	return LimitStats{
+		Active:   int64(active),
+		Accepted: atomic.LoadUint64(&l.accepted),
+		Rejected: atomic.LoadUint64(&l.rejected),
+		Queued:   atomic.LoadUint64(&l.queued),
+	}
+}
+
+// clientHost returns the ip of a client address
+func clientHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
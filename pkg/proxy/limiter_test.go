@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, 0, now)
+	for i := 0; i < 2; i++ {
+		if ok, _ := tb.take(now); !ok {
+			t.Fatalf("expected token %d of the burst", i)
+		}
+	}
+	ok, wait := tb.take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms for the next token, got %v %v", ok, wait)
+	}
+	if ok, _ := tb.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Fatal("expected a token after 500ms")
+	}
+}
+
+func TestConnLimiterMaxConnections(t *testing.T) {
+	l := newConnLimiter(&api.ConnectionLimits{MaxConnections: 2, MaxConnectionsPerClient: 1})
+	if err := l.acquire("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire("10.0.0.1"); err != errOverLimit {
+		t.Fatalf("expected the client limit to be hit got %v", err)
+	}
+	if err := l.acquire("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire("10.0.0.3"); err != errOverLimit {
+		t.Fatalf("expected the service limit to be hit got %v", err)
+	}
+	l.release("10.0.0.1")
+	if err := l.acquire("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	stats := l.stats()
+	if stats.Active != 2 || stats.Accepted != 3 || stats.Rejected != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+	l := newConnLimiter(&api.ConnectionLimits{MaxConnections: 1, OverLimit: api.OverLimitQueue, QueueTimeoutSeconds: 5})
+	if err := l.acquire("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- l.acquire("10.0.0.2")
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the connection to be queued, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.release("10.0.0.1")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the queued connection to be admitted")
+	}
+	if stats := l.stats(); stats.Queued != 1 || stats.Active != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestConnLimiterQueueRate(t *testing.T) {
+	l := newConnLimiter(&api.ConnectionLimits{ConnectionsPerSecond: 20, Burst: 1, OverLimit: api.OverLimitQueue})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.acquire("10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected the connections to be spread by the rate limit, took %v", elapsed)
+	}
+}
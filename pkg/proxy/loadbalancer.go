@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/pkg/labels"
 )
 
 var (
@@ -19,10 +22,29 @@ var (
 type LoadBalancer interface {
 	AddService(service ServicePortName)
 	NextEndpoint(service ServicePortName) (string, error)
+
+	// UpdateServices tells the balancer how the ports of the services map to
+	// the ports of their endpoints
+	UpdateServices(services []api.Service)
+
+	// ReportFailure tells the balancer the endpoint of the service could not
+	// be reached
+	ReportFailure(service ServicePortName, endpoint string)
+
+	// ServicePorts returns the names of the ports of a service
+	ServicePorts(namespace, name string) []string
 }
 
+// failedEndpointTimeout is the time an endpoint which could not be reached is
+// avoided by services preferring local endpoints
+const failedEndpointTimeout = 10 * time.Second
+
 // ServicePortName is an unique identifier for a registered service
 type ServicePortName struct {
+	// Namespace of the service, services with the same name in different
+	// namespaces are proxied separately
+	Namespace string
+
 	// A service is assumed to have its proxy port on the same machine flow is
 	// running
 	Name string
@@ -30,29 +52,81 @@ type ServicePortName struct {
 }
 
 func (s ServicePortName) String() string {
-	return fmt.Sprintf("%s:%s", s.Name, s.Port)
+	if s.Namespace == "" {
+		return fmt.Sprintf("%s:%s", s.Name, s.Port)
+	}
+	return fmt.Sprintf("%s/%s:%s", s.Namespace, s.Name, s.Port)
 }
 
 type hostPort struct {
-	host string
-	port int
+	host     string
+	port     int
+	topology api.Topology
+	labels   map[string]string
 }
 
 // serviceBalancer directs traffic between nodes from the same service cluster
 type serviceBalancer struct {
+	// Topology of the node, services preferring local endpoints use the
+	// endpoints with the same node, zone or region
+	Topology api.Topology
+
+	// DefaultLocality applies to services without a locality policy
+	DefaultLocality *api.LocalityPolicy
+
 	lock     sync.RWMutex
 	services map[ServicePortName]*balancerState
+	now      func() time.Time
+
+	// the last known specs of the services and endpoints, keyed by namespace
+	// and name
+	serviceSpecs map[string]serviceSpec
+	endpoints    []api.Endpoints
+}
+
+// serviceSpec is the part of a service the balancer depends on
+type serviceSpec struct {
+	ports    []api.ServicePort
+	locality *api.LocalityPolicy
+	split    *api.TrafficSplit
 }
 
 // balancerState keeps track of service endpoints and their index
 type balancerState struct {
 	endpoints []string
 	index     int
+
+	// topology and labels of the endpoints, in the same order as the
+	// endpoints
+	topology []api.Topology
+	labels   []map[string]string
+	locality *api.LocalityPolicy
+
+	// unhealthy endpoints and the time they are used again
+	unhealthy map[string]time.Time
+
+	// split of the service and the subsets of the endpoints it selects
+	split   *api.TrafficSplit
+	subsets []*subsetState
+}
+
+// subsetState keeps track of the endpoints of a subset of a traffic split
+type subsetState struct {
+	name      string
+	weight    int
+	endpoints []string
+	topology  []api.Topology
+	index     int
+
+	// current weight of the subset in the smooth weighted round robin
+	current int
 }
 
 func NewServiceBalancer() *serviceBalancer {
 	return &serviceBalancer{
-		services: map[ServicePortName]*balancerState{},
+		services:     map[ServicePortName]*balancerState{},
+		serviceSpecs: map[string]serviceSpec{},
+		now:          time.Now,
 	}
 }
 
@@ -66,10 +140,160 @@ func (sb *serviceBalancer) NextEndpoint(service ServicePortName) (string, error)
 	if len(state.endpoints) == 0 {
 		return "", errMissingEndpoints
 	}
-	endpoint := state.endpoints[state.index]
-	log.Printf("serving %s for service %s", endpoint, service)
-	state.index = (state.index + 1) % len(state.endpoints)
-	return endpoint, nil
+	endpoints, topology, index := state.endpoints, state.topology, &state.index
+	if subset := state.nextSubset(); subset != nil {
+		endpoints, topology, index = subset.endpoints, subset.topology, &subset.index
+	} else if len(state.subsets) > 0 {
+		// the endpoints of subsets with weight 0 stay drained when the
+		// weighted subsets have no endpoints
+		endpoints, topology = state.undrainedEndpoints()
+		if len(endpoints) == 0 {
+			return "", errMissingEndpoints
+		}
+	}
+	endpoints, topology = sb.healthyEndpoints(state, endpoints, topology)
+	if state.locality != nil && state.locality.Mode == api.LocalityPreferLocal {
+		endpoints = sb.localEndpoints(state.locality, endpoints, topology)
+	}
+	i := *index % len(endpoints)
+	log.Printf("serving %s for service %s", endpoints[i], service)
+	*index = (i + 1) % len(endpoints)
+	return endpoints[i], nil
+}
+
+// nextSubset picks the subset of the next connection with a smooth weighted
+// round robin, which spreads the connections of a small subset evenly. It
+// returns nil when the service has no split or none of its weighted subsets
+// has endpoints.
+func (state *balancerState) nextSubset() *subsetState {
+	var next *subsetState
+	total := 0
+	for _, subset := range state.subsets {
+		if subset.weight == 0 || len(subset.endpoints) == 0 {
+			continue
+		}
+		subset.current += subset.weight
+		total += subset.weight
+		if next == nil || subset.current > next.current {
+			next = subset
+		}
+	}
+	if next != nil {
+		next.current -= total
+	}
+	return next
+}
+
+// undrainedEndpoints returns the endpoints which are in no subset with weight 0
+func (state *balancerState) undrainedEndpoints() ([]string, []api.Topology) {
+	drained := make(map[string]bool)
+	for _, subset := range state.subsets {
+		if subset.weight != 0 {
+			continue
+		}
+		for _, endpoint := range subset.endpoints {
+			drained[endpoint] = true
+		}
+	}
+	if len(drained) == 0 {
+		return state.endpoints, state.topology
+	}
+	var endpoints []string
+	var topology []api.Topology
+	for i, endpoint := range state.endpoints {
+		if !drained[endpoint] {
+			endpoints = append(endpoints, endpoint)
+			topology = append(topology, state.topology[i])
+		}
+	}
+	return endpoints, topology
+}
+
+// healthyEndpoints returns the endpoints which did not fail recently, or every
+// endpoint when all of them failed
+func (sb *serviceBalancer) healthyEndpoints(state *balancerState, endpoints []string, endpointTopology []api.Topology) ([]string, []api.Topology) {
+	if len(state.unhealthy) == 0 {
+		return endpoints, endpointTopology
+	}
+	now := sb.now()
+	var healthy []string
+	var topology []api.Topology
+	for i, endpoint := range endpoints {
+		if until, ok := state.unhealthy[endpoint]; ok && now.Before(until) {
+			continue
+		}
+		healthy = append(healthy, endpoint)
+		topology = append(topology, endpointTopology[i])
+	}
+	if len(healthy) == 0 {
+		return endpoints, endpointTopology
+	}
+	return healthy, topology
+}
+
+// localEndpoints returns the endpoints closest to the node. The endpoints on
+// the node are used first, then the ones in the zone and then the ones in the
+// region, as long as there are at least MinEndpoints of them. Otherwise every
+// endpoint is used.
+func (sb *serviceBalancer) localEndpoints(locality *api.LocalityPolicy, endpoints []string, topology []api.Topology) []string {
+	min := locality.MinEndpoints
+	if min < 1 {
+		min = 1
+	}
+	local := sb.Topology
+	localities := []func(t api.Topology) bool{
+		func(t api.Topology) bool { return local.Node != "" && t.Node == local.Node },
+		func(t api.Topology) bool { return local.Zone != "" && t.Zone == local.Zone },
+		func(t api.Topology) bool { return local.Region != "" && t.Region == local.Region },
+	}
+	for _, isLocal := range localities {
+		var local []string
+		for i, endpoint := range endpoints {
+			if isLocal(topology[i]) {
+				local = append(local, endpoint)
+			}
+		}
+		if len(local) >= min {
+			return local
+		}
+	}
+	return endpoints
+}
+
+// ReportFailure avoids the endpoint for a while, its connections go to the
+// other endpoints of the service
+func (sb *serviceBalancer) ReportFailure(service ServicePortName, endpoint string) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	state, exists := sb.services[service]
+	if !exists {
+		return
+	}
+	if state.unhealthy == nil {
+		state.unhealthy = make(map[string]time.Time)
+	}
+	state.unhealthy[endpoint] = sb.now().Add(failedEndpointTimeout)
+}
+
+// ServicePorts returns the port names of the service spec, or the ports with
+// endpoints of a service without spec
+func (sb *serviceBalancer) ServicePorts(namespace, name string) []string {
+	sb.lock.RLock()
+	defer sb.lock.RUnlock()
+	var ports []string
+	if spec, ok := sb.serviceSpecs[namespacedName(namespace, name)]; ok {
+		for _, port := range spec.ports {
+			ports = append(ports, port.Name)
+		}
+		return ports
+	}
+	for service := range sb.services {
+		if service.Namespace == namespace && service.Name == name {
+			ports = append(ports, service.Port)
+		}
+	}
+	sort.Strings(ports)
+	return ports
 }
 
 func (sb *serviceBalancer) AddService(service ServicePortName) {
@@ -88,37 +312,110 @@ func (sb *serviceBalancer) addServiceInternal(service ServicePortName) *balancer
 	return sb.services[service]
 }
 
+// UpdateServices stores the port mapping, locality and traffic split of the
+// services and applies them to the known endpoints.
+func (sb *serviceBalancer) UpdateServices(services []api.Service) {
+	serviceSpecs := make(map[string]serviceSpec, len(services))
+	for i := range services {
+		serviceSpecs[namespacedName(services[i].Namespace, services[i].Name)] = serviceSpec{
+			ports:    services[i].Ports,
+			locality: services[i].Locality,
+			split:    services[i].Split,
+		}
+	}
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if reflect.DeepEqual(serviceSpecs, sb.serviceSpecs) {
+		return
+	}
+	sb.serviceSpecs = serviceSpecs
+	sb.updateInternal(sb.endpoints)
+}
+
 // Update wil compare the new endpointSet with the existing state.
 func (sb *serviceBalancer) Update(endpoints []api.Endpoints) {
-	registeredEndpoints := make(map[ServicePortName]bool)
 	sb.lock.Lock()
 	defer sb.lock.Unlock()
+	sb.endpoints = endpoints
+	sb.updateInternal(endpoints)
+}
 
-	for i := range endpoints {
-		svcEndpoints := &endpoints[i]
-
-		hostPortMap := make(map[string][]hostPort)
-		for i := range svcEndpoints.Ports {
-			port := svcEndpoints.Ports[i]
-			for i := range svcEndpoints.Addresses {
-				address := svcEndpoints.Addresses[i]
-				hostPortMap[port.Name] = append(hostPortMap[port.Name], hostPort{address, port.Port})
+// hostPorts returns the backends of every service port. Ports of a known
+// service are mapped to their target port, the endpoints of unknown services
+// are used per endpoint port name.
+func (sb *serviceBalancer) hostPorts(endpoints *api.Endpoints) map[string][]hostPort {
+	hostPortMap := make(map[string][]hostPort)
+	spec, ok := sb.serviceSpecs[namespacedName(endpoints.Namespace, endpoints.Name)]
+	if !ok {
+		for _, port := range endpoints.Ports {
+			for _, address := range endpoints.Addresses {
+				hostPortMap[port.Name] = append(hostPortMap[port.Name], hostPort{address, port.Port, endpoints.Topology[address], endpoints.AddressLabels[address]})
+			}
+		}
+		return hostPortMap
+	}
+	for _, servicePort := range spec.ports {
+		if servicePort.TargetPort != 0 {
+			for _, address := range endpoints.Addresses {
+				hostPortMap[servicePort.Name] = append(hostPortMap[servicePort.Name], hostPort{address, servicePort.TargetPort, endpoints.Topology[address], endpoints.AddressLabels[address]})
 			}
+			continue
 		}
+		targetName := servicePort.TargetPortName
+		if targetName == "" {
+			targetName = servicePort.Name
+		}
+		for _, port := range endpoints.Ports {
+			if port.Name != targetName {
+				continue
+			}
+			for _, address := range endpoints.Addresses {
+				hostPortMap[servicePort.Name] = append(hostPortMap[servicePort.Name], hostPort{address, port.Port, endpoints.Topology[address], endpoints.AddressLabels[address]})
+			}
+		}
+	}
+	return hostPortMap
+}
+
+// updateInternal syncs the balancer states with endpoints, assumes the lock is
+// held.
+func (sb *serviceBalancer) updateInternal(endpoints []api.Endpoints) {
+	registeredEndpoints := make(map[ServicePortName]bool)
+	for i := range endpoints {
+		svcEndpoints := &endpoints[i]
+		hostPortMap := sb.hostPorts(svcEndpoints)
+		locality := sb.localityOf(svcEndpoints.Namespace, svcEndpoints.Name)
+		split := sb.serviceSpecs[namespacedName(svcEndpoints.Namespace, svcEndpoints.Name)].split
 
 		for portName := range hostPortMap {
-			serviceName := ServicePortName{svcEndpoints.Name, portName}
+			serviceName := ServicePortName{svcEndpoints.Namespace, svcEndpoints.Name, portName}
 			state, exists := sb.services[serviceName]
 			curEndpoints := []string{}
+			var curTopology []api.Topology
+			var curLabels []map[string]string
 			if state != nil {
 				curEndpoints = state.endpoints
+				curTopology = state.topology
+				curLabels = state.labels
 			}
 			newEndpoints := endpointsToSlice(hostPortMap[portName])
-			if !exists || !equalSlices(curEndpoints, newEndpoints) {
-				state := sb.addServiceInternal(serviceName)
-				state.endpoints = endpointsToSlice(hostPortMap[portName])
+			newTopology := topologyToSlice(hostPortMap[portName])
+			newLabels := labelsToSlice(hostPortMap[portName])
+			changed := !exists || !equalSlices(curEndpoints, newEndpoints) ||
+				!reflect.DeepEqual(curTopology, newTopology) || !reflect.DeepEqual(curLabels, newLabels)
+			if changed {
+				state = sb.addServiceInternal(serviceName)
+				state.endpoints = newEndpoints
+				state.topology = newTopology
+				state.labels = newLabels
+				state.unhealthy = nil
 				state.index = 0
 			}
+			if changed || !reflect.DeepEqual(state.split, split) {
+				state.split = split
+				state.subsets = newSubsets(serviceName, split, state)
+			}
+			state.locality = locality
 			registeredEndpoints[serviceName] = true
 		}
 	}
@@ -131,6 +428,43 @@ func (sb *serviceBalancer) Update(endpoints []api.Endpoints) {
 	}
 }
 
+// localityOf returns the locality policy of a service, assumes the lock is
+// held
+func (sb *serviceBalancer) localityOf(namespace, name string) *api.LocalityPolicy {
+	if spec, ok := sb.serviceSpecs[namespacedName(namespace, name)]; ok && spec.locality != nil {
+		return spec.locality
+	}
+	return sb.DefaultLocality
+}
+
+// newSubsets selects the endpoints of every subset of the split
+func newSubsets(service ServicePortName, split *api.TrafficSplit, state *balancerState) []*subsetState {
+	if split == nil {
+		return nil
+	}
+	subsets := make([]*subsetState, 0, len(split.Subsets))
+	for _, subset := range split.Subsets {
+		selector, err := labels.Parse(subset.Selector)
+		if err != nil {
+			log.Printf("ignoring subset %s of %s: %v", subset.Name, service, err)
+			continue
+		}
+		s := &subsetState{name: subset.Name, weight: subset.Weight}
+		for i, endpoint := range state.endpoints {
+			if selector.Matches(labels.Set(state.labels[i])) {
+				s.endpoints = append(s.endpoints, endpoint)
+				s.topology = append(s.topology, state.topology[i])
+			}
+		}
+		subsets = append(subsets, s)
+	}
+	return subsets
+}
+
+func namespacedName(namespace, name string) string {
+	return namespace + "/" + name
+}
+
 func endpointsToSlice(hostPorts []hostPort) []string {
 	var out []string
 	for _, hostPort := range hostPorts {
@@ -139,6 +473,22 @@ func endpointsToSlice(hostPorts []hostPort) []string {
 	return out
 }
 
+func topologyToSlice(hostPorts []hostPort) []api.Topology {
+	var out []api.Topology
+	for _, hostPort := range hostPorts {
+		out = append(out, hostPort.topology)
+	}
+	return out
+}
+
+func labelsToSlice(hostPorts []hostPort) []map[string]string {
+	var out []map[string]string
+	for _, hostPort := range hostPorts {
+		out = append(out, hostPort.labels)
+	}
+	return out
+}
+
 func equalSlices(src, dst []string) bool {
 	if len(src) != len(dst) {
 		return false
@@ -1,13 +1,15 @@
 package proxy
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/twanies/flow/api"
 )
 
 func TestNewService(t *testing.T) {
-	serviceName := ServicePortName{"fooo", "bar"}
+	serviceName := ServicePortName{Name: "fooo", Port: "bar"}
 	balancer := NewServiceBalancer()
 	balancer.AddService(serviceName)
 	_, ok := balancer.services[serviceName]
@@ -20,7 +22,7 @@ func TestLoadBalancerFailsNoEndpoints(t *testing.T) {
 	var endpoints []api.Endpoints
 	loadBalancer := NewServiceBalancer()
 	loadBalancer.Update(endpoints)
-	service := ServicePortName{"foo", "bar"}
+	service := ServicePortName{Name: "foo", Port: "bar"}
 	endpoint, err := loadBalancer.NextEndpoint(service)
 	if err == nil {
 		t.Error("loadBalancer didnt fail with no endpoints")
@@ -31,7 +33,7 @@ func TestLoadBalancerFailsNoEndpoints(t *testing.T) {
 }
 
 func TestExpectEndpoints(t *testing.T) {
-	serviceName := ServicePortName{"foo", "a"}
+	serviceName := ServicePortName{Name: "foo", Port: "a"}
 	endpoints := api.Endpoints{
 		Name:      "foo",
 		Addresses: []string{"1.1"},
@@ -52,8 +54,8 @@ func TestExpectEndpoints(t *testing.T) {
 }
 
 func TestExpectMultipleEndpointsMultiplePorts(t *testing.T) {
-	serviceName1 := ServicePortName{"foo", "a"}
-	serviceName2 := ServicePortName{"foo", "b"}
+	serviceName1 := ServicePortName{Name: "foo", Port: "a"}
+	serviceName2 := ServicePortName{Name: "foo", Port: "b"}
 	endpoints := api.Endpoints{
 		Name:      "foo",
 		Addresses: []string{"1.1", "1.2"},
@@ -77,8 +79,8 @@ func TestExpectMultipleEndpointsMultiplePorts(t *testing.T) {
 }
 
 func TestExpectMultipleEndpointsAndPortsWithUpdate(t *testing.T) {
-	serviceName1 := ServicePortName{"foo", "a"}
-	serviceName2 := ServicePortName{"foo", "b"}
+	serviceName1 := ServicePortName{Name: "foo", Port: "a"}
+	serviceName2 := ServicePortName{Name: "foo", Port: "b"}
 	endpoints := api.Endpoints{
 		Name:      "foo",
 		Addresses: []string{"1.1", "1.2"},
@@ -122,6 +124,19 @@ func TestExpectMultipleEndpointsAndPortsWithUpdate(t *testing.T) {
 	expectEndpoint(t, serviceName1, balancer, curEndpoints[0])
 }
 
+func TestEndpointsSeparatedByNamespace(t *testing.T) {
+	serviceA := ServicePortName{Namespace: "a", Name: "foo", Port: "p"}
+	serviceB := ServicePortName{Namespace: "b", Name: "foo", Port: "p"}
+	balancer := NewServiceBalancer()
+	balancer.Update([]api.Endpoints{
+		{Name: "foo", Namespace: "a", Addresses: []string{"1.1"}, Ports: []api.EndpointPort{{"p", 80}}},
+		{Name: "foo", Namespace: "b", Addresses: []string{"1.2"}, Ports: []api.EndpointPort{{"p", 80}}},
+	})
+	expectEndpoint(t, serviceA, balancer, "1.1:80")
+	expectEndpoint(t, serviceB, balancer, "1.2:80")
+	expectEndpoint(t, serviceA, balancer, "1.1:80")
+}
+
 func expectEndpoint(t *testing.T, service ServicePortName, balancer *serviceBalancer, expected string) {
 	endpoint, err := balancer.NextEndpoint(service)
 	if err != nil {
@@ -163,3 +178,247 @@ func TestEqualSlicesUnsorted(t *testing.T) {
 		t.Errorf("expected slices to be equal")
 	}
 }
+
+func TestServiceTargetPorts(t *testing.T) {
+	balancer := NewServiceBalancer()
+	balancer.UpdateServices([]api.Service{{
+		Name: "foo",
+		Ports: []api.ServicePort{
+			{Name: "web", TargetPort: 8080},
+			{Name: "admin", TargetPortName: "management"},
+			{Name: "metrics"},
+		},
+	}})
+	balancer.Update([]api.Endpoints{
+		{
+			Name:      "foo",
+			Addresses: []string{"1.1", "1.2"},
+			Ports: []api.EndpointPort{
+				{Name: "management", Port: 9000},
+				{Name: "metrics", Port: 9100},
+				{Name: "unused", Port: 9200},
+			},
+		},
+		// endpoints of a service without spec keep their own port names
+		{
+			Name:      "bar",
+			Addresses: []string{"1.3"},
+			Ports:     []api.EndpointPort{{Name: "a", Port: 7000}},
+		},
+	})
+	expectEndpoint(t, ServicePortName{Name: "foo", Port: "web"}, balancer, "1.1:8080")
+	expectEndpoint(t, ServicePortName{Name: "foo", Port: "web"}, balancer, "1.2:8080")
+	expectEndpoint(t, ServicePortName{Name: "foo", Port: "admin"}, balancer, "1.1:9000")
+	expectEndpoint(t, ServicePortName{Name: "foo", Port: "metrics"}, balancer, "1.1:9100")
+	expectEndpoint(t, ServicePortName{Name: "bar", Port: "a"}, balancer, "1.3:7000")
+	if _, err := balancer.NextEndpoint(ServicePortName{Name: "foo", Port: "unused"}); err == nil {
+		t.Fatal("expected endpoint ports not used by the service not to be balanced")
+	}
+
+	// changing the target port applies to the known endpoints
+	balancer.UpdateServices([]api.Service{{
+		Name:  "foo",
+		Ports: []api.ServicePort{{Name: "web", TargetPort: 8081}},
+	}})
+	expectEndpoint(t, ServicePortName{Name: "foo", Port: "web"}, balancer, "1.1:8081")
+}
+
+func TestBareAddressEndpoints(t *testing.T) {
+	balancer := NewServiceBalancer()
+	balancer.UpdateServices([]api.Service{{
+		Namespace: "payments",
+		Name:      "foo",
+		Ports:     []api.ServicePort{{Name: "a", TargetPort: 80}},
+	}})
+	balancer.Update([]api.Endpoints{{
+		Namespace: "payments",
+		Name:      "foo",
+		Addresses: []string{"10.0.0.1"},
+	}})
+	expectEndpoint(t, ServicePortName{Namespace: "payments", Name: "foo", Port: "a"}, balancer, "10.0.0.1:80")
+}
+
+func TestPreferLocalEndpoints(t *testing.T) {
+	serviceName := ServicePortName{Namespace: "default", Name: "foo", Port: "a"}
+	service := api.Service{
+		Namespace: "default",
+		Name:      "foo",
+		Ports:     []api.ServicePort{{Name: "a", TargetPort: 80}},
+		Locality:  &api.LocalityPolicy{Mode: api.LocalityPreferLocal},
+	}
+	endpoints := api.Endpoints{
+		Namespace: "default",
+		Name:      "foo",
+		Addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.1.0.1"},
+		Topology: map[string]api.Topology{
+			"10.0.0.1": {Node: "n1", Zone: "a", Region: "eu"},
+			"10.0.0.2": {Node: "n2", Zone: "a", Region: "eu"},
+			"10.0.1.1": {Node: "n3", Zone: "b", Region: "eu"},
+			"10.1.0.1": {Node: "n4", Zone: "c", Region: "us"},
+		},
+	}
+	now := time.Now()
+	balancer := NewServiceBalancer()
+	balancer.now = func() time.Time { return now }
+	balancer.Topology = api.Topology{Node: "n1", Zone: "a", Region: "eu"}
+	balancer.UpdateServices([]api.Service{service})
+	balancer.Update([]api.Endpoints{endpoints})
+
+	// the endpoint on the node gets every connection
+	expectEndpoint(t, serviceName, balancer, "10.0.0.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.1:80")
+
+	// without the local endpoint connections spill over to the zone
+	balancer.ReportFailure(serviceName, "10.0.0.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.2:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.2:80")
+
+	// and to the region when the zone has too few endpoints
+	service.Locality.MinEndpoints = 2
+	balancer.UpdateServices([]api.Service{service})
+	balancer.ReportFailure(serviceName, "10.0.0.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.2:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.1.1:80")
+
+	// failed endpoints are used again after a while
+	now = now.Add(failedEndpointTimeout)
+	expectEndpoint(t, serviceName, balancer, "10.0.0.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.2:80")
+}
+
+func TestReportFailure(t *testing.T) {
+	serviceName := ServicePortName{Namespace: "default", Name: "foo", Port: "a"}
+	now := time.Now()
+	balancer := NewServiceBalancer()
+	balancer.now = func() time.Time { return now }
+	balancer.Update([]api.Endpoints{{
+		Namespace: "default",
+		Name:      "foo",
+		Addresses: []string{"10.0.0.1", "10.0.0.2"},
+		Ports:     []api.EndpointPort{{Name: "a", Port: 80}},
+	}})
+
+	// round robin services avoid failed endpoints as well
+	balancer.ReportFailure(serviceName, "10.0.0.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.2:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.2:80")
+
+	// every endpoint is used when all of them failed
+	balancer.ReportFailure(serviceName, "10.0.0.2:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.2:80")
+
+	now = now.Add(failedEndpointTimeout)
+	balancer.ReportFailure(serviceName, "10.0.0.2:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.0.1:80")
+}
+
+func TestDefaultLocality(t *testing.T) {
+	serviceName := ServicePortName{Namespace: "default", Name: "foo", Port: "a"}
+	endpoints := api.Endpoints{
+		Namespace: "default",
+		Name:      "foo",
+		Addresses: []string{"10.0.0.1", "10.0.1.1"},
+		Ports:     []api.EndpointPort{{Name: "a", Port: 80}},
+		Topology:  map[string]api.Topology{"10.0.1.1": {Zone: "b"}},
+	}
+	balancer := NewServiceBalancer()
+	balancer.Topology = api.Topology{Zone: "b"}
+	balancer.Update([]api.Endpoints{endpoints})
+	expectEndpoint(t, serviceName, balancer, "10.0.0.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.1.1:80")
+
+	balancer.DefaultLocality = &api.LocalityPolicy{Mode: api.LocalityPreferLocal}
+	balancer.Update([]api.Endpoints{endpoints})
+	expectEndpoint(t, serviceName, balancer, "10.0.1.1:80")
+	expectEndpoint(t, serviceName, balancer, "10.0.1.1:80")
+}
+
+func TestTrafficSplit(t *testing.T) {
+	serviceName := ServicePortName{Namespace: "default", Name: "foo", Port: "a"}
+	service := api.Service{
+		Namespace: "default",
+		Name:      "foo",
+		Ports:     []api.ServicePort{{Name: "a", TargetPort: 80}},
+		Split: &api.TrafficSplit{Subsets: []api.Subset{
+			{Name: "stable", Selector: "version=v1", Weight: 95},
+			{Name: "canary", Selector: "version=v2", Weight: 5},
+		}},
+	}
+	endpoints := api.Endpoints{
+		Namespace: "default",
+		Name:      "foo",
+		Addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+		AddressLabels: map[string]map[string]string{
+			"10.0.0.1": {"version": "v1"},
+			"10.0.0.2": {"version": "v1"},
+			"10.0.0.3": {"version": "v2"},
+		},
+	}
+	balancer := NewServiceBalancer()
+	balancer.UpdateServices([]api.Service{service})
+	balancer.Update([]api.Endpoints{endpoints})
+
+	count := func(n int) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			endpoint, err := balancer.NextEndpoint(serviceName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[endpoint]++
+		}
+		return counts
+	}
+	// the endpoint without labels is in no subset
+	expected := map[string]int{"10.0.0.1:80": 48, "10.0.0.2:80": 47, "10.0.0.3:80": 5}
+	if counts := count(100); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v got %v", expected, counts)
+	}
+
+	// the split is changed at runtime without touching the endpoints
+	service.Split = &api.TrafficSplit{Subsets: []api.Subset{
+		{Name: "stable", Selector: "version=v1", Weight: 50},
+		{Name: "canary", Selector: "version=v2", Weight: 50},
+	}}
+	balancer.UpdateServices([]api.Service{service})
+	expected = map[string]int{"10.0.0.1:80": 25, "10.0.0.2:80": 25, "10.0.0.3:80": 50}
+	if counts := count(100); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v got %v", expected, counts)
+	}
+
+	// the share of a subset without endpoints goes to the other subsets
+	endpoints.Addresses = []string{"10.0.0.1", "10.0.0.2", "10.0.0.4"}
+	delete(endpoints.AddressLabels, "10.0.0.3")
+	balancer.Update([]api.Endpoints{endpoints})
+	expected = map[string]int{"10.0.0.1:80": 2, "10.0.0.2:80": 2}
+	if counts := count(4); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v got %v", expected, counts)
+	}
+
+	// every endpoint is used when no subset has endpoints
+	service.Split = &api.TrafficSplit{Subsets: []api.Subset{{Name: "canary", Selector: "version=v3", Weight: 5}}}
+	balancer.UpdateServices([]api.Service{service})
+	expected = map[string]int{"10.0.0.1:80": 1, "10.0.0.2:80": 1, "10.0.0.4:80": 1}
+	if counts := count(3); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v got %v", expected, counts)
+	}
+
+	// drained subsets receive no connections, not even when they are the
+	// only ones with endpoints
+	service.Split = &api.TrafficSplit{Subsets: []api.Subset{
+		{Name: "stable", Selector: "version=v1", Weight: 0},
+		{Name: "canary", Selector: "version=v3", Weight: 5},
+	}}
+	balancer.UpdateServices([]api.Service{service})
+	expected = map[string]int{"10.0.0.4:80": 3}
+	if counts := count(3); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v got %v", expected, counts)
+	}
+	endpoints.Addresses = []string{"10.0.0.1", "10.0.0.2"}
+	balancer.Update([]api.Endpoints{endpoints})
+	if endpoint, err := balancer.NextEndpoint(serviceName); err != errMissingEndpoints {
+		t.Errorf("expected no endpoint of the drained subset, got %q: %v", endpoint, err)
+	}
+}
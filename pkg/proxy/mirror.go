@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+const (
+	// maxMirrorBacklog is the number of reads queued for a mirror connection,
+	// a mirror which falls further behind is dropped
+	maxMirrorBacklog = 64
+
+	// mirrorWriteTimeout is the time a write to a mirror connection can take
+	mirrorWriteTimeout = 5 * time.Second
+)
+
+// Sampler picks a percentage of the calls to Sample, spread evenly over the
+// calls
+type Sampler struct {
+	n uint64
+}
+
+// Sample reports if the call is part of the percent of sampled calls
+func (s *Sampler) Sample(percent int) bool {
+	n := atomic.AddUint64(&s.n, 1)
+	return n*uint64(percent)/100 != (n-1)*uint64(percent)/100
+}
+
+// MirrorService returns the service port a mirror of service sends to
+func MirrorService(service ServicePortName, mirror *api.Mirror) ServicePortName {
+	port := mirror.ServicePort
+	if port == "" {
+		port = service.Port
+	}
+	return ServicePortName{Namespace: service.Namespace, Name: mirror.Service, Port: port}
+}
+
+// teeConn copies the bytes read from the client to a mirror connection. The
+// mirror is written asynchronously, reads from the client never wait for it.
+type teeConn struct {
+	net.Conn
+	mirror *mirrorWriter
+}
+
+func (c *teeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mirror.write(p[:n])
+	}
+	return n, err
+}
+
+// CloseWrite keeps the half close of the client working
+func (c *teeConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *teeConn) Close() error {
+	c.mirror.close()
+	return c.Conn.Close()
+}
+
+// mirrorWriter queues the bytes for a mirror connection. The mirror is dropped
+// when the queue is full or a write fails.
+type mirrorWriter struct {
+	mu     sync.Mutex // protects following
+	chunks chan []byte
+	closed bool
+}
+
+// newTeeConn tees the bytes read from conn to an endpoint of mirror
+func newTeeConn(conn net.Conn, mirror ServicePortName, proxy *Proxier) *teeConn {
+	w := &mirrorWriter{chunks: make(chan []byte, maxMirrorBacklog)}
+	go w.run(mirror, proxy)
+	return &teeConn{Conn: conn, mirror: w}
+}
+
+func (w *mirrorWriter) write(p []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	select {
+	case w.chunks <- chunk:
+	default:
+		w.closed = true
+		close(w.chunks)
+	}
+}
+
+func (w *mirrorWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.chunks)
+	}
+}
+
+// run connects to the mirror and writes the queued bytes to it, the responses
+// of the mirror are discarded
+func (w *mirrorWriter) run(mirror ServicePortName, proxy *Proxier) {
+	conn, err := connectEndpoint(mirror, "tcp", proxy)
+	if err != nil {
+		log.Printf("failed to connect to mirror %s: %v", mirror, err)
+		w.close()
+		for range w.chunks {
+		}
+		return
+	}
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+	failed := false
+	for chunk := range w.chunks {
+		if failed {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+		if _, err := conn.Write(chunk); err != nil {
+			log.Printf("dropping mirror %s: %v", mirror, err)
+			w.close()
+			failed = true
+		}
+	}
+}
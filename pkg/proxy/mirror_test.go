@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+func TestSampler(t *testing.T) {
+	tests := []struct {
+		percent int
+		calls   int
+		want    int
+	}{
+		{percent: 100, calls: 10, want: 10},
+		{percent: 50, calls: 10, want: 5},
+		{percent: 5, calls: 100, want: 5},
+		{percent: 1, calls: 99, want: 0},
+	}
+	for _, test := range tests {
+		var sampler Sampler
+		got := 0
+		for i := 0; i < test.calls; i++ {
+			if sampler.Sample(test.percent) {
+				got++
+			}
+		}
+		if got != test.want {
+			t.Errorf("%d%% of %d calls: expected %d samples, got %d", test.percent, test.calls, test.want, got)
+		}
+	}
+}
+
+func TestMirrorTCP(t *testing.T) {
+	mirror, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirror.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := mirror.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	lb := NewServiceBalancer()
+	lb.Update([]api.Endpoints{
+		{
+			Name:      "foo",
+			Addresses: []string{"127.0.0.1"},
+			Ports:     []api.EndpointPort{{Name: "a", Port: tcpServerPort}},
+		},
+		{
+			Name:      "shadow",
+			Addresses: []string{"127.0.0.1"},
+			Ports:     []api.EndpointPort{{Name: "a", Port: mirror.Addr().(*net.TCPAddr).Port}},
+		},
+	})
+	proxier := NewProxier(lb)
+	proxier.Update([]api.Service{{
+		Name: "foo",
+		Ports: []api.ServicePort{{
+			Name: "a", Port: 91, TargetPort: tcpServerPort, Protocol: "tcp",
+			Mirror: &api.Mirror{Service: "shadow", Percent: 100},
+		}},
+	}})
+	defer proxier.Update([]api.Service{})
+	info, ok := proxier.getServiceInfo(ServicePortName{Name: "foo", Port: "a"})
+	if !ok {
+		t.Fatal("expected service foo to be proxied")
+	}
+	testReadWriteTCP(t, "127.0.0.1", info.proxyPort)
+
+	select {
+	case line := <-received:
+		if !strings.HasPrefix(line, "GET /foobar ") {
+			t.Fatalf("expected the mirror to receive the request, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mirror did not receive the request")
+	}
+}
@@ -2,31 +2,55 @@ package proxy
 
 import (
 	"errors"
-	"math/big"
 	"math/rand"
+	"sort"
 	"sync"
+	"time"
 )
 
-var ErrPortClaimed = errors.New("port allready claimed")
+var (
+	ErrPortClaimed    = errors.New("port allready claimed")
+	ErrPortOutOfRange = errors.New("port out of range")
+	ErrNoFreePorts    = errors.New("no free ports left in the range")
+)
 
+// PortAllocator hands out ports from the range [min, max). The free ports are
+// kept in a slice with the position of every port in a second slice, so
+// assigning, allocating and releasing a port are constant time.
 type PortAllocator struct {
-	port chan int
-	min  int
-	max  int
+	min int
+	max int
 
-	mu      sync.RWMutex
-	claimed big.Int
-	last    int
+	mu    sync.Mutex // protects following
+	rand  *rand.Rand
+	free  []int // ports which are not claimed, in no particular order
+	index []int // position of port-min in free, -1 when the port is claimed
 }
 
+// NewPortAllocator returns an allocator handing out random ports from the
+// range [min, max).
 func NewPortAllocator(min, max int) *PortAllocator {
-	port := make(chan int)
+	return NewPortAllocatorWithSource(min, max, rand.NewSource(time.Now().UnixNano()))
+}
+
+// NewPortAllocatorWithSource returns an allocator picking ports with src, a
+// source with a fixed seed gives the same assignments every run.
+func NewPortAllocatorWithSource(min, max int, src rand.Source) *PortAllocator {
 	p := &PortAllocator{
-		port: port,
 		min:  min,
 		max:  max,
+		rand: rand.New(src),
+	}
+	size := p.portRange()
+	if size < 0 {
+		size = 0
+	}
+	p.free = make([]int, size)
+	p.index = make([]int, size)
+	for i := 0; i < size; i++ {
+		p.free[i] = min + i
+		p.index[i] = i
 	}
-	go p.run(port)
 	return p
 }
 
@@ -34,56 +58,80 @@ func (p *PortAllocator) portRange() int {
 	return p.max - p.min
 }
 
+func (p *PortAllocator) inRange(port int) bool {
+	return port >= p.min && port < p.max
+}
+
+// AssignNext claims a random free port
 func (p *PortAllocator) AssignNext() (int, error) {
-	port := <-p.port
-	if port == -1 {
-		return -1, ErrPortClaimed
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.free) == 0 {
+		return -1, ErrNoFreePorts
 	}
+	port := p.free[p.rand.Intn(len(p.free))]
+	p.claim(port)
 	return port, nil
 }
 
-func (p *PortAllocator) run(port chan int) {
-	for {
-		port <- p.nextPort()
+// AllocatePort claims the given port
+func (p *PortAllocator) AllocatePort(port int) error {
+	if !p.inRange(port) {
+		return ErrPortOutOfRange
 	}
-}
-
-func (p *PortAllocator) nextPort() int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	portRange := p.portRange()
-	i := rand.Intn(portRange)
-	if b := p.claimed.Bit(i); b == 0 {
-		p.claimed.SetBit(&p.claimed, i, 1)
-		port := p.min + i
-		p.last = port
-		return port
-	}
-	for x := i + 1; x < portRange; x++ {
-		if b := p.claimed.Bit(x); b == 0 {
-			p.claimed.SetBit(&p.claimed, x, 1)
-			port := p.min + x
-			p.last = port
-			return port
-		}
-	}
-	for x := 0; x < i; x++ {
-		if b := p.claimed.Bit(x); b == 0 {
-			p.claimed.SetBit(&p.claimed, x, 1)
-			port := p.min + x
-			p.last = port
-			return port
-		}
+	if p.index[port-p.min] == -1 {
+		return ErrPortClaimed
 	}
-	return -1
+	p.claim(port)
+	return nil
+}
+
+// claim removes port from the free ports by moving the last free port into
+// its position. Assumes the lock is held and the port is free.
+func (p *PortAllocator) claim(port int) {
+	i := p.index[port-p.min]
+	last := p.free[len(p.free)-1]
+	p.free[i] = last
+	p.index[last-p.min] = i
+	p.free = p.free[:len(p.free)-1]
+	p.index[port-p.min] = -1
 }
 
+// Release returns a claimed port to the free ports. Ports out of range or not
+// claimed are ignored.
 func (p *PortAllocator) Release(port int) {
-	port -= p.min
-	if port < 0 || port > p.portRange() {
+	if !p.inRange(port) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.index[port-p.min] != -1 {
 		return
 	}
+	p.index[port-p.min] = len(p.free)
+	p.free = append(p.free, port)
+}
+
+// Used returns the claimed ports in ascending order
+func (p *PortAllocator) Used() []int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.claimed.SetBit(&p.claimed, port, 0)
+	used := make([]int, 0, len(p.index)-len(p.free))
+	for i, pos := range p.index {
+		if pos == -1 {
+			used = append(used, p.min+i)
+		}
+	}
+	return used
+}
+
+// Free returns the free ports in ascending order
+func (p *PortAllocator) Free() []int {
+	p.mu.Lock()
+	free := append([]int(nil), p.free...)
+	p.mu.Unlock()
+	sort.Ints(free)
+	return free
 }
@@ -1,6 +1,10 @@
 package proxy
 
-import "testing"
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
 
 func TestAssignFullRange(t *testing.T) {
 	p := NewPortAllocator(2000, 3000)
@@ -46,3 +50,98 @@ func TestAssignAllReleaseAll(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAllocatePort(t *testing.T) {
+	p := NewPortAllocator(2000, 2010)
+	if err := p.AllocatePort(2010); err != ErrPortOutOfRange {
+		t.Fatalf("expected port 2010 to be out of range got %v", err)
+	}
+	if err := p.AllocatePort(2005); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AllocatePort(2005); err != ErrPortClaimed {
+		t.Fatalf("expected port 2005 to be claimed got %v", err)
+	}
+	for i := 0; i < 9; i++ {
+		port, err := p.AssignNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port == 2005 {
+			t.Fatal("expected the allocated port not to be assigned")
+		}
+	}
+	if _, err := p.AssignNext(); err != ErrNoFreePorts {
+		t.Fatalf("expected the range to be exhausted got %v", err)
+	}
+	p.Release(2005)
+	if err := p.AllocatePort(2005); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseOutOfRange(t *testing.T) {
+	p := NewPortAllocator(2000, 2002)
+	p.AllocatePort(2000)
+	p.AllocatePort(2001)
+	// max is not part of the range, releasing it must not free a port
+	p.Release(2002)
+	p.Release(1999)
+	if free := p.Free(); len(free) != 0 {
+		t.Fatalf("expected no free ports got %v", free)
+	}
+	// releasing a port twice frees it once
+	p.Release(2001)
+	p.Release(2001)
+	if free := p.Free(); !reflect.DeepEqual(free, []int{2001}) {
+		t.Fatalf("expected port 2001 to be free got %v", free)
+	}
+}
+
+func TestUsedFree(t *testing.T) {
+	p := NewPortAllocator(2000, 2005)
+	p.AllocatePort(2003)
+	p.AllocatePort(2001)
+	if used := p.Used(); !reflect.DeepEqual(used, []int{2001, 2003}) {
+		t.Fatalf("expected used ports [2001 2003] got %v", used)
+	}
+	if free := p.Free(); !reflect.DeepEqual(free, []int{2000, 2002, 2004}) {
+		t.Fatalf("expected free ports [2000 2002 2004] got %v", free)
+	}
+}
+
+func TestSeededAllocation(t *testing.T) {
+	assign := func() []int {
+		p := NewPortAllocatorWithSource(2000, 3000, rand.NewSource(42))
+		var ports []int
+		for i := 0; i < 20; i++ {
+			port, err := p.AssignNext()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%3 == 0 {
+				p.Release(port)
+			}
+			ports = append(ports, port)
+		}
+		return ports
+	}
+	if first, second := assign(), assign(); !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected the same seed to assign the same ports, got %v and %v", first, second)
+	}
+}
+
+func BenchmarkAssignRelease(b *testing.B) {
+	p := NewPortAllocatorWithSource(1024, 65536, rand.NewSource(1))
+	for i := 0; i < 60000; i++ {
+		p.AssignNext()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		port, err := p.AssignNext()
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.Release(port)
+	}
+}
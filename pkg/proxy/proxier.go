@@ -1,11 +1,17 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/twanies/flow/api"
+	"github.com/twanies/flow/pkg/tlsutil"
 )
 
 type serviceInfo struct {
@@ -14,11 +20,58 @@ type serviceInfo struct {
 
 	// proxyPort is the port assigned by flow where the service proxy wil listen on
 	proxyPort int
+
+	// requestedPort is the port requested by the service, zero when the proxy
+	// port is assigned by flow
+	requestedPort int
+
+	// tlsConfig terminates tls on the proxy port when set, tls is the spec it
+	// is loaded from
+	tlsConfig *tls.Config
+	tls       *api.ServiceTLS
+
+	// proxyProtocol is the PROXY protocol version sent to the endpoints,
+	// acceptProxyProtocol reads the header from the clients.
+	proxyProtocol       string
+	acceptProxyProtocol bool
+
+	// limiter admits the connections to the service, limits are the limits it
+	// enforces
+	limiter *connLimiter
+	limits  *api.ConnectionLimits
+
+	timeouts connTimeouts
+
+	// mirror tees the bytes sent by a share of the clients to another service
+	mirror   *api.Mirror
+	mirrored Sampler
+}
+
+// default range of the ports assigned to services, max is not included
+const (
+	DefaultPortMin = 2000
+	DefaultPortMax = 3000
+)
+
+// PortStore persists the proxy ports assigned to service ports, so a service
+// keeps its port across restarts and is proxied on the same port by every
+// flow node.
+type PortStore interface {
+	// ClaimProxyPort stores proxyPort for the service port unless a port is
+	// stored already, it returns the stored port.
+	ClaimProxyPort(namespace, name, port string, proxyPort int) (int, error)
+	ReleaseProxyPort(namespace, name, port string) error
 }
 
 // Proxier proxies incomming traffic between its endpoints
 type Proxier struct {
+	// DefaultLimits and DefaultTimeouts apply to service ports which do not
+	// set their own limits or timeouts
+	DefaultLimits   *api.ConnectionLimits
+	DefaultTimeouts *api.ConnectionTimeouts
+
 	loadBalancer LoadBalancer
+	portStore    PortStore
 
 	// number of accepted connections in the proxyLoop. Atomicly updated
 	numLoops int32
@@ -26,45 +79,143 @@ type Proxier struct {
 	mu         sync.RWMutex // protects following
 	serviceMap map[ServicePortName]*serviceInfo
 	proxyPorts *PortAllocator
+	sniRoutes  map[string]sniRoute
+	sni        *sniSocket
+
+	// sniLimiters of the passthrough services, by service port
+	sniLimiters map[ServicePortName]sniLimiter
 }
 
 func NewProxier(loadBalancer LoadBalancer) *Proxier {
-	proxyPorts := NewPortAllocator(2000, 3000)
+	return NewProxierWithPorts(loadBalancer, NewPortAllocator(DefaultPortMin, DefaultPortMax), nil)
+}
+
+// NewProxierWithPorts returns a proxier assigning ports from proxyPorts to
+// services which do not request a port. Assignments are persisted in store
+// when it is not nil.
+func NewProxierWithPorts(loadBalancer LoadBalancer, proxyPorts *PortAllocator, store PortStore) *Proxier {
 	return &Proxier{
 		loadBalancer: loadBalancer,
+		portStore:    store,
 		serviceMap:   make(map[ServicePortName]*serviceInfo),
 		proxyPorts:   proxyPorts,
+		sniRoutes:    make(map[string]sniRoute),
+		sniLimiters:  make(map[ServicePortName]sniLimiter),
+	}
+}
+
+func (p *Proxier) limitsOf(port *api.ServicePort) *api.ConnectionLimits {
+	if port.Limits != nil {
+		return port.Limits
 	}
+	return p.DefaultLimits
+}
+
+func (p *Proxier) timeoutsOf(port *api.ServicePort) *api.ConnectionTimeouts {
+	if port.Timeouts != nil {
+		return port.Timeouts
+	}
+	return p.DefaultTimeouts
 }
 
 // Update will sync the endpoints to their new state
 func (p *Proxier) Update(services []api.Service) {
+	p.loadBalancer.UpdateServices(services)
 	activeServices := make(map[ServicePortName]bool)
+	sniRoutes := make(map[string]sniRoute)
+	sniLimiters := make(map[ServicePortName]sniLimiter)
 	for i := range services {
 		service := &services[i]
 
 		for i := range service.Ports {
 			servicePort := &service.Ports[i]
-			serviceName := ServicePortName{service.Name, servicePort.Name}
+			serviceName := ServicePortName{service.Namespace, service.Name, servicePort.Name}
+			if servicePort.TLS != nil && servicePort.TLS.Mode == api.TLSPassthrough {
+				// passthrough ports share the sni port instead of having their own
+				limiter := p.sniLimiter(serviceName, p.limitsOf(servicePort))
+				sniLimiters[serviceName] = limiter
+				for _, name := range servicePort.TLS.ServerNames {
+					name = strings.ToLower(name)
+					// a name claimed by several services is served by the
+					// first service in name order, whatever order they
+					// arrive in
+					if existing, ok := sniRoutes[name]; ok {
+						first, other := existing.service, serviceName
+						if servicePortLess(other, first) {
+							first, other = other, first
+						}
+						log.Printf("server name %s of %s is already served by %s", name, other, first)
+						if first == existing.service {
+							continue
+						}
+					}
+					sniRoutes[name] = sniRoute{
+						service:       serviceName,
+						proxyProtocol: servicePort.ProxyProtocol,
+						timeouts:      newConnTimeouts(p.timeoutsOf(servicePort)),
+						limiter:       limiter.limiter,
+					}
+				}
+				p.loadBalancer.AddService(serviceName)
+				continue
+			}
 			activeServices[serviceName] = true
 			info, exists := p.getServiceInfo(serviceName)
-			if exists && sameInfo(info, service, servicePort) {
+			if exists && p.sameInfo(info, servicePort) {
 				// no updates
 				continue
 			}
-			if exists {
+			if exists && sameListener(info, servicePort) {
 				log.Printf("receiving updates for service %s", serviceName)
-				panic("no implementation")
-			}
-			log.Printf("discovering %s as a new service", serviceName)
-			port, err := p.proxyPorts.AssignNext()
-			if err != nil {
-				log.Printf("failed to assign new port for %s", serviceName)
+				p.updateService(serviceName, info, servicePort)
 				continue
 			}
-			info, err = p.addServiceToPort(serviceName, servicePort.Protocol, port)
-			if err != nil {
+			var port int
+			var err error
+			if exists {
+				// the listener is reopened, on the same port unless the
+				// service requests another one
+				log.Printf("restarting service %s", serviceName)
+				keepPort := servicePort.Port == info.requestedPort
+				p.stopService(serviceName, info, !keepPort)
+				if keepPort {
+					port = info.proxyPort
+				}
+			} else {
+				log.Printf("discovering %s as a new service", serviceName)
+			}
+			if port == 0 {
+				port, err = p.assignPort(serviceName, servicePort)
+				if err != nil {
+					log.Printf("failed to assign new port for %s: %v", serviceName, err)
+					continue
+				}
+			}
+			info = &serviceInfo{
+				protocol:            servicePort.Protocol,
+				proxyPort:           port,
+				requestedPort:       servicePort.Port,
+				tls:                 servicePort.TLS,
+				proxyProtocol:       servicePort.ProxyProtocol,
+				acceptProxyProtocol: servicePort.AcceptProxyProtocol,
+				limiter:             newConnLimiter(p.limitsOf(servicePort)),
+				limits:              p.limitsOf(servicePort),
+				timeouts:            newConnTimeouts(p.timeoutsOf(servicePort)),
+				mirror:              servicePort.Mirror,
+			}
+			if servicePort.TLS != nil && servicePort.TLS.Mode == api.TLSTerminate {
+				info.tlsConfig, err = tlsutil.ServerConfig(servicePort.TLS.CertFile, servicePort.TLS.KeyFile, "")
+				if err != nil {
+					log.Printf("failed to load the certificate of %s: %v", serviceName, err)
+					// the stored port is kept, the service gets it back
+					// once it starts
+					p.proxyPorts.Release(port)
+					continue
+				}
+			}
+			if err := p.startService(serviceName, info); err != nil {
 				log.Printf("failed to start proxy for %s: %v", serviceName, err)
+				p.proxyPorts.Release(port)
 				continue
 			}
 			log.Printf("service %s running on port %d", serviceName, port)
@@ -74,6 +225,8 @@ func (p *Proxier) Update(services []api.Service) {
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.sniRoutes = sniRoutes
+	p.sniLimiters = sniLimiters
 	for service, info := range p.serviceMap {
 		if !activeServices[service] {
 			// Stop the service internal
@@ -82,13 +235,180 @@ func (p *Proxier) Update(services []api.Service) {
 			if err := info.socket.Close(); err != nil {
 				log.Printf("failed to stop service %s", service)
 			}
-			p.proxyPorts.Release(info.proxyPort)
+			p.releasePort(service, info.proxyPort)
+		}
+	}
+}
+
+// sniLimiter returns the limiter of a passthrough service, the limiter of a
+// known service is kept and updated to limits
+func (p *Proxier) sniLimiter(service ServicePortName, limits *api.ConnectionLimits) sniLimiter {
+	p.mu.RLock()
+	current, ok := p.sniLimiters[service]
+	p.mu.RUnlock()
+	if !ok {
+		return sniLimiter{limiter: newConnLimiter(limits), limits: limits}
+	}
+	if !reflect.DeepEqual(current.limits, limits) {
+		current.limiter.setLimits(limits)
+		current.limits = limits
+	}
+	return current
+}
+
+// assignPort returns the proxy port of a new service port. The port requested
+// by the service is used as is, else the port stored for the service or a new
+// port from the allocator.
+func (p *Proxier) assignPort(service ServicePortName, servicePort *api.ServicePort) (int, error) {
+	if servicePort.Port != 0 {
+		// requested ports outside of the range are not tracked by the allocator
+		if err := p.proxyPorts.AllocatePort(servicePort.Port); err != nil && err != ErrPortOutOfRange {
+			return 0, err
+		}
+		return servicePort.Port, nil
+	}
+	port, err := p.proxyPorts.AssignNext()
+	if err != nil {
+		return 0, err
+	}
+	if p.portStore == nil {
+		return port, nil
+	}
+	stored, err := p.portStore.ClaimProxyPort(service.Namespace, service.Name, service.Port, port)
+	if err != nil {
+		p.proxyPorts.Release(port)
+		return 0, err
+	}
+	if stored != port {
+		p.proxyPorts.Release(port)
+		if err := p.proxyPorts.AllocatePort(stored); err != nil && err != ErrPortOutOfRange {
+			return 0, fmt.Errorf("stored port %d: %v", stored, err)
 		}
 	}
+	return stored, nil
 }
 
-func sameInfo(info *serviceInfo, service *api.Service, port *api.ServicePort) bool {
-	return true
+// releasePort releases the proxy port of a service which is no longer proxied
+// and its stored port. Ports of services which fail to start on this node are
+// only released from the allocator, the other nodes keep using the stored port.
+func (p *Proxier) releasePort(service ServicePortName, port int) {
+	p.proxyPorts.Release(port)
+	if p.portStore == nil {
+		return
+	}
+	if err := p.portStore.ReleaseProxyPort(service.Namespace, service.Name, service.Port); err != nil {
+		log.Printf("failed to release the stored port of %s: %v", service, err)
+	}
+}
+
+// sameInfo reports if the service port is proxied as described by port
+func (p *Proxier) sameInfo(info *serviceInfo, port *api.ServicePort) bool {
+	return sameListener(info, port) &&
+		info.proxyProtocol == port.ProxyProtocol &&
+		reflect.DeepEqual(info.limits, p.limitsOf(port)) &&
+		info.timeouts == newConnTimeouts(p.timeoutsOf(port)) &&
+		reflect.DeepEqual(info.mirror, port.Mirror)
+}
+
+// sameListener reports if the proxy socket of info can serve port, other
+// changes are applied without reopening the socket
+func sameListener(info *serviceInfo, port *api.ServicePort) bool {
+	return strings.EqualFold(info.protocol, port.Protocol) &&
+		info.requestedPort == port.Port &&
+		info.acceptProxyProtocol == port.AcceptProxyProtocol &&
+		reflect.DeepEqual(info.tls, port.TLS)
+}
+
+// updateService replaces the settings of a running service port which do not
+// need a new socket. Connections in flight keep their settings, the limiter is
+// shared so they stay counted.
+func (p *Proxier) updateService(service ServicePortName, info *serviceInfo, port *api.ServicePort) {
+	updated := &serviceInfo{
+		protocol:            info.protocol,
+		socket:              info.socket,
+		proxyPort:           info.proxyPort,
+		requestedPort:       info.requestedPort,
+		tlsConfig:           info.tlsConfig,
+		tls:                 info.tls,
+		proxyProtocol:       port.ProxyProtocol,
+		acceptProxyProtocol: info.acceptProxyProtocol,
+		limiter:             info.limiter,
+		limits:              p.limitsOf(port),
+		timeouts:            newConnTimeouts(p.timeoutsOf(port)),
+		mirror:              port.Mirror,
+	}
+	updated.limiter.setLimits(updated.limits)
+	p.setServiceInfo(service, updated)
+}
+
+// stopService closes the proxy socket of service. The proxy port is released
+// unless release is false, because the service is restarted on the port.
+func (p *Proxier) stopService(service ServicePortName, info *serviceInfo, release bool) {
+	p.mu.Lock()
+	delete(p.serviceMap, service)
+	p.mu.Unlock()
+	if err := info.socket.Close(); err != nil {
+		log.Printf("failed to stop service %s", service)
+	}
+	if release {
+		p.releasePort(service, info.proxyPort)
+	}
+}
+
+// Stats returns the connection counters of every proxied service
+func (p *Proxier) Stats() map[string]LimitStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	stats := make(map[string]LimitStats, len(p.serviceMap)+len(p.sniLimiters))
+	for service, info := range p.serviceMap {
+		stats[service.String()] = info.limiter.stats()
+	}
+	for service, limiter := range p.sniLimiters {
+		stats[service.String()] = limiter.limiter.stats()
+	}
+	return stats
+}
+
+// Services returns the proxied service ports sorted by name
+func (p *Proxier) Services() []api.NodeService {
+	p.mu.RLock()
+	services := make([]api.NodeService, 0, len(p.serviceMap))
+	for service, info := range p.serviceMap {
+		services = append(services, api.NodeService{
+			Namespace: service.Namespace,
+			Name:      service.Name,
+			Port:      service.Port,
+			ProxyPort: info.proxyPort,
+		})
+	}
+	p.mu.RUnlock()
+	sort.Sort(nodeServices(services))
+	return services
+}
+
+// servicePortLess orders service ports by namespace, name and port
+func servicePortLess(a, b ServicePortName) bool {
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Port < b.Port
+}
+
+type nodeServices []api.NodeService
+
+func (s nodeServices) Len() int      { return len(s) }
+func (s nodeServices) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s nodeServices) Less(i, j int) bool {
+	if s[i].Namespace != s[j].Namespace {
+		return s[i].Namespace < s[j].Namespace
+	}
+	if s[i].Name != s[j].Name {
+		return s[i].Name < s[j].Name
+	}
+	return s[i].Port < s[j].Port
 }
 
 func (p *Proxier) getServiceInfo(service ServicePortName) (*serviceInfo, bool) {
@@ -105,15 +425,27 @@ func (p *Proxier) setServiceInfo(service ServicePortName, info *serviceInfo) {
 }
 
 func (p *Proxier) addServiceToPort(service ServicePortName, protocol string, proxyPort int) (*serviceInfo, error) {
-	sock, err := newProxySocket(protocol, proxyPort)
-	if err != nil {
-		return nil, err
-	}
 	info := &serviceInfo{
 		protocol:  protocol,
 		proxyPort: proxyPort,
-		socket:    sock,
 	}
+	if err := p.startService(service, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// startService opens the proxy socket described by info and starts proxying
+// connections to the endpoints of service
+func (p *Proxier) startService(service ServicePortName, info *serviceInfo) error {
+	if info.limiter == nil {
+		info.limiter = newConnLimiter(nil)
+	}
+	sock, err := newProxySocket(info)
+	if err != nil {
+		return err
+	}
+	info.socket = sock
 	p.setServiceInfo(service, info)
 
 	go func(service ServicePortName, p *Proxier) {
@@ -121,5 +453,5 @@ func (p *Proxier) addServiceToPort(service ServicePortName, protocol string, pro
 		sock.ProxyLoop(service, info, p)
 		atomic.AddInt32(&p.numLoops, -1)
 	}(service, p)
-	return info, nil
+	return nil
 }
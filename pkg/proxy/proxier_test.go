@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -20,7 +21,7 @@ var tcpServerPort int
 
 func TestUpdateProxier(t *testing.T) {
 	lb := NewServiceBalancer()
-	service := ServicePortName{"foo", "b"}
+	service := ServicePortName{Name: "foo", Port: "b"}
 	lb.Update([]api.Endpoints{api.Endpoints{
 		Name:      "foo",
 		Addresses: []string{"127.0.0.1"},
@@ -38,7 +39,7 @@ func TestUpdateProxier(t *testing.T) {
 
 func TestUpdateDelete(t *testing.T) {
 	lb := NewServiceBalancer()
-	service := ServicePortName{"foo", "b"}
+	service := ServicePortName{Name: "foo", Port: "b"}
 	lb.Update([]api.Endpoints{api.Endpoints{
 		Name:      "foo",
 		Addresses: []string{"127.0.0.1"},
@@ -62,7 +63,7 @@ func TestUpdateDelete(t *testing.T) {
 
 func TestTcpUpdateDeleteUpdate(t *testing.T) {
 	lb := NewServiceBalancer()
-	service := ServicePortName{"foo", "a"}
+	service := ServicePortName{Name: "foo", Port: "a"}
 	lb.Update([]api.Endpoints{api.Endpoints{
 		Name:      "foo",
 		Addresses: []string{"127.0.0.1"},
@@ -85,7 +86,7 @@ func TestTcpUpdateDeleteUpdate(t *testing.T) {
 	proxier.Update([]api.Service{api.Service{
 		Name: "foo",
 		Ports: []api.ServicePort{
-			api.ServicePort{"a", 90, 9999, "tcp"},
+			api.ServicePort{Name: "a", Port: 90, TargetPort: tcpServerPort, Protocol: "tcp"},
 		},
 	}})
 
@@ -98,7 +99,7 @@ func TestTcpUpdateDeleteUpdate(t *testing.T) {
 
 func TestCloseProxy(t *testing.T) {
 	lb := NewServiceBalancer()
-	service := ServicePortName{"foo", "a"}
+	service := ServicePortName{Name: "foo", Port: "a"}
 	lb.Update([]api.Endpoints{api.Endpoints{
 		Name:      "foo",
 		Addresses: []string{"127.0.0.1"},
@@ -160,3 +161,149 @@ func init() {
 		panic(err)
 	}
 }
+
+// fakePortStore keeps the claimed ports in memory
+type fakePortStore map[ServicePortName]int
+
+func (f fakePortStore) ClaimProxyPort(namespace, name, port string, proxyPort int) (int, error) {
+	service := ServicePortName{namespace, name, port}
+	if stored, ok := f[service]; ok {
+		return stored, nil
+	}
+	f[service] = proxyPort
+	return proxyPort, nil
+}
+
+func (f fakePortStore) ReleaseProxyPort(namespace, name, port string) error {
+	delete(f, ServicePortName{namespace, name, port})
+	return nil
+}
+
+func TestAssignPort(t *testing.T) {
+	store := fakePortStore{
+		ServicePortName{"default", "stored", "a"}: 4123,
+	}
+	proxier := NewProxierWithPorts(NewServiceBalancer(), NewPortAllocator(4000, 4200), store)
+	tests := []struct {
+		service ServicePortName
+		port    api.ServicePort
+		want    int
+	}{
+		{ServicePortName{"default", "requested", "a"}, api.ServicePort{Name: "a", Port: 4150}, 4150},
+		{ServicePortName{"default", "outofrange", "a"}, api.ServicePort{Name: "a", Port: 5150}, 5150},
+		{ServicePortName{"default", "stored", "a"}, api.ServicePort{Name: "a"}, 4123},
+	}
+	for _, test := range tests {
+		port, err := proxier.assignPort(test.service, &test.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != test.want {
+			t.Errorf("expected %s to get port %d got %d", test.service, test.want, port)
+		}
+	}
+	if _, err := proxier.assignPort(ServicePortName{"default", "taken", "a"}, &api.ServicePort{Name: "a", Port: 4123}); err != ErrPortClaimed {
+		t.Fatalf("expected a claimed port to be refused, got %v", err)
+	}
+
+	service := ServicePortName{"default", "new", "a"}
+	port, err := proxier.assignPort(service, &api.ServicePort{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port < 4000 || port >= 4200 || store[service] != port {
+		t.Fatalf("expected port %d to be in range and stored, stored %d", port, store[service])
+	}
+	proxier.releasePort(service, port)
+	if _, ok := store[service]; ok {
+		t.Fatal("expected the stored port to be released")
+	}
+}
+
+func TestReleaseFailedPort(t *testing.T) {
+	service := ServicePortName{"default", "broken", "https"}
+	store := fakePortStore{service: 4123}
+	ports := NewPortAllocator(4000, 4200)
+	proxier := NewProxierWithPorts(NewServiceBalancer(), ports, store)
+	proxier.Update([]api.Service{{
+		Namespace: "default",
+		Name:      "broken",
+		Ports: []api.ServicePort{{Name: "https", Protocol: "TCP", TLS: &api.ServiceTLS{
+			Mode: api.TLSTerminate, CertFile: "missing.pem", KeyFile: "missing-key.pem"}}},
+	}})
+	if _, ok := proxier.getServiceInfo(service); ok {
+		t.Fatal("expected the service not to be proxied")
+	}
+	if store[service] != 4123 {
+		t.Fatalf("expected the stored port to survive the failed start, stored %v", store)
+	}
+	if err := ports.AllocatePort(4123); err != nil {
+		t.Fatalf("expected the port to be released on this node: %v", err)
+	}
+}
+
+func TestUpdateRunningService(t *testing.T) {
+	lb := NewServiceBalancer()
+	lb.Update([]api.Endpoints{{
+		Name:      "foo",
+		Addresses: []string{"127.0.0.1"},
+		Ports:     []api.EndpointPort{{Name: "a", Port: tcpServerPort}},
+	}})
+	proxier := NewProxier(lb)
+	defer proxier.Update([]api.Service{})
+	service := ServicePortName{Name: "foo", Port: "a"}
+	servicePort := api.ServicePort{Name: "a", Protocol: "tcp"}
+	update := func() *serviceInfo {
+		proxier.Update([]api.Service{{Name: "foo", Ports: []api.ServicePort{servicePort}}})
+		info, ok := proxier.getServiceInfo(service)
+		if !ok {
+			t.Fatal("expected service foo to be proxied")
+		}
+		return info
+	}
+	started := update()
+
+	// hold a connection, so the limiter has one active connection when the
+	// limits change
+	held, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", started.proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	for i := 0; proxier.Stats()[service.String()].Active != 1; i++ {
+		if i == 100 {
+			t.Fatal("expected the held connection to be active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	servicePort.Timeouts = &api.ConnectionTimeouts{IdleTimeoutSeconds: 30}
+	servicePort.Limits = &api.ConnectionLimits{MaxConnections: 1}
+	updated := update()
+	if updated.socket != started.socket || updated.proxyPort != started.proxyPort {
+		t.Fatal("expected the limits and timeouts to be updated without a new socket")
+	}
+	if updated.timeouts.idle != 30*time.Second {
+		t.Fatalf("expected the idle timeout to be updated, got %v", updated.timeouts.idle)
+	}
+	rejected, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", updated.proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection over the updated limit to be closed, got %v", err)
+	}
+
+	servicePort.Port = 3011
+	servicePort.Limits = nil
+	restarted := update()
+	if restarted.socket == started.socket || restarted.proxyPort != 3011 {
+		t.Fatalf("expected the service to be restarted on port 3011, got %d", restarted.proxyPort)
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", started.proxyPort)); err == nil {
+		t.Fatal("expected the previous port to be closed")
+	}
+	testReadWriteTCP(t, "127.0.0.1", restarted.proxyPort)
+}
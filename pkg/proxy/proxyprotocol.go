@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol as described in
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+// proxyHeaderTimeout is the time a client has to send its PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	proxyV1MaxLength = 107
+
+	proxyV2CmdLocal = 0x20
+	proxyV2CmdProxy = 0x21
+	proxyV2TCP4     = 0x11
+	proxyV2TCP6     = 0x21
+)
+
+// writeProxyHeader writes a PROXY protocol header of version to w, describing
+// a connection from src to dst. Connections which are not tcp are written as
+// UNKNOWN (v1) or LOCAL (v2), telling the receiver to use the connection
+// addresses.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk
+	ipv4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	var header []byte
+	switch version {
+	case "v1":
+		switch {
+		case !known:
+			header = []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			header = []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcTCP.IP.To4(), dstTCP.IP.To4(), srcTCP.Port, dstTCP.Port))
+		default:
+			header = []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcTCP.IP.To16(), dstTCP.IP.To16(), srcTCP.Port, dstTCP.Port))
+		}
+	case "v2":
+		buf := bytes.NewBuffer(append([]byte{}, proxyV2Signature...))
+		var addrs []byte
+		switch {
+		case !known:
+			buf.Write([]byte{proxyV2CmdLocal, 0x00})
+		case ipv4:
+			buf.Write([]byte{proxyV2CmdProxy, proxyV2TCP4})
+			addrs = append(append(addrs, srcTCP.IP.To4()...), dstTCP.IP.To4()...)
+		default:
+			buf.Write([]byte{proxyV2CmdProxy, proxyV2TCP6})
+			addrs = append(append(addrs, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+		}
+		if addrs != nil {
+			addrs = append(addrs, byte(srcTCP.Port>>8), byte(srcTCP.Port), byte(dstTCP.Port>>8), byte(dstTCP.Port))
+		}
+		binary.Write(buf, binary.BigEndian, uint16(len(addrs)))
+		buf.Write(addrs)
+		header = buf.Bytes()
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %q", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from r. The returned
+// addresses are nil when the header does not carry addresses.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// both versions can be told apart by their first bytes, a short v1 header
+	// may be all the client sends before waiting for the server
+	prefix, err := r.Peek(len("PROXY "))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(prefix, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	if !bytes.HasPrefix(proxyV2Signature, prefix) {
+		return nil, nil, errProxyHeader
+	}
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(sig, proxyV2Signature) {
+		return nil, nil, errProxyHeader
+	}
+	return readProxyHeaderV2(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.Atoi(port)
+	if addr.IP == nil || err != nil || p < 0 || p > 65535 {
+		return nil, errProxyHeader
+	}
+	addr.Port = p
+	return addr, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	cmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if cmd == proxyV2CmdLocal {
+		return nil, nil, nil
+	}
+	if cmd != proxyV2CmdProxy {
+		return nil, nil, errProxyHeader
+	}
+	var size int
+	switch family {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		// other families are allowed but carry no usable addresses
+		return nil, nil, nil
+	}
+	if length < 2*size+4 {
+		return nil, nil, errProxyHeader
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return src, dst, nil
+}
+
+// proxyProtocolListener accepts connections starting with a PROXY protocol
+// header.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the PROXY header on first use, so Accept does not
+// block on slow clients. RemoteAddr and LocalAddr return the addresses of the
+// header. A connection with an invalid header fails every read.
+type proxyProtocolConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.dst, c.err = readProxyHeader(c.r)
+		// restore the deadline set by the user of the connection
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	})
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// CloseWrite closes the write side of the underlying connection
+func (c *proxyProtocolConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
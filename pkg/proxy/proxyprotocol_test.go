@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst net.Addr
+		v1       string
+	}{
+		{
+			&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443},
+			"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4000},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 4000 80\r\n",
+		},
+		{
+			&net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+			&net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+			"PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, test := range tests {
+		for _, version := range []string{api.ProxyProtocolV1, api.ProxyProtocolV2} {
+			buf := &bytes.Buffer{}
+			if err := writeProxyHeader(buf, version, test.src, test.dst); err != nil {
+				t.Fatal(err)
+			}
+			if version == api.ProxyProtocolV1 && buf.String() != test.v1 {
+				t.Errorf("expected header %q got %q", test.v1, buf.String())
+			}
+			buf.WriteString("payload")
+			r := bufio.NewReader(buf)
+			src, dst, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatalf("%s: %v", version, err)
+			}
+			if _, ok := test.src.(*net.TCPAddr); ok {
+				if src.String() != test.src.String() || dst.String() != test.dst.String() {
+					t.Errorf("%s: expected %s -> %s got %v -> %v", version, test.src, test.dst, src, dst)
+				}
+			} else if src != nil || dst != nil {
+				t.Errorf("%s: expected no addresses got %v -> %v", version, src, dst)
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != "payload" {
+				t.Errorf("%s: expected the payload to follow the header, got %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 80\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 80 99999\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 80 443\n",
+		"\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00",
+	} {
+		if _, _, err := readProxyHeader(bufio.NewReader(bytes.NewBufferString(header))); err == nil {
+			t.Errorf("expected header %q to be invalid", header)
+		}
+	}
+}
+
+func TestProxyProtocolConn(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Addr().String())
+	backendPort, _ := strconv.Atoi(port)
+
+	lb := NewServiceBalancer()
+	lb.Update([]api.Endpoints{{
+		Name:      "pp",
+		Addresses: []string{"127.0.0.1"},
+		Ports:     []api.EndpointPort{{Name: "a", Port: backendPort}},
+	}})
+	proxier := NewProxier(lb)
+	proxier.Update([]api.Service{{Name: "pp", Ports: []api.ServicePort{{
+		Name: "a", Protocol: "TCP", ProxyProtocol: api.ProxyProtocolV2, AcceptProxyProtocol: true,
+	}}}})
+	defer proxier.Update(nil)
+	info, ok := proxier.getServiceInfo(ServicePortName{Name: "pp", Port: "a"})
+	if !ok {
+		t.Fatal("expected the service to be proxied")
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(info.proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 10.0.0.1 10.0.0.2 51000 443\r\nhello"))
+
+	server, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(server)
+	src, dst, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.String() != "10.0.0.1:51000" || dst.String() != "10.0.0.2:443" {
+		t.Fatalf("expected the client addresses to be forwarded, got %v -> %v", src, dst)
+	}
+	payload := make([]byte, 5)
+	if _, err := r.Read(payload); err != nil || string(payload) != "hello" {
+		t.Fatalf("expected the payload to follow the header, got %q: %v", payload, err)
+	}
+}
@@ -1,12 +1,23 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+var (
+	errIdleTimeout = errors.New("connection idle timeout")
+	errHalfClose   = errors.New("connection can not be half closed")
 )
 
 const (
@@ -21,16 +32,24 @@ type ProxySocket interface {
 	Close() error
 }
 
-func newProxySocket(protocol string, port int) (ProxySocket, error) {
-	switch strings.ToUpper(protocol) {
+// newProxySocket listens on the proxy port of info. A PROXY protocol header is
+// read before the tls handshake when both are enabled.
+func newProxySocket(info *serviceInfo) (ProxySocket, error) {
+	switch strings.ToUpper(info.protocol) {
 	case "TCP":
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", info.proxyPort))
 		if err != nil {
 			return nil, err
 		}
+		if info.acceptProxyProtocol {
+			listener = proxyProtocolListener{listener}
+		}
+		if info.tlsConfig != nil {
+			listener = tls.NewListener(listener, info.tlsConfig)
+		}
 		return &tcpSocket{listener}, nil
 	default:
-		return nil, fmt.Errorf("no implementation for %s", protocol)
+		return nil, fmt.Errorf("no implementation for %s", info.protocol)
 	}
 }
 
@@ -39,14 +58,20 @@ type tcpSocket struct {
 }
 
 // connect attemps to connect to the destination service port
-// TODO: implement couple retries with incrementing timeout duration
 func (tcp *tcpSocket) connect(service ServicePortName, protocol string, proxy *Proxier) (net.Conn, error) {
+	return connectEndpoint(service, protocol, proxy)
+}
+
+// connectEndpoint connects to the next endpoint of service
+// TODO: implement couple retries with incrementing timeout duration
+func connectEndpoint(service ServicePortName, protocol string, proxy *Proxier) (net.Conn, error) {
 	endpoint, err := proxy.loadBalancer.NextEndpoint(service)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialTimeout(protocol, endpoint, 2*time.Second)
+	conn, err := net.DialTimeout(strings.ToLower(protocol), endpoint, 2*time.Second)
 	if err != nil {
+		proxy.loadBalancer.ReportFailure(service, endpoint)
 		return nil, fmt.Errorf("dial failed: %v", err)
 	}
 	return conn, nil
@@ -58,9 +83,6 @@ func (tcp *tcpSocket) Close() error {
 
 func (tcp *tcpSocket) ProxyLoop(service ServicePortName, newInfo *serviceInfo, proxy *Proxier) {
 	for {
-		if info, exists := proxy.getServiceInfo(service); !exists || newInfo != info {
-			return // this means the old port is replaced or closed
-		}
 		rwc, err := tcp.Accept()
 		if err != nil {
 			if strings.Contains(err.Error(), useCloseConn) {
@@ -69,35 +91,163 @@ func (tcp *tcpSocket) ProxyLoop(service ServicePortName, newInfo *serviceInfo, p
 			log.Printf("failed to accept: %v", err)
 			continue
 		}
-		rwr, err := tcp.connect(service, newInfo.protocol, proxy)
-		if err != nil {
-			log.Printf("failed to connect to service endpoint: %v", err)
+		// the settings of the service are updated in place while the socket
+		// stays open, every connection uses the latest ones
+		info, exists := proxy.getServiceInfo(service)
+		if !exists || info.socket != newInfo.socket {
+			rwc.Close()
+			return // this means the old port is replaced or closed
+		}
+		go tcp.proxyConn(service, info, proxy, rwc)
+	}
+}
+
+// proxyConn connects the client to an endpoint of service
+func (tcp *tcpSocket) proxyConn(service ServicePortName, info *serviceInfo, proxy *Proxier, rwc net.Conn) {
+	client := clientHost(rwc.RemoteAddr().String())
+	if err := info.limiter.acquire(client); err != nil {
+		log.Printf("rejecting connection from %s to %s: %v", client, service, err)
+		rwc.Close()
+		return
+	}
+	defer info.limiter.release(client)
+
+	rwr, err := tcp.connect(service, info.protocol, proxy)
+	if err != nil {
+		log.Printf("failed to connect to service endpoint: %v", err)
+		rwc.Close()
+		return
+	}
+	if info.proxyProtocol != "" {
+		if err := writeProxyHeader(rwr, info.proxyProtocol, rwc.RemoteAddr(), rwc.LocalAddr()); err != nil {
+			log.Printf("failed to send the PROXY header to %s: %v", service, err)
+			rwc.Close()
 			rwr.Close()
-			continue
+			return
 		}
-		go func() {
-			done := make(chan bool, 1)
-			go copyContent(rwc, rwr, done)
-			go copyContent(rwr, rwc, done)
-			<-done
+	}
+	if info.mirror != nil && info.mirrored.Sample(info.mirror.Percent) {
+		rwc = newTeeConn(rwc, MirrorService(service, info.mirror), proxy)
+	}
+	pipe(rwc, rwr, info.timeouts)
+}
+
+// connTimeouts of the connections to a service, zero disables a timeout
+type connTimeouts struct {
+	idle     time.Duration
+	lifetime time.Duration
+}
+
+func newConnTimeouts(timeouts *api.ConnectionTimeouts) connTimeouts {
+	if timeouts == nil {
+		return connTimeouts{}
+	}
+	return connTimeouts{
+		idle:     time.Duration(timeouts.IdleTimeoutSeconds) * time.Second,
+		lifetime: time.Duration(timeouts.MaxLifetimeSeconds) * time.Second,
+	}
+}
+
+// pipe copies between the client and server connection in both directions.
+// When one side stops sending the write side of the other connection is closed,
+// so protocols which shut down one direction first keep working. Both
+// connections are closed once both directions are done, an error occurs, or
+// one of the timeouts expires.
+func pipe(rwc, rwr net.Conn, timeouts connTimeouts) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
 			rwc.Close()
 			rwr.Close()
-		}()
+		})
+	}
+	if timeouts.lifetime > 0 {
+		timer := time.AfterFunc(timeouts.lifetime, closeBoth)
+		defer timer.Stop()
+	}
+	activity := time.Now().UnixNano()
+	done := make(chan error, 2)
+	go func() { done <- copyContent(rwr, rwc, timeouts.idle, &activity) }()
+	go func() { done <- copyContent(rwc, rwr, timeouts.idle, &activity) }()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			closeBoth()
+		}
+	}
+	closeBoth()
+}
+
+// copyContent copies from src to dst until src is done sending, which is
+// propagated by closing the write side of dst. With an idle timeout the copy
+// fails when neither direction transferred data for the duration, activity
+// holds the time of the last transfer of both directions.
+func copyContent(dst, src net.Conn, idle time.Duration, activity *int64) error {
+	if idle == 0 && canSplice(dst, src) {
+		// io.Copy uses TCPConn.ReadFrom, which splices on linux without
+		// copying through userspace
+		if _, err := io.Copy(dst, src); err != nil {
+			return err
+		}
+		return closeWrite(dst)
 	}
+	bufp := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufp)
+	return copyBuffer(dst, src, *bufp, idle, activity)
 }
 
-func copyContent(src io.Reader, dst io.Writer, done chan bool) {
-	buf := make([]byte, RWBufferSize)
+// copyBuffer copies from src to dst through buf, see copyContent
+func copyBuffer(dst, src net.Conn, buf []byte, idle time.Duration, activity *int64) error {
 	for {
+		if idle > 0 {
+			src.SetReadDeadline(time.Now().Add(idle))
+		}
 		n, err := src.Read(buf)
-		if err != nil {
-			done <- true
-			return
+		if n > 0 {
+			atomic.StoreInt64(activity, time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return closeWrite(dst)
 		}
-		_, err = dst.Write(buf[:n])
 		if err != nil {
-			done <- true
-			return
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && idle > 0 {
+				// the other direction may still be in use
+				last := time.Unix(0, atomic.LoadInt64(activity))
+				if time.Since(last) < idle {
+					continue
+				}
+				return errIdleTimeout
+			}
+			return err
 		}
 	}
 }
+
+// bufferPool holds the buffers of connections which can not be spliced
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, RWBufferSize)
+		return &buf
+	},
+}
+
+// canSplice reports if the kernel can move data from src to dst. Connections
+// wrapped by tls or the PROXY protocol go through a buffer.
+func canSplice(dst, src net.Conn) bool {
+	_, dstTCP := dst.(*net.TCPConn)
+	_, srcTCP := src.(*net.TCPConn)
+	return dstTCP && srcTCP
+}
+
+// closeWrite closes the write side of conn, connections which can not be half
+// closed fail so both connections are torn down.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return errHalfClose
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback tcp connection
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+// startPipe connects a client and a server through pipe
+func startPipe(t testing.TB, timeouts connTimeouts) (client, server net.Conn, done chan bool) {
+	return startPipeFunc(t, func(rwc, rwr net.Conn) { pipe(rwc, rwr, timeouts) })
+}
+
+// startPipeFunc is startPipe with the connections piped by pipeFunc
+func startPipeFunc(t testing.TB, pipeFunc func(rwc, rwr net.Conn)) (client, server net.Conn, done chan bool) {
+	client, proxyClient := tcpPair(t)
+	proxyServer, server := tcpPair(t)
+	done = make(chan bool)
+	go func() {
+		pipeFunc(proxyClient, proxyServer)
+		close(done)
+	}()
+	return client, server, done
+}
+
+// allocatingPipe pipes the way the proxy did before plain connections were
+// spliced and buffers pooled, with a new buffer for each direction of every
+// connection. It is the baseline of the benchmarks.
+func allocatingPipe(rwc, rwr net.Conn) {
+	var activity int64
+	done := make(chan error, 2)
+	go func() { done <- copyBuffer(rwr, rwc, make([]byte, RWBufferSize), 0, &activity) }()
+	go func() { done <- copyBuffer(rwc, rwr, make([]byte, RWBufferSize), 0, &activity) }()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			rwc.Close()
+			rwr.Close()
+		}
+	}
+	rwc.Close()
+	rwr.Close()
+}
+
+func waitDone(t *testing.T, done chan bool, within time.Duration) {
+	select {
+	case <-done:
+	case <-time.After(within):
+		t.Fatal("expected the pipe to be done")
+	}
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	client, server, done := startPipe(t, connTimeouts{})
+	defer client.Close()
+	defer server.Close()
+
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+	// the server only answers once the client is done sending
+	p, err := ioutil.ReadAll(server)
+	if err != nil || string(p) != "ping" {
+		t.Fatalf("expected the server to read ping until EOF, got %q: %v", p, err)
+	}
+	server.Write([]byte("pong"))
+	server.Close()
+	p, err = ioutil.ReadAll(client)
+	if err != nil || string(p) != "pong" {
+		t.Fatalf("expected the client to read pong after closing its write side, got %q: %v", p, err)
+	}
+	waitDone(t, done, time.Second)
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	client, server, done := startPipe(t, connTimeouts{idle: 100 * time.Millisecond})
+	defer client.Close()
+	defer server.Close()
+
+	// traffic in one direction keeps the connection alive
+	for i := 0; i < 5; i++ {
+		if _, err := server.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("expected an active connection not to time out")
+	default:
+	}
+	waitDone(t, done, time.Second)
+	p, _ := ioutil.ReadAll(client)
+	if string(p) != "xxxxx" {
+		t.Fatalf("expected the data sent before the timeout, got %q", p)
+	}
+}
+
+func TestPipeMaxLifetime(t *testing.T) {
+	client, server, done := startPipe(t, connTimeouts{lifetime: 150 * time.Millisecond})
+	defer client.Close()
+	defer server.Close()
+
+	stop := time.After(time.Second)
+	for {
+		select {
+		case <-done:
+			return
+		case <-stop:
+			t.Fatal("expected the connection to be closed after its lifetime")
+		default:
+		}
+		client.Write([]byte("x"))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCanSplice(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	if !canSplice(client, server) {
+		t.Fatal("expected tcp connections to be spliced")
+	}
+	wrapped := &proxyProtocolConn{Conn: server}
+	if canSplice(client, wrapped) || canSplice(wrapped, client) {
+		t.Fatal("expected wrapped connections not to be spliced")
+	}
+}
+
+// benchmarkPipe sends size bytes per iteration through a single connection
+// piped by pipeFunc
+func benchmarkPipe(b *testing.B, pipeFunc func(rwc, rwr net.Conn), size int) {
+	client, server, done := startPipeFunc(b, pipeFunc)
+	read := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, server)
+		server.Close()
+		close(read)
+	}()
+	defer func() {
+		client.Close()
+		<-read
+		<-done
+	}()
+	payload := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPipeAllocated is the baseline of the pipe benchmarks. On loopback
+// connections splicing and the pooled buffer move data as fast as the
+// baseline, they only save its buffers.
+func BenchmarkPipeAllocated(b *testing.B) {
+	benchmarkPipe(b, allocatingPipe, 1<<20)
+}
+
+// BenchmarkPipeSplice forwards between plain tcp connections in the kernel
+func BenchmarkPipeSplice(b *testing.B) {
+	benchmarkPipe(b, func(rwc, rwr net.Conn) { pipe(rwc, rwr, connTimeouts{}) }, 1<<20)
+}
+
+// BenchmarkPipeBuffered forwards through a pooled buffer, an idle timeout
+// needs a read deadline per read
+func BenchmarkPipeBuffered(b *testing.B) {
+	benchmarkPipe(b, func(rwc, rwr net.Conn) { pipe(rwc, rwr, connTimeouts{idle: time.Minute}) }, 1<<20)
+}
+
+// benchmarkShortConnections pipes a small message per iteration, each through
+// a new connection piped by pipeFunc
+func benchmarkShortConnections(b *testing.B, pipeFunc func(rwc, rwr net.Conn)) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		client, server, done := startPipeFunc(b, pipeFunc)
+		client.Write([]byte("ping"))
+		client.(*net.TCPConn).CloseWrite()
+		ioutil.ReadAll(server)
+		server.Close()
+		<-done
+		client.Close()
+	}
+}
+
+// BenchmarkShortConnectionsAllocated is the baseline of the short connection
+// benchmarks, it allocates two buffers per connection which splicing and the
+// pooled buffers do not
+func BenchmarkShortConnectionsAllocated(b *testing.B) {
+	benchmarkShortConnections(b, allocatingPipe)
+}
+
+func BenchmarkShortConnectionsSplice(b *testing.B) {
+	benchmarkShortConnections(b, func(rwc, rwr net.Conn) { pipe(rwc, rwr, connTimeouts{}) })
+}
+
+func BenchmarkShortConnectionsBuffered(b *testing.B) {
+	benchmarkShortConnections(b, func(rwc, rwr net.Conn) { pipe(rwc, rwr, connTimeouts{idle: time.Minute}) })
+}
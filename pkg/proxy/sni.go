@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+// helloTimeout is the time a client has to send its tls hello on the sni port
+const helloTimeout = 5 * time.Second
+
+var errHelloRead = errors.New("tls client hello read")
+
+// sniRoute is the passthrough service serving a server name
+type sniRoute struct {
+	service       ServicePortName
+	proxyProtocol string
+	timeouts      connTimeouts
+	limiter       *connLimiter
+}
+
+// sniLimiter admits the connections of a passthrough service, it is kept
+// across updates of the routes so the connections stay counted
+type sniLimiter struct {
+	limiter *connLimiter
+	limits  *api.ConnectionLimits
+}
+
+// sniSocket accepts tls connections on a port shared by the passthrough
+// services and routes them by the server name of the client hello. The
+// connections are not decrypted.
+type sniSocket struct {
+	net.Listener
+}
+
+// ListenSNI starts routing tls connections arriving on addr to the
+// passthrough services. With acceptProxyProtocol every connection has to start
+// with a PROXY protocol header.
+func (p *Proxier) ListenSNI(addr string, acceptProxyProtocol bool) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if acceptProxyProtocol {
+		listener = proxyProtocolListener{listener}
+	}
+	sock := &sniSocket{listener}
+	p.mu.Lock()
+	p.sni = sock
+	p.mu.Unlock()
+	go sock.ProxyLoop(p)
+	return nil
+}
+
+// sniRoute returns the service serving serverName. Exact names take precedence
+// over wildcard names.
+func (p *Proxier) sniRoute(serverName string) (sniRoute, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	serverName = strings.ToLower(serverName)
+	if route, ok := p.sniRoutes[serverName]; ok {
+		return route, true
+	}
+	if i := strings.Index(serverName, "."); i > 0 {
+		route, ok := p.sniRoutes["*"+serverName[i:]]
+		return route, ok
+	}
+	return sniRoute{}, false
+}
+
+func (sni *sniSocket) ProxyLoop(proxy *Proxier) {
+	for {
+		rwc, err := sni.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), useCloseConn) {
+				return
+			}
+			log.Printf("failed to accept: %v", err)
+			continue
+		}
+		go sni.proxyConn(rwc, proxy)
+	}
+}
+
+func (sni *sniSocket) proxyConn(rwc net.Conn, proxy *Proxier) {
+	rwc.SetReadDeadline(time.Now().Add(helloTimeout))
+	serverName, hello, err := readServerName(rwc)
+	if err != nil {
+		log.Printf("failed to read the tls hello from %s: %v", rwc.RemoteAddr(), err)
+		rwc.Close()
+		return
+	}
+	rwc.SetReadDeadline(time.Time{})
+	route, ok := proxy.sniRoute(serverName)
+	if !ok {
+		log.Printf("no service for server name %q", serverName)
+		rwc.Close()
+		return
+	}
+	service := route.service
+	client := clientHost(rwc.RemoteAddr().String())
+	if err := route.limiter.acquire(client); err != nil {
+		log.Printf("rejecting connection from %s to %s: %v", client, service, err)
+		rwc.Close()
+		return
+	}
+	defer route.limiter.release(client)
+
+	rwr, err := connectEndpoint(service, "tcp", proxy)
+	if err != nil {
+		log.Printf("failed to connect to service endpoint: %v", err)
+		rwc.Close()
+		return
+	}
+	if route.proxyProtocol != "" {
+		if err := writeProxyHeader(rwr, route.proxyProtocol, rwc.RemoteAddr(), rwc.LocalAddr()); err != nil {
+			log.Printf("failed to send the PROXY header to %s: %v", service, err)
+			rwc.Close()
+			rwr.Close()
+			return
+		}
+	}
+	// replay the hello consumed while reading the server name
+	if _, err := rwr.Write(hello); err != nil {
+		log.Printf("failed to forward the tls hello to %s: %v", service, err)
+		rwc.Close()
+		rwr.Close()
+		return
+	}
+	pipe(rwc, rwr, route.timeouts)
+}
+
+// readServerName reads the tls client hello from conn and returns the server
+// name it requests together with the bytes read from conn.
+func readServerName(conn net.Conn) (string, []byte, error) {
+	buf := &bytes.Buffer{}
+	var serverName string
+	var seen bool
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, seen = hello.ServerName, true
+			return nil, errHelloRead
+		},
+	}
+	err := tls.Server(readOnlyConn{conn, io.TeeReader(conn, buf)}, config).Handshake()
+	if !seen {
+		return "", nil, err
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+// readOnlyConn lets the tls handshake read the client hello without writing
+// anything back to the client.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+// writeTestCert writes a self signed certificate for cn to dir
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestReadServerName(t *testing.T) {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "foo.example.com", InsecureSkipVerify: true}).Handshake()
+	name, hello, err := readServerName(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "foo.example.com" {
+		t.Fatalf("expected server name foo.example.com got %q", name)
+	}
+	// a tls record starts with the handshake content type
+	if len(hello) == 0 || hello[0] != 0x16 {
+		t.Fatalf("expected the hello bytes to be returned, got %v", hello)
+	}
+	client.Close()
+}
+
+func TestSNIRoute(t *testing.T) {
+	proxier := NewProxier(NewServiceBalancer())
+	proxier.Update([]api.Service{
+		{Name: "exact", Ports: []api.ServicePort{{Name: "https", Protocol: "TCP", TLS: &api.ServiceTLS{
+			Mode: api.TLSPassthrough, ServerNames: []string{"api.example.com"}}}}},
+		{Name: "wildcard", Ports: []api.ServicePort{{Name: "https", Protocol: "TCP", TLS: &api.ServiceTLS{
+			Mode: api.TLSPassthrough, ServerNames: []string{"*.example.com"}}}}},
+	})
+	tests := map[string]string{
+		"api.example.com": "exact",
+		"API.example.com": "exact",
+		"www.example.com": "wildcard",
+		"a.b.example.com": "",
+		"example.com":     "",
+	}
+	for name, want := range tests {
+		route, ok := proxier.sniRoute(name)
+		if ok != (want != "") || route.service.Name != want {
+			t.Errorf("expected %q to route to %q got %q", name, want, route.service.Name)
+		}
+	}
+	if _, ok := proxier.getServiceInfo(ServicePortName{Name: "exact", Port: "https"}); ok {
+		t.Fatal("expected passthrough services not to get a proxy port")
+	}
+}
+
+func TestSNIRouteDuplicate(t *testing.T) {
+	passthrough := func(namespace, name string) api.Service {
+		return api.Service{Namespace: namespace, Name: name, Ports: []api.ServicePort{{Name: "https", Protocol: "TCP", TLS: &api.ServiceTLS{
+			Mode: api.TLSPassthrough, ServerNames: []string{"api.example.com"}}}}}
+	}
+	proxier := NewProxier(NewServiceBalancer())
+	for _, services := range [][]api.Service{
+		{passthrough("b", "api"), passthrough("a", "web")},
+		{passthrough("a", "web"), passthrough("b", "api")},
+	} {
+		proxier.Update(services)
+		route, ok := proxier.sniRoute("api.example.com")
+		if !ok || route.service.Namespace != "a" || route.service.Name != "web" {
+			t.Errorf("expected the first service in name order to keep the server name, got %s", route.service)
+		}
+	}
+}
+
+func TestSNIPassthrough(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.TLS.ServerName, r.URL.Path)
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	backendPort, _ := strconv.Atoi(port)
+
+	lb := NewServiceBalancer()
+	lb.Update([]api.Endpoints{{
+		Name:      "foo",
+		Addresses: []string{"127.0.0.1"},
+		Ports:     []api.EndpointPort{{Name: "https", Port: backendPort}},
+	}})
+	proxier := NewProxier(lb)
+	if err := proxier.ListenSNI("127.0.0.1:0", false); err != nil {
+		t.Fatal(err)
+	}
+	defer proxier.sni.Close()
+	proxier.Update([]api.Service{{Name: "foo", Ports: []api.ServicePort{{Name: "https", Protocol: "TCP", TLS: &api.ServiceTLS{
+		Mode: api.TLSPassthrough, ServerNames: []string{"foo.example.com"}}}}}})
+
+	sniAddr := proxier.sni.Addr().String()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", sniAddr)
+		},
+	}}
+	resp, err := client.Get("https://foo.example.com/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "foo.example.com /bar" {
+		t.Fatalf("expected the backend to terminate tls for foo.example.com, got %q", body)
+	}
+	if _, err := client.Get("https://unknown.example.com/"); err == nil {
+		t.Fatal("expected an unknown server name to be rejected")
+	}
+}
+
+func TestSNILimits(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	backendPort, _ := strconv.Atoi(port)
+
+	lb := NewServiceBalancer()
+	lb.Update([]api.Endpoints{{
+		Name:      "foo",
+		Addresses: []string{"127.0.0.1"},
+		Ports:     []api.EndpointPort{{Name: "https", Port: backendPort}},
+	}})
+	proxier := NewProxier(lb)
+	if err := proxier.ListenSNI("127.0.0.1:0", false); err != nil {
+		t.Fatal(err)
+	}
+	defer proxier.sni.Close()
+	update := func(limits *api.ConnectionLimits) {
+		proxier.Update([]api.Service{{Name: "foo", Ports: []api.ServicePort{{Name: "https", Protocol: "TCP", Limits: limits, TLS: &api.ServiceTLS{
+			Mode: api.TLSPassthrough, ServerNames: []string{"foo.example.com"}}}}}})
+	}
+	dial := func() (*tls.Conn, error) {
+		return tls.Dial("tcp", proxier.sni.Addr().String(), &tls.Config{ServerName: "foo.example.com", InsecureSkipVerify: true})
+	}
+	update(nil)
+	held, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	// the limiter survives the update of the routes and keeps counting the
+	// held connection
+	update(&api.ConnectionLimits{MaxConnections: 1})
+	if conn, err := dial(); err == nil {
+		conn.Close()
+		t.Fatal("expected the connection over the limit to be rejected")
+	}
+	stats := proxier.Stats()["foo:https"]
+	if stats.Active != 1 || stats.Rejected != 1 {
+		t.Fatalf("expected 1 active and 1 rejected connection, got %+v", stats)
+	}
+}
+
+func TestTLSTerminate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "foo.example.com")
+
+	lb := NewServiceBalancer()
+	lb.Update([]api.Endpoints{{
+		Name:      "secure",
+		Addresses: []string{"127.0.0.1"},
+		Ports:     []api.EndpointPort{{Name: "https", Port: tcpServerPort}},
+	}})
+	proxier := NewProxier(lb)
+	proxier.Update([]api.Service{{Name: "secure", Ports: []api.ServicePort{{Name: "https", Protocol: "TCP", TLS: &api.ServiceTLS{
+		Mode: api.TLSTerminate, CertFile: certFile, KeyFile: keyFile}}}}})
+	service := ServicePortName{Name: "secure", Port: "https"}
+	info, ok := proxier.getServiceInfo(service)
+	if !ok {
+		t.Fatal("expected the service to be proxied")
+	}
+	defer proxier.Update(nil)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/foobar", info.proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.TLS == nil || resp.TLS.PeerCertificates[0].Subject.CommonName != "foo.example.com" {
+		t.Fatal("expected flow to serve the certificate of the service")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "foobar") {
+		t.Fatalf("expected the plaintext backend to respond, got %q", body)
+	}
+}
@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"errors"
+
+	"github.com/coreos/go-etcd/etcd"
+
+	apierrors "github.com/twanies/flow/api/errors"
+)
+
+// etcd v2 error codes
+const (
+	etcdErrKeyNotFound  = 100
+	etcdErrTestFailed   = 101
+	etcdErrNodeExist    = 105
+	etcdErrIndexNaN     = 203
+	etcdErrIndexOrValue = 209
+)
+
+var errResourceVersion = errors.New("the resource version does not match, get the latest version and try again")
+
+const (
+	kindService   = "service"
+	kindEndpoints = "endpoints"
+	kindFrontend  = "frontend"
+	kindNode      = "node"
+
+	kindEndpointLease = "lease"
+)
+
+// toStatusError converts errors returned by the etcd client into typed errors
+// for the object of kind with the given name. Unknown errors are returned as is.
+func toStatusError(err error, kind, name string) error {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	if !ok {
+		return err
+	}
+	switch etcdErr.ErrorCode {
+	case etcdErrKeyNotFound:
+		return apierrors.NewNotFound(kind, name)
+	case etcdErrNodeExist:
+		return apierrors.NewAlreadyExists(kind, name)
+	case etcdErrTestFailed:
+		return apierrors.NewConflict(kind, name, errResourceVersion)
+	}
+	return err
+}
+
+func isEtcdNotFound(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == etcdErrKeyNotFound
+}
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"path"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/api/validation"
+)
+
+const (
+	frontendPath string = "/frontends"
+
+	frontendsWatchPath string = root + "/register" + "/frontends"
+)
+
+// CreateFrontend stores a new frontend to the registry
+// frontends are stored as json like "/flow/frontends/{namespace}/{name}/spec"
+func (r *Registry) CreateFrontend(frontend *api.FrontendSpec) (*api.FrontendSpec, error) {
+	out := *frontend
+	out.Namespace = defaultNamespace(frontend.Namespace)
+	if errs := validation.ValidateFrontend(&out); len(errs) > 0 {
+		return nil, apierrors.NewInvalid(kindFrontend, frontend.Name, errs)
+	}
+	out.ResourceVersion = 0
+	version, err := r.createObject(makeEtcdFrontendKey(out.Namespace, out.Name), &out)
+	if err != nil {
+		return nil, toStatusError(err, kindFrontend, out.Name)
+	}
+	out.ResourceVersion = version
+	if err := r.setKey(frontendsWatchPath, path.Join(out.Namespace, out.Name)); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetFrontend retrieves a frontend from the registry
+func (r *Registry) GetFrontend(namespace, name string) (*api.FrontendSpec, error) {
+	frontend := &api.FrontendSpec{}
+	version, err := r.getObject(makeEtcdFrontendKey(defaultNamespace(namespace), name), frontend)
+	if err != nil {
+		return nil, toStatusError(err, kindFrontend, name)
+	}
+	frontend.ResourceVersion = version
+	return frontend, nil
+}
+
+// GetFrontends retrieves the frontends of a namespace, or of all namespaces
+// when namespace is api.NamespaceAll
+func (r *Registry) GetFrontends(namespace string) ([]api.FrontendSpec, error) {
+	frontends := make([]api.FrontendSpec, 0)
+	keys, err := r.getObjectKeys(frontendPath, namespace)
+	if err != nil {
+		return frontends, err
+	}
+	for _, key := range keys {
+		frontend, err := r.GetFrontend(path.Base(path.Dir(key)), path.Base(key))
+		if err != nil {
+			return frontends, err
+		}
+		frontends = append(frontends, *frontend)
+	}
+	return frontends, nil
+}
+
+// UpdateFrontend replaces a stored frontend. The ResourceVersion must match the
+// stored version.
+func (r *Registry) UpdateFrontend(frontend *api.FrontendSpec) (*api.FrontendSpec, error) {
+	out := *frontend
+	out.Namespace = defaultNamespace(frontend.Namespace)
+	if errs := validation.ValidateFrontendUpdate(&out); len(errs) > 0 {
+		return nil, apierrors.NewInvalid(kindFrontend, frontend.Name, errs)
+	}
+	out.ResourceVersion = 0
+	version, err := r.swapObject(makeEtcdFrontendKey(out.Namespace, out.Name), &out, frontend.ResourceVersion)
+	if err != nil {
+		return nil, toStatusError(err, kindFrontend, out.Name)
+	}
+	out.ResourceVersion = version
+	if err := r.setKey(frontendsWatchPath, path.Join(out.Namespace, out.Name)); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (r *Registry) DeleteFrontend(namespace, name string) error {
+	namespace = defaultNamespace(namespace)
+	if _, err := r.client.Delete(makeEtcdFrontendKey(namespace, name), true); err != nil {
+		return toStatusError(err, kindFrontend, name)
+	}
+	return r.setKey(frontendsWatchPath, path.Join(namespace, name))
+}
+
+func (r *Registry) WatchFrontends(frontendsch chan []api.FrontendSpec) {
+	resp := make(chan *etcd.Response)
+	go r.client.Watch(frontendsWatchPath, 0, true, resp, nil)
+	for true {
+		<-resp
+		frontends, err := r.GetFrontends(api.NamespaceAll)
+		if err != nil {
+			panic(err)
+		}
+		frontendsch <- frontends
+	}
+}
+
+func makeEtcdFrontendKey(namespace, name string) string {
+	return path.Join(root, frontendPath, namespace, name)
+}
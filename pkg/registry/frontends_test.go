@@ -0,0 +1,43 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+)
+
+func TestFrontends(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	frontend, err := r.CreateFrontend(&api.FrontendSpec{
+		Name:    "flowtest",
+		Service: "api",
+		Scheme:  "http",
+		Route:   "/v1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.DeleteFrontend(api.NamespaceDefault, "flowtest")
+	if frontend.Namespace != api.NamespaceDefault || frontend.ResourceVersion == 0 {
+		t.Fatalf("expected a versioned frontend in the default namespace got %+v", frontend)
+	}
+	frontend.Route = "/v2"
+	if _, err := r.UpdateFrontend(frontend); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.UpdateFrontend(frontend); !apierrors.IsConflict(err) {
+		t.Fatalf("expected a conflict error got %v", err)
+	}
+	frontends, err := r.GetFrontends(api.NamespaceDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frontends) != 1 || frontends[0].Route != "/v2" {
+		t.Fatalf("expected the updated frontend got %+v", frontends)
+	}
+	if _, err := r.CreateFrontend(&api.FrontendSpec{Name: "flowtest-invalid", Scheme: "http", Route: "/"}); !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an invalid error without service got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"reflect"
+	"time"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/api/validation"
+)
+
+// leases of endpoint addresses are stored as json like
+// "/flow/leases/{namespace}/{name}/{address}"
+const leasePath string = "/leases"
+
+// maxLeaseRetries is the number of times the endpoints are read again when
+// they were modified while a lease changed them
+const maxLeaseRetries = 5
+
+// RenewEndpointLease adds the address of the lease to the endpoints of the
+// service, creating the endpoints when needed, and extends the lease by its
+// ttl. The endpoints are only updated when the address or its ports are
+// missing.
+func (r *Registry) RenewEndpointLease(namespace, name string, lease *api.EndpointLease) (*api.EndpointLease, error) {
+	namespace = defaultNamespace(namespace)
+	if errs := validation.ValidateEndpointLease(lease); len(errs) > 0 {
+		return nil, apierrors.NewInvalid(kindEndpointLease, lease.Address, errs)
+	}
+	err := r.changeEndpoints(namespace, name, true, func(endpoints *api.Endpoints) (bool, error) {
+		return addLeaseAddress(endpoints, lease)
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := *lease
+	out.Expires = time.Now().Add(time.Duration(lease.TTLSeconds) * time.Second).UTC()
+	b, err := json.Marshal(&out)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.setKey(makeEtcdLeaseKey(namespace, name, lease.Address), string(b)); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ReleaseEndpointLease removes the address from the endpoints of the service
+// together with its lease. Releasing a lease which does not exist is not an
+// error.
+func (r *Registry) ReleaseEndpointLease(namespace, name, address string) error {
+	namespace = defaultNamespace(namespace)
+	err := r.changeEndpoints(namespace, name, false, func(endpoints *api.Endpoints) (bool, error) {
+		return removeAddress(endpoints, address), nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.deleteKey(makeEtcdLeaseKey(namespace, name, address)); err != nil && !isEtcdNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ExpireEndpointLeases removes the addresses of the leases which expired
+// before now. Every flow node runs it, a lease renewed in the meantime is left
+// alone. An address which can not be removed keeps its lease, so the next
+// sweep tries again.
+func (r *Registry) ExpireEndpointLeases(now time.Time) error {
+	namespaces, err := r.getDirKeys(root, leasePath)
+	if err != nil {
+		if isEtcdNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	for _, ns := range namespaces {
+		names, err := r.getDirKeys(ns)
+		if err != nil && !isEtcdNotFound(err) {
+			return err
+		}
+		for _, dir := range names {
+			resp, err := r.client.Get(dir, false, false)
+			if err != nil {
+				if isEtcdNotFound(err) {
+					continue
+				}
+				return err
+			}
+			for _, node := range resp.Node.Nodes {
+				lease := api.EndpointLease{}
+				if isDir(node) || json.Unmarshal([]byte(node.Value), &lease) != nil || now.Before(lease.Expires) {
+					continue
+				}
+				// the address is removed before the lease, so a failed removal
+				// is retried by the next sweep
+				namespace, name := path.Base(ns), path.Base(dir)
+				err := r.changeEndpoints(namespace, name, false, func(endpoints *api.Endpoints) (bool, error) {
+					return removeAddress(endpoints, lease.Address), nil
+				})
+				if err != nil {
+					log.Printf("failed to remove the expired address %s of %s/%s: %v", lease.Address, namespace, name, err)
+					continue
+				}
+				// the lease is only deleted when it was not renewed since, the
+				// address of a lease renewed in the meantime is added back
+				if _, err := r.client.CompareAndDelete(node.Key, "", node.ModifiedIndex); err != nil {
+					if err := r.restoreLeaseAddress(namespace, name, node.Key); err != nil {
+						log.Printf("failed to restore the renewed address %s of %s/%s: %v", lease.Address, namespace, name, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// restoreLeaseAddress adds the address of the lease stored at key back to the
+// endpoints, a lease which is gone is not an error
+func (r *Registry) restoreLeaseAddress(namespace, name, key string) error {
+	value, err := r.getValue(key)
+	if err != nil {
+		if isEtcdNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	lease := api.EndpointLease{}
+	if err := json.Unmarshal([]byte(value), &lease); err != nil {
+		return err
+	}
+	return r.changeEndpoints(namespace, name, true, func(endpoints *api.Endpoints) (bool, error) {
+		return addLeaseAddress(endpoints, &lease)
+	})
+}
+
+// changeEndpoints applies change to the stored endpoints and stores them when
+// change reports they changed. Missing endpoints are created when create is
+// set. The change is applied again when the endpoints were modified in the
+// meantime.
+func (r *Registry) changeEndpoints(namespace, name string, create bool, change func(*api.Endpoints) (bool, error)) error {
+	for retry := 0; ; retry++ {
+		endpoints, err := r.GetServiceEndpoints(namespace, name)
+		if apierrors.IsNotFound(err) {
+			if !create {
+				return nil
+			}
+			endpoints = &api.Endpoints{Name: name, Namespace: namespace, Addresses: []string{}, Ports: []api.EndpointPort{}}
+			if _, err := change(endpoints); err != nil {
+				return err
+			}
+			_, err = r.CreateEndpoints(endpoints)
+			if apierrors.IsAlreadyExists(err) && retry < maxLeaseRetries {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		changed, err := change(endpoints)
+		if err != nil || !changed {
+			return err
+		}
+		_, err = r.UpdateEndpoints(endpoints)
+		if apierrors.IsConflict(err) && retry < maxLeaseRetries {
+			continue
+		}
+		return err
+	}
+}
+
+// addLeaseAddress adds the address, ports, topology and labels of the lease to
+// the endpoints and reports if they changed
+func addLeaseAddress(endpoints *api.Endpoints, lease *api.EndpointLease) (bool, error) {
+	changed := false
+	for _, port := range lease.Ports {
+		found := false
+		for _, existing := range endpoints.Ports {
+			if existing.Name != port.Name {
+				continue
+			}
+			if existing.Port != port.Port {
+				return false, apierrors.NewConflict(kindEndpoints, endpoints.Name,
+					fmt.Errorf("port %q is registered as %d", port.Name, existing.Port))
+			}
+			found = true
+		}
+		if !found {
+			endpoints.Ports = append(endpoints.Ports, port)
+			changed = true
+		}
+	}
+	if !containsString(endpoints.Addresses, lease.Address) {
+		endpoints.Addresses = append(endpoints.Addresses, lease.Address)
+		changed = true
+	}
+	if lease.Topology != nil && endpoints.Topology[lease.Address] != *lease.Topology {
+		if endpoints.Topology == nil {
+			endpoints.Topology = map[string]api.Topology{}
+		}
+		endpoints.Topology[lease.Address] = *lease.Topology
+		changed = true
+	}
+	if len(lease.Labels) > 0 && !reflect.DeepEqual(endpoints.AddressLabels[lease.Address], lease.Labels) {
+		if endpoints.AddressLabels == nil {
+			endpoints.AddressLabels = map[string]map[string]string{}
+		}
+		endpoints.AddressLabels[lease.Address] = lease.Labels
+		changed = true
+	}
+	return changed, nil
+}
+
+// removeAddress removes the address from the endpoints and reports if it was
+// registered
+func removeAddress(endpoints *api.Endpoints, address string) bool {
+	for i, existing := range endpoints.Addresses {
+		if existing == address {
+			endpoints.Addresses = append(endpoints.Addresses[:i], endpoints.Addresses[i+1:]...)
+			delete(endpoints.Topology, address)
+			delete(endpoints.AddressLabels, address)
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func makeEtcdLeaseKey(namespace, name, address string) string {
+	return path.Join(root, leasePath, namespace, name, address)
+}
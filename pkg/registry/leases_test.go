@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+)
+
+func TestEndpointLeases(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	const ns = "flowtest-leases"
+	defer r.deleteKey(root, leasePath, ns)
+	defer r.DeleteEndpoints(ns, "api")
+
+	port := []api.EndpointPort{{Name: "http", Port: 8080}}
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		lease, err := r.RenewEndpointLease(ns, "api", &api.EndpointLease{Address: address, Ports: port, TTLSeconds: 30})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.Expires.Before(time.Now().Add(20 * time.Second)) {
+			t.Fatalf("expected the lease to expire in 30s got %v", lease.Expires)
+		}
+	}
+	endpoints, err := r.GetServiceEndpoints(ns, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(endpoints.Addresses, []string{"10.0.0.1", "10.0.0.2"}) || !reflect.DeepEqual(endpoints.Ports, port) {
+		t.Fatalf("expected both addresses with their port got %+v", endpoints)
+	}
+
+	// renewing does not touch the endpoints
+	if _, err := r.RenewEndpointLease(ns, "api", &api.EndpointLease{Address: "10.0.0.1", Ports: port, TTLSeconds: 30}); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := r.GetServiceEndpoints(ns, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.ResourceVersion != endpoints.ResourceVersion {
+		t.Fatal("expected a renewal to keep the endpoints unchanged")
+	}
+
+	// labels of the address are stored with the endpoints
+	canary := &api.EndpointLease{Address: "10.0.0.2", Ports: port, TTLSeconds: 30, Labels: map[string]string{"version": "v2"}}
+	if _, err := r.RenewEndpointLease(ns, "api", canary); err != nil {
+		t.Fatal(err)
+	}
+	labeled, err := r.GetServiceEndpoints(ns, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(labeled.AddressLabels, map[string]map[string]string{"10.0.0.2": {"version": "v2"}}) {
+		t.Fatalf("expected the labels of the address got %v", labeled.AddressLabels)
+	}
+
+	other := []api.EndpointPort{{Name: "http", Port: 9090}}
+	if _, err := r.RenewEndpointLease(ns, "api", &api.EndpointLease{Address: "10.0.0.3", Ports: other, TTLSeconds: 30}); !apierrors.IsConflict(err) {
+		t.Fatalf("expected a conflict for a port with another number got %v", err)
+	}
+
+	if err := r.ReleaseEndpointLease(ns, "api", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ExpireEndpointLeases(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err = r.GetServiceEndpoints(ns, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints.Addresses) != 0 {
+		t.Fatalf("expected the released and expired addresses to be removed got %v", endpoints.Addresses)
+	}
+	if err := r.ReleaseEndpointLease(ns, "api", "10.0.0.1"); err != nil {
+		t.Fatalf("expected releasing an expired lease to succeed got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/api/validation"
+)
+
+// nodes of the cluster are stored as json like "/flow/nodes/{name}". The key
+// expires unless the node renews it, so crashed nodes leave the cluster.
+const nodePath string = "/nodes"
+
+// RegisterNode stores the node, the registration expires after ttl unless it
+// is renewed by registering the node again
+func (r *Registry) RegisterNode(node *api.Node, ttl time.Duration) error {
+	if errs := validation.ValidateNode(node); len(errs) > 0 {
+		return apierrors.NewInvalid(kindNode, node.Name, errs)
+	}
+	b, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	// etcd ttls are in seconds, round up so the key does not expire early
+	seconds := uint64((ttl + time.Second - 1) / time.Second)
+	if seconds == 0 {
+		seconds = 1
+	}
+	_, err = r.client.Set(makeEtcdNodeKey(node.Name), string(b), seconds)
+	return err
+}
+
+// GetNode retrieves a registered node
+func (r *Registry) GetNode(name string) (*api.Node, error) {
+	value, err := r.getValue(makeEtcdNodeKey(name))
+	if err != nil {
+		return nil, toStatusError(err, kindNode, name)
+	}
+	node := &api.Node{}
+	if err := json.Unmarshal([]byte(value), node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// GetNodes retrieves the registered nodes sorted by name
+func (r *Registry) GetNodes() ([]api.Node, error) {
+	nodes := make([]api.Node, 0)
+	kvList, err := r.getKeyValues(path.Join(root, nodePath))
+	if err != nil {
+		if isEtcdNotFound(err) {
+			return nodes, nil
+		}
+		return nodes, err
+	}
+	for _, kv := range kvList.list {
+		node := api.Node{}
+		if err := json.Unmarshal([]byte(kv.value), &node); err != nil {
+			return nodes, err
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Sort(nodesByName(nodes))
+	return nodes, nil
+}
+
+// DeleteNode removes the node from the cluster
+func (r *Registry) DeleteNode(name string) error {
+	if err := r.deleteKey(makeEtcdNodeKey(name)); err != nil {
+		return toStatusError(err, kindNode, name)
+	}
+	return nil
+}
+
+type nodesByName []api.Node
+
+func (n nodesByName) Len() int           { return len(n) }
+func (n nodesByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesByName) Less(i, j int) bool { return n[i].Name < n[j].Name }
+
+func makeEtcdNodeKey(name string) string {
+	return path.Join(root, nodePath, name)
+}
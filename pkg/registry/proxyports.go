@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"path"
+	"strconv"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// proxy ports assigned to service ports are stored as
+// "/flow/proxyports/{namespace}/{name}/{port}" so every flow node, and a
+// restarted node, proxies a service on the same port.
+const proxyPortPath string = "/proxyports"
+
+// unnamedPort is the key used for a service port without name, it can not
+// collide with a port name since port names are DNS labels.
+const unnamedPort = "_"
+
+// ClaimProxyPort stores proxyPort as the proxy port of the service port unless
+// a port is stored already. It returns the stored port.
+func (r *Registry) ClaimProxyPort(namespace, name, port string, proxyPort int) (int, error) {
+	key := makeEtcdProxyPortKey(namespace, name, port)
+	_, err := r.client.Create(key, strconv.Itoa(proxyPort), 0)
+	if err == nil {
+		return proxyPort, nil
+	}
+	if etcdErr, ok := err.(*etcd.EtcdError); !ok || etcdErr.ErrorCode != etcdErrNodeExist {
+		return 0, err
+	}
+	value, err := r.getValue(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// ReleaseProxyPort removes the proxy port stored for the service port
+func (r *Registry) ReleaseProxyPort(namespace, name, port string) error {
+	_, err := r.client.Delete(makeEtcdProxyPortKey(namespace, name, port), false)
+	if err != nil && !isEtcdNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func makeEtcdProxyPortKey(namespace, name, port string) string {
+	if port == "" {
+		port = unnamedPort
+	}
+	return path.Join(root, proxyPortPath, defaultNamespace(namespace), name, port)
+}
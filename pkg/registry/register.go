@@ -1,21 +1,26 @@
 package registry
 
 import (
+	"encoding/json"
 	"errors"
 	"net"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
+	"github.com/twanies/flow/api/validation"
 )
 
 const (
 	root         string = "/flow"
 	servicePath  string = "/services"
 	endpointPath string = "/endpoints"
+	specKey      string = "spec"
 
 	// keyspace where services register themself, telling the registry there are
 	// new, updated or deleted
@@ -23,23 +28,52 @@ const (
 	endpointsWatchPath string = root + "/register" + "/endpoints"
 )
 
+// Register stores services, endpoints and frontends scoped by namespace.
+// Objects without a namespace are stored in the default namespace, listing the
+// api.NamespaceAll namespace returns the objects of every namespace.
 type Register interface {
 	CreateService(service *api.Service) (*api.Service, error)
-	GetService(key string) (*api.Service, error)
-	GetServices() ([]api.Service, error)
+	GetService(namespace, name string) (*api.Service, error)
+	GetServices(namespace string) ([]api.Service, error)
+	UpdateService(service *api.Service) (*api.Service, error)
 	CreateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error)
-	GetServiceEndpoints(name string) (*api.Endpoints, error)
-	GetEndpoints() ([]api.Endpoints, error)
+	GetServiceEndpoints(namespace, name string) (*api.Endpoints, error)
+	GetEndpoints(namespace string) ([]api.Endpoints, error)
+	UpdateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error)
 	WatchServices(services chan []api.Service)
 	WatchEndpoints(endpoints chan []api.Endpoints)
-	DeleteService(name string) error
-	DeleteEndpoints(name string) error
+	DeleteService(namespace, name string) error
+	DeleteEndpoints(namespace, name string) error
+	CreateFrontend(frontend *api.FrontendSpec) (*api.FrontendSpec, error)
+	GetFrontend(namespace, name string) (*api.FrontendSpec, error)
+	GetFrontends(namespace string) ([]api.FrontendSpec, error)
+	UpdateFrontend(frontend *api.FrontendSpec) (*api.FrontendSpec, error)
+	WatchFrontends(frontends chan []api.FrontendSpec)
+	DeleteFrontend(namespace, name string) error
+	RegisterNode(node *api.Node, ttl time.Duration) error
+	GetNode(name string) (*api.Node, error)
+	GetNodes() ([]api.Node, error)
+	DeleteNode(name string) error
+	RenewEndpointLease(namespace, name string, lease *api.EndpointLease) (*api.EndpointLease, error)
+	ReleaseEndpointLease(namespace, name, address string) error
+	ExpireEndpointLeases(now time.Time) error
 }
 
 type Registry struct {
 	client *etcd.Client
 }
 
+// Config describes how to connect to the store
+type Config struct {
+	Machines []string
+
+	// CertFile and KeyFile are the client certificate presented to the store,
+	// CAFile is used to verify the certificate of the store.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
 // TODO: just a quick fix for now
 func NewRegistry() *Registry {
 	m := os.Getenv("FLOW_MACHINES")
@@ -51,43 +85,76 @@ func NewRegistry() *Registry {
 	return &Registry{client}
 }
 
-// CreateService stores a new service to the registry
-func (r *Registry) CreateService(service *api.Service) (*api.Service, error) {
-	kvList := keyValList{}
-	kvList.add("name", service.Name)
-	for _, kv := range kvList.list {
-		key := path.Join(makeEtcdServiceKey(service.Name), kv.key)
-		if err := r.setKey(key, kv.value); err != nil {
+// NewRegistryConfig returns a registry connecting to the store as described by
+// config. A client certificate requires both CertFile and KeyFile.
+func NewRegistryConfig(config Config) (*Registry, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("store client certificate requires both a certificate and a key file")
+	}
+	machines := config.Machines
+	if len(machines) == 0 {
+		machines = []string{"http://localhost:4001"}
+	}
+	if config.CertFile != "" {
+		client, err := etcd.NewTLSClient(machines, config.CertFile, config.KeyFile, config.CAFile)
+		if err != nil {
 			return nil, err
 		}
+		return &Registry{client}, nil
 	}
+	client := etcd.NewClient(machines)
+	if config.CAFile != "" {
+		if err := client.AddRootCA(config.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return &Registry{client}, nil
+}
+
+// CreateService stores a new service to the registry. It fails with an
+// Invalid error when the service does not pass validation and AlreadyExists when
+// a service with the same name is registered in the namespace.
+// services are stored as json like "/flow/services/{namespace}/{name}/spec"
+func (r *Registry) CreateService(service *api.Service) (*api.Service, error) {
+	out := *service
+	out.Namespace = defaultNamespace(service.Namespace)
+	if errs := validation.ValidateService(&out); len(errs) > 0 {
+		return nil, apierrors.NewInvalid(kindService, service.Name, errs)
+	}
+	out.ResourceVersion = 0
+	version, err := r.createObject(makeEtcdServiceKey(out.Namespace, out.Name), &out)
+	if err != nil {
+		return nil, toStatusError(err, kindService, out.Name)
+	}
+	out.ResourceVersion = version
 	// let the watchers know the service is successfully created
-	if err := r.setKey(serviceWatchPath, service.Name); err != nil {
+	if err := r.setKey(serviceWatchPath, path.Join(out.Namespace, out.Name)); err != nil {
 		return nil, err
 	}
-	return service, nil
+	return &out, nil
 }
 
 // GetService retrieves a service from the registry
-func (r *Registry) GetService(key string) (*api.Service, error) {
-	kvals, err := r.getKeyValues(key)
+func (r *Registry) GetService(namespace, name string) (*api.Service, error) {
+	service := &api.Service{}
+	version, err := r.getObject(makeEtcdServiceKey(defaultNamespace(namespace), name), service)
 	if err != nil {
-		return nil, err
-	}
-	service := &api.Service{
-		Name: kvals.get(key, "name"),
+		return nil, toStatusError(err, kindService, name)
 	}
+	service.ResourceVersion = version
 	return service, nil
 }
 
-func (r *Registry) GetServices() ([]api.Service, error) {
+// GetServices retrieves the services of a namespace, or of all namespaces when
+// namespace is api.NamespaceAll
+func (r *Registry) GetServices(namespace string) ([]api.Service, error) {
 	services := make([]api.Service, 0)
-	keys, err := r.getDirKeys(root, servicePath)
+	keys, err := r.getObjectKeys(servicePath, namespace)
 	if err != nil {
 		return services, err
 	}
 	for _, key := range keys {
-		service, err := r.GetService(key)
+		service, err := r.GetService(path.Base(path.Dir(key)), path.Base(key))
 		if err != nil {
 			return services, err
 		}
@@ -96,34 +163,70 @@ func (r *Registry) GetServices() ([]api.Service, error) {
 	return services, nil
 }
 
-func (r *Registry) DeleteService(name string) error {
-	keyspace := makeEtcdServiceKey(name)
+// UpdateService replaces a stored service. The ResourceVersion of the service
+// must match the stored version, otherwise a Conflict error is returned.
+func (r *Registry) UpdateService(service *api.Service) (*api.Service, error) {
+	out := *service
+	out.Namespace = defaultNamespace(service.Namespace)
+	if errs := validation.ValidateServiceUpdate(&out); len(errs) > 0 {
+		return nil, apierrors.NewInvalid(kindService, service.Name, errs)
+	}
+	out.ResourceVersion = 0
+	version, err := r.swapObject(makeEtcdServiceKey(out.Namespace, out.Name), &out, service.ResourceVersion)
+	if err != nil {
+		return nil, toStatusError(err, kindService, out.Name)
+	}
+	out.ResourceVersion = version
+	if err := r.setKey(serviceWatchPath, path.Join(out.Namespace, out.Name)); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (r *Registry) DeleteService(namespace, name string) error {
+	namespace = defaultNamespace(namespace)
+	keyspace := makeEtcdServiceKey(namespace, name)
 	_, err := r.client.Delete(keyspace, true)
 	if err != nil {
-		return err
+		return toStatusError(err, kindService, name)
 	}
 	// let the watchers know they need to reconfigure
-	if err := r.setKey(serviceWatchPath, name); err != nil {
+	if err := r.setKey(serviceWatchPath, path.Join(namespace, name)); err != nil {
 		return err
 	}
 	return nil
 }
 
 // CreateEndpoints stores endpoints implemented by a service
-// endpoints are stored like "/flow/endpoints/{name}/host:port"
+// endpoints are stored as json like "/flow/endpoints/{namespace}/{name}/spec"
 func (r *Registry) CreateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error) {
-	return nil, nil
+	out := *endpoints
+	out.Namespace = defaultNamespace(endpoints.Namespace)
+	if errs := validation.ValidateEndpoints(&out); len(errs) > 0 {
+		return nil, apierrors.NewInvalid(kindEndpoints, endpoints.Name, errs)
+	}
+	out.ResourceVersion = 0
+	version, err := r.createObject(makeEtcdEndpointsKey(out.Namespace, out.Name), &out)
+	if err != nil {
+		return nil, toStatusError(err, kindEndpoints, out.Name)
+	}
+	out.ResourceVersion = version
+	if err := r.setKey(endpointsWatchPath, path.Join(out.Namespace, out.Name)); err != nil {
+		return nil, err
+	}
+	return &out, nil
 }
 
-// GetEndpoints retrieves all endpoints stored in the registry
-func (r *Registry) GetEndpoints() ([]api.Endpoints, error) {
+// GetEndpoints retrieves the endpoints of a namespace, or of all namespaces
+// when namespace is api.NamespaceAll
+func (r *Registry) GetEndpoints(namespace string) ([]api.Endpoints, error) {
 	var allEndpoints []api.Endpoints
-	keys, err := r.getDirKeys(root, endpointPath)
+	keys, err := r.getObjectKeys(endpointPath, namespace)
 	if err != nil {
 		return allEndpoints, err
 	}
 	for _, key := range keys {
-		endpoints, err := r.GetServiceEndpoints(key)
+		endpoints, err := r.GetServiceEndpoints(path.Base(path.Dir(key)), path.Base(key))
 		if err != nil {
 			return allEndpoints, err
 		}
@@ -132,29 +235,91 @@ func (r *Registry) GetEndpoints() ([]api.Endpoints, error) {
 	return allEndpoints, nil
 }
 
-// GetServiceEndpoints retrieves the endpoints from a service by its keyspace
-func (r *Registry) GetServiceEndpoints(key string) (*api.Endpoints, error) {
-	return nil, nil
+// GetServiceEndpoints retrieves the endpoints from a service by its name
+func (r *Registry) GetServiceEndpoints(namespace, name string) (*api.Endpoints, error) {
+	endpoints := &api.Endpoints{}
+	version, err := r.getObject(makeEtcdEndpointsKey(defaultNamespace(namespace), name), endpoints)
+	if err != nil {
+		return nil, toStatusError(err, kindEndpoints, name)
+	}
+	endpoints.ResourceVersion = version
+	return endpoints, nil
 }
 
-func (r *Registry) DeleteEndpoints(name string) error {
-	keyspace := makeEtcdEndpointsKey(name)
+// UpdateEndpoints replaces the stored endpoints of a service. The
+// ResourceVersion must match the stored version.
+func (r *Registry) UpdateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error) {
+	out := *endpoints
+	out.Namespace = defaultNamespace(endpoints.Namespace)
+	if errs := validation.ValidateEndpointsUpdate(&out); len(errs) > 0 {
+		return nil, apierrors.NewInvalid(kindEndpoints, endpoints.Name, errs)
+	}
+	out.ResourceVersion = 0
+	version, err := r.swapObject(makeEtcdEndpointsKey(out.Namespace, out.Name), &out, endpoints.ResourceVersion)
+	if err != nil {
+		return nil, toStatusError(err, kindEndpoints, out.Name)
+	}
+	out.ResourceVersion = version
+	if err := r.setKey(endpointsWatchPath, path.Join(out.Namespace, out.Name)); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (r *Registry) DeleteEndpoints(namespace, name string) error {
+	namespace = defaultNamespace(namespace)
+	keyspace := makeEtcdEndpointsKey(namespace, name)
 	_, err := r.client.Delete(keyspace, true)
 	if err != nil {
-		return err
+		return toStatusError(err, kindEndpoints, name)
 	}
-	if err := r.setKey(endpointsWatchPath, name); err != nil {
+	if err := r.setKey(endpointsWatchPath, path.Join(namespace, name)); err != nil {
 		return err
 	}
 	return nil
 }
 
+// getObjectKeys returns the keyspaces of the objects stored under resourcePath
+// in the namespace, or in every namespace for api.NamespaceAll
+func (r *Registry) getObjectKeys(resourcePath, namespace string) ([]string, error) {
+	namespaces := []string{namespace}
+	if namespace == api.NamespaceAll {
+		var err error
+		namespaces, err = r.getDirKeys(root, resourcePath)
+		if err != nil {
+			if isEtcdNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	var keys []string
+	for _, ns := range namespaces {
+		nsKeys, err := r.getDirKeys(root, resourcePath, path.Base(ns))
+		if err != nil {
+			if isEtcdNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		keys = append(keys, nsKeys...)
+	}
+	return keys, nil
+}
+
+func defaultNamespace(namespace string) string {
+	if namespace == "" {
+		return api.NamespaceDefault
+	}
+	return namespace
+}
+
 func (r *Registry) WatchServices(servicesch chan []api.Service) {
 	resp := make(chan *etcd.Response)
 	go r.client.Watch(serviceWatchPath, 0, true, resp, nil)
 	for true {
 		<-resp
-		services, err := r.GetServices()
+		services, err := r.GetServices(api.NamespaceAll)
 		if err != nil {
 			panic(err)
 		}
@@ -167,7 +332,7 @@ func (r *Registry) WatchEndpoints(endpointsch chan []api.Endpoints) {
 	go r.client.Watch(endpointsWatchPath, 0, true, resp, nil)
 	for true {
 		<-resp
-		endpoints, err := r.GetEndpoints()
+		endpoints, err := r.GetEndpoints(api.NamespaceAll)
 		if err != nil {
 			panic(err)
 		}
@@ -190,6 +355,48 @@ func extractEndpointFromKey(key string) (string, int) {
 	return host, port
 }
 
+// object helper methods, objects are stored as json in the "spec" key of their
+// keyspace. The modified index of the spec key is the resource version of the
+// object.
+
+// createObject stores a new object, it fails when the object exists
+func (r *Registry) createObject(keyspace string, obj interface{}) (uint64, error) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.Create(path.Join(keyspace, specKey), string(b), 0)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+// getObject decodes the stored object into obj and returns its version
+func (r *Registry) getObject(keyspace string, obj interface{}) (uint64, error) {
+	resp, err := r.client.Get(path.Join(keyspace, specKey), false, false)
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal([]byte(resp.Node.Value), obj); err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+// swapObject replaces the stored object only when its version equals version
+func (r *Registry) swapObject(keyspace string, obj interface{}, version uint64) (uint64, error) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.CompareAndSwap(path.Join(keyspace, specKey), string(b), 0, "", version)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
 // etcd helper methods
 func (r *Registry) setKey(key, val string) error {
 	_, err := r.client.Set(key, val, 0)
@@ -281,10 +488,10 @@ func isDir(node *etcd.Node) bool {
 	return node.Dir && node != nil
 }
 
-func makeEtcdServiceKey(name string) string {
-	return path.Join(root, servicePath, name)
+func makeEtcdServiceKey(namespace, name string) string {
+	return path.Join(root, servicePath, namespace, name)
 }
 
-func makeEtcdEndpointsKey(name string) string {
-	return path.Join(root, endpointPath, name)
+func makeEtcdEndpointsKey(namespace, name string) string {
+	return path.Join(root, endpointPath, namespace, name)
 }
@@ -3,6 +3,10 @@ package registry
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+	apierrors "github.com/twanies/flow/api/errors"
 )
 
 func TestSetKeyGetValue(t *testing.T) {
@@ -76,3 +80,196 @@ func tearDown(t *testing.T, r *Registry) {
 	}
 	r.client.Close()
 }
+
+func TestCreateServiceTypedErrors(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	_, err := r.CreateService(&api.Service{Name: "flowtest"})
+	if !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an invalid error got %v", err)
+	}
+	service := &api.Service{
+		Name:  "flowtest",
+		Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}},
+	}
+	if _, err := r.CreateService(service); err != nil {
+		t.Fatal(err)
+	}
+	defer r.DeleteService(api.NamespaceDefault, "flowtest")
+	if _, err := r.CreateService(service); !apierrors.IsAlreadyExists(err) {
+		t.Fatalf("expected an already exists error got %v", err)
+	}
+}
+
+func TestGetServiceNotFound(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	if _, err := r.GetService(api.NamespaceDefault, "flowtest-missing"); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected a not found error got %v", err)
+	}
+	if err := r.DeleteService(api.NamespaceDefault, "flowtest-missing"); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected a not found error got %v", err)
+	}
+}
+
+func TestUpdateServiceResourceVersion(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	service, err := r.CreateService(&api.Service{
+		Name:  "flowtest",
+		Ports: []api.ServicePort{{Name: "a", Protocol: "TCP"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.DeleteService(api.NamespaceDefault, "flowtest")
+	stored, err := r.GetService(api.NamespaceDefault, "flowtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ResourceVersion != service.ResourceVersion {
+		t.Fatalf("expected version %d got %d", service.ResourceVersion, stored.ResourceVersion)
+	}
+
+	stale := *stored
+	stored.Ports[0].Port = 8080
+	updated, err := r.UpdateService(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ResourceVersion == stale.ResourceVersion {
+		t.Fatal("expected the resource version to change after an update")
+	}
+	if _, err := r.UpdateService(&stale); !apierrors.IsConflict(err) {
+		t.Fatalf("expected a conflict error got %v", err)
+	}
+	stale.ResourceVersion = 0
+	if _, err := r.UpdateService(&stale); !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an invalid error without resource version got %v", err)
+	}
+}
+
+func TestCreateGetEndpoints(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	endpoints := &api.Endpoints{
+		Name:      "flowtest",
+		Namespace: api.NamespaceDefault,
+		Addresses: []string{"127.0.0.1"},
+		Ports:     []api.EndpointPort{{Name: "a", Port: 8080}},
+	}
+	if _, err := r.CreateEndpoints(endpoints); err != nil {
+		t.Fatal(err)
+	}
+	defer r.DeleteEndpoints(api.NamespaceDefault, "flowtest")
+	stored, err := r.GetServiceEndpoints(api.NamespaceDefault, "flowtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ResourceVersion == 0 {
+		t.Fatal("expected the endpoints to have a resource version")
+	}
+	stored.ResourceVersion = 0
+	if !reflect.DeepEqual(endpoints, stored) {
+		t.Fatalf("expected %+v got %+v", endpoints, stored)
+	}
+}
+
+func TestServiceNamespaces(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	for _, ns := range []string{"flowtest-a", "flowtest-b"} {
+		_, err := r.CreateService(&api.Service{
+			Name:      "api",
+			Namespace: ns,
+			Ports:     []api.ServicePort{{Name: "a", Protocol: "TCP"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.DeleteService(ns, "api")
+	}
+	services, err := r.GetServices("flowtest-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Namespace != "flowtest-a" {
+		t.Fatalf("expected a single service in namespace flowtest-a got %+v", services)
+	}
+	services, err = r.GetServices(api.NamespaceAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, service := range services {
+		if service.Name == "api" {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("expected the service in both namespaces got %+v", services)
+	}
+}
+
+func TestClaimProxyPort(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	defer r.ReleaseProxyPort("flowtest", "api", "")
+
+	port, err := r.ClaimProxyPort("flowtest", "api", "", 2100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 2100 {
+		t.Fatalf("expected port 2100 got %d", port)
+	}
+	// a second node gets the port claimed by the first
+	port, err = r.ClaimProxyPort("flowtest", "api", "", 2200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 2100 {
+		t.Fatalf("expected the claimed port 2100 got %d", port)
+	}
+	if err := r.ReleaseProxyPort("flowtest", "api", ""); err != nil {
+		t.Fatal(err)
+	}
+	port, err = r.ClaimProxyPort("flowtest", "api", "", 2200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 2200 {
+		t.Fatalf("expected port 2200 after release got %d", port)
+	}
+}
+
+func TestRegisterNode(t *testing.T) {
+	r := NewRegistry()
+	defer r.client.Close()
+	for _, name := range []string{"flowtest-b", "flowtest-a"} {
+		if err := r.RegisterNode(&api.Node{Name: name, Address: "10.0.0.1"}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		defer r.DeleteNode(name)
+	}
+	nodes, err := r.GetNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"flowtest-a", "flowtest-b"}) {
+		t.Fatalf("expected the nodes sorted by name got %v", names)
+	}
+	if err := r.RegisterNode(&api.Node{Name: "flowtest-c"}, time.Minute); !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an invalid error without address got %v", err)
+	}
+	if err := r.DeleteNode("flowtest-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetNode("flowtest-a"); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected a not found error got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Package tlsutil loads certificates for flow's listeners and reloads them when
+// the files on disk change, so certificates can be rotated without a restart.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCheckInterval is the minimum time between two checks of the
+// certificate files for changes.
+const DefaultCheckInterval = 5 * time.Second
+
+// CertReloader serves a certificate and key pair loaded from files. The files
+// are checked for changes at most once per CheckInterval when a certificate is
+// requested and reloaded when their modification time changed. When reloading
+// fails the previous certificate is kept.
+type CertReloader struct {
+	CheckInterval time.Duration
+
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+	now       func() time.Time
+}
+
+// NewCertReloader loads the certificate and key from certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		CheckInterval: DefaultCheckInterval,
+		certFile:      certFile,
+		keyFile:       keyFile,
+		now:           time.Now,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) load() error {
+	certMod, keyMod, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.certMod, c.keyMod = certMod, keyMod
+	c.lastCheck = c.now()
+	return nil
+}
+
+func (c *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// Reload checks the certificate files and reloads the certificate when one of
+// them changed.
+func (c *CertReloader) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reload()
+}
+
+func (c *CertReloader) reload() error {
+	c.lastCheck = c.now()
+	certMod, keyMod, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	if certMod.Equal(c.certMod) && keyMod.Equal(c.keyMod) {
+		return nil
+	}
+	return c.load()
+}
+
+// Certificate returns the current certificate, reloading it first when the
+// files changed since the last check.
+func (c *CertReloader) Certificate() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.now().Sub(c.lastCheck) >= c.CheckInterval {
+		if err := c.reload(); err != nil {
+			log.Printf("failed to reload certificate %s, keeping the current one: %v", c.certFile, err)
+		}
+	}
+	return c.cert
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// LoadCertPool reads the PEM encoded certificates in file into a pool
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns the tls configuration of a listener serving the
+// certificate in certFile and keyFile, reloaded when the files change. When
+// clientCAFile is set client certificates are verified against it. Clients
+// without a certificate are still accepted, it is up to the authenticator to
+// require one.
+func ServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls requires both a certificate and a key file")
+	}
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// ClientConfig returns the tls configuration of a client presenting the
+// certificate in certFile and keyFile, when set, and verifying the server
+// against the certificates in caFile instead of the system roots, when set.
+func ClientConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a client certificate requires both a certificate and a key file")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
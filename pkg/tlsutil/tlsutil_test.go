@@ -0,0 +1,117 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self signed certificate for cn to dir
+func writeCert(t *testing.T, dir, cn string, mod time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, c *CertReloader) string {
+	cert, err := x509.ParseCertificate(c.Certificate().Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	certFile, keyFile := writeCert(t, dir, "one", start.Add(-time.Minute))
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := c.lastCheck
+	c.now = func() time.Time { return now }
+	if cn := commonName(t, c); cn != "one" {
+		t.Fatalf("expected certificate one got %s", cn)
+	}
+
+	writeCert(t, dir, "two", start)
+	if cn := commonName(t, c); cn != "one" {
+		t.Fatalf("expected the certificate not to be reloaded before the check interval, got %s", cn)
+	}
+	now = now.Add(c.CheckInterval)
+	if cn := commonName(t, c); cn != "two" {
+		t.Fatalf("expected certificate two got %s", cn)
+	}
+
+	// a broken certificate keeps the current one
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	os.Chtimes(certFile, start.Add(time.Minute), start.Add(time.Minute))
+	now = now.Add(c.CheckInterval)
+	if cn := commonName(t, c); cn != "two" {
+		t.Fatalf("expected to keep certificate two got %s", cn)
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCert(t, dir, "flow", time.Now())
+
+	if _, err := ServerConfig(certFile, "", ""); err == nil {
+		t.Fatal("expected a missing key to fail")
+	}
+	config, err := ServerConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientCAs == nil || config.GetCertificate == nil {
+		t.Fatal("expected client CAs and a certificate")
+	}
+	if _, err := ServerConfig(certFile, keyFile, keyFile); err == nil {
+		t.Fatal("expected a CA file without certificates to fail")
+	}
+}
@@ -0,0 +1,46 @@
+// Package yamljson converts values decoded from YAML or TOML into JSON, so
+// files in those formats can be decoded into types with json field names.
+package yamljson
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Marshal returns the JSON encoding of a value decoded by yaml or toml
+func Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(Value(v))
+}
+
+// Value converts the maps decoded by yaml, which have interface{} keys, and
+// the arrays of tables decoded by toml into values which can be encoded as json
+func Value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = Value(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = Value(value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = Value(value)
+		}
+		return s
+	case []map[string]interface{}:
+		// toml decodes arrays of tables like this
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = Value(value)
+		}
+		return s
+	}
+	return v
+}
@@ -0,0 +1,30 @@
+package yamljson
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMarshal(t *testing.T) {
+	// json sorts the keys of maps
+	expected := `{"labels":{"1":"one"},"ports":[{"name":"http","port":80}]}`
+	var fromYAML interface{}
+	if err := yaml.Unmarshal([]byte("ports:\n- name: http\n  port: 80\nlabels:\n  1: one\n"), &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+	fromTOML := map[string]interface{}{}
+	if _, err := toml.Decode("[[ports]]\nname = \"http\"\nport = 80\n[labels]\n1 = \"one\"\n", &fromTOML); err != nil {
+		t.Fatal(err)
+	}
+	for format, raw := range map[string]interface{}{"yaml": fromYAML, "toml": fromTOML} {
+		b, err := Marshal(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if string(b) != expected {
+			t.Errorf("%s: expected %s, got %s", format, expected, b)
+		}
+	}
+}
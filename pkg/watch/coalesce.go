@@ -0,0 +1,109 @@
+package watch
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultWindow is the quiet period a watcher waits for before it passes a
+	// burst of updates to its handler
+	DefaultWindow = 100 * time.Millisecond
+
+	// DefaultMaxDelay is the maximum time an update can be held back while the
+	// store keeps sending changes
+	DefaultMaxDelay = time.Second
+)
+
+// Stats holds the counters of a watcher
+type Stats struct {
+	// Events is the number of updates received from the store
+	Events uint64 `json:"events"`
+
+	// Updates is the number of consolidated updates passed to the handler
+	Updates uint64 `json:"updates"`
+
+	// Merged is the number of events that were folded into another update
+	Merged uint64 `json:"merged"`
+}
+
+// coalescer groups bursts of events. Every event (re)arms a timer that fires
+// after window, but never later than maxDelay after the first pending event.
+// Only the goroutine running the watch loop may call add, ready and flush.
+type coalescer struct {
+	window   time.Duration
+	maxDelay time.Duration
+
+	timer   *time.Timer
+	first   time.Time
+	pending uint64
+
+	// counters, atomicly updated
+	events  uint64
+	updates uint64
+	merged  uint64
+}
+
+// add records a new event and rearms the timer
+func (c *coalescer) add() {
+	atomic.AddUint64(&c.events, 1)
+	now := time.Now()
+	if c.pending == 0 {
+		c.first = now
+	}
+	c.pending++
+
+	wait := c.window
+	if c.maxDelay > 0 {
+		if left := c.first.Add(c.maxDelay).Sub(now); left < wait {
+			wait = left
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if c.timer == nil {
+		c.timer = time.NewTimer(wait)
+		return
+	}
+	if !c.timer.Stop() {
+		select {
+		case <-c.timer.C:
+		default:
+		}
+	}
+	c.timer.Reset(wait)
+}
+
+// ready returns a channel that fires when the pending events need to be
+// flushed. It returns nil when nothing is pending.
+func (c *coalescer) ready() <-chan time.Time {
+	if c.pending == 0 || c.timer == nil {
+		return nil
+	}
+	return c.timer.C
+}
+
+// flush marks the pending events as delivered
+func (c *coalescer) flush() {
+	if c.pending == 0 {
+		return
+	}
+	atomic.AddUint64(&c.updates, 1)
+	atomic.AddUint64(&c.merged, c.pending-1)
+	c.pending = 0
+}
+
+func (c *coalescer) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+func (c *coalescer) stats() Stats {
+	return Stats{
+		Events:  atomic.LoadUint64(&c.events),
+		Updates: atomic.LoadUint64(&c.updates),
+		Merged:  atomic.LoadUint64(&c.merged),
+	}
+}
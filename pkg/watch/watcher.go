@@ -1,6 +1,8 @@
 package watch
 
 import (
+	"time"
+
 	"github.com/twanies/flow/api"
 	"github.com/twanies/flow/pkg/registry"
 )
@@ -17,16 +19,28 @@ type ServiceUpdate struct {
 }
 
 // ServiceWatcher watches for changes in the registry, it invokes the update handler
-// Update method when a change is detected
+// Update method when a change is detected. Changes arriving within Window of
+// each other are coalesced into a single update, which is delayed no longer
+// than MaxDelay.
 type ServiceWatcher struct {
+	Window   time.Duration
+	MaxDelay time.Duration
+
 	store   registry.Register
 	handler ServiceUpdateHandler
+	burst   coalescer
 }
 
 func NewServiceWatcher() *ServiceWatcher {
-	store := registry.NewRegistry()
+	return NewServiceWatcherWithStore(registry.NewRegistry())
+}
+
+// NewServiceWatcherWithStore returns a watcher watching store
+func NewServiceWatcherWithStore(store registry.Register) *ServiceWatcher {
 	return &ServiceWatcher{
-		store: store,
+		Window:   DefaultWindow,
+		MaxDelay: DefaultMaxDelay,
+		store:    store,
 	}
 }
 
@@ -38,9 +52,36 @@ func (sw *ServiceWatcher) RegisterHandler(handler ServiceUpdateHandler) {
 func (sw *ServiceWatcher) WatchForUpdates() {
 	serviceUpdate := make(chan []api.Service)
 	go sw.store.WatchServices(serviceUpdate)
-	for true {
-		services := <-serviceUpdate
-		sw.handler.Update(services)
+	sw.watch(serviceUpdate)
+}
+
+// Stats returns the event counters of the watcher
+func (sw *ServiceWatcher) Stats() Stats {
+	return sw.burst.stats()
+}
+
+// watch delivers the latest services received on updates to the handler once
+// a burst is over. Pending changes are flushed when updates is closed.
+func (sw *ServiceWatcher) watch(updates <-chan []api.Service) {
+	sw.burst.window, sw.burst.maxDelay = sw.Window, sw.MaxDelay
+	defer sw.burst.stop()
+	var latest []api.Service
+	for {
+		select {
+		case services, ok := <-updates:
+			if !ok {
+				if sw.burst.pending > 0 {
+					sw.burst.flush()
+					sw.handler.Update(latest)
+				}
+				return
+			}
+			latest = services
+			sw.burst.add()
+		case <-sw.burst.ready():
+			sw.burst.flush()
+			sw.handler.Update(latest)
+		}
 	}
 }
 
@@ -48,14 +89,28 @@ type EndpointUpdateHandler interface {
 	Update(endpoints []api.Endpoints)
 }
 
+// EndpointWatcher watches the registry for changes in endpoints and coalesces
+// them the same way as the ServiceWatcher
 type EndpointWatcher struct {
+	Window   time.Duration
+	MaxDelay time.Duration
+
 	store   registry.Register
 	handler EndpointUpdateHandler
+	burst   coalescer
 }
 
 func NewEndpointWatcher() *EndpointWatcher {
-	store := registry.NewRegistry()
-	return &EndpointWatcher{store: store}
+	return NewEndpointWatcherWithStore(registry.NewRegistry())
+}
+
+// NewEndpointWatcherWithStore returns a watcher watching store
+func NewEndpointWatcherWithStore(store registry.Register) *EndpointWatcher {
+	return &EndpointWatcher{
+		Window:   DefaultWindow,
+		MaxDelay: DefaultMaxDelay,
+		store:    store,
+	}
 }
 
 func (ew *EndpointWatcher) RegisterHandler(handler EndpointUpdateHandler) {
@@ -66,8 +121,97 @@ func (ew *EndpointWatcher) RegisterHandler(handler EndpointUpdateHandler) {
 func (ew *EndpointWatcher) WatchForUpdates() {
 	endpointsUpdate := make(chan []api.Endpoints)
 	go ew.store.WatchEndpoints(endpointsUpdate)
-	for true {
-		endpoints := <-endpointsUpdate
-		ew.handler.Update(endpoints)
+	ew.watch(endpointsUpdate)
+}
+
+// Stats returns the event counters of the watcher
+func (ew *EndpointWatcher) Stats() Stats {
+	return ew.burst.stats()
+}
+
+func (ew *EndpointWatcher) watch(updates <-chan []api.Endpoints) {
+	ew.burst.window, ew.burst.maxDelay = ew.Window, ew.MaxDelay
+	defer ew.burst.stop()
+	var latest []api.Endpoints
+	for {
+		select {
+		case endpoints, ok := <-updates:
+			if !ok {
+				if ew.burst.pending > 0 {
+					ew.burst.flush()
+					ew.handler.Update(latest)
+				}
+				return
+			}
+			latest = endpoints
+			ew.burst.add()
+		case <-ew.burst.ready():
+			ew.burst.flush()
+			ew.handler.Update(latest)
+		}
+	}
+}
+
+// FrontendUpdateHandler handles the frontends mapping HTTP requests to services
+type FrontendUpdateHandler interface {
+	Update(frontends []api.FrontendSpec)
+}
+
+// FrontendWatcher watches the registry for changes in frontends and coalesces
+// them the same way as the ServiceWatcher
+type FrontendWatcher struct {
+	Window   time.Duration
+	MaxDelay time.Duration
+
+	store   registry.Register
+	handler FrontendUpdateHandler
+	burst   coalescer
+}
+
+// NewFrontendWatcherWithStore returns a watcher watching store
+func NewFrontendWatcherWithStore(store registry.Register) *FrontendWatcher {
+	return &FrontendWatcher{
+		Window:   DefaultWindow,
+		MaxDelay: DefaultMaxDelay,
+		store:    store,
+	}
+}
+
+func (fw *FrontendWatcher) RegisterHandler(handler FrontendUpdateHandler) {
+	fw.handler = handler
+	go fw.WatchForUpdates()
+}
+
+func (fw *FrontendWatcher) WatchForUpdates() {
+	frontendsUpdate := make(chan []api.FrontendSpec)
+	go fw.store.WatchFrontends(frontendsUpdate)
+	fw.watch(frontendsUpdate)
+}
+
+// Stats returns the event counters of the watcher
+func (fw *FrontendWatcher) Stats() Stats {
+	return fw.burst.stats()
+}
+
+func (fw *FrontendWatcher) watch(updates <-chan []api.FrontendSpec) {
+	fw.burst.window, fw.burst.maxDelay = fw.Window, fw.MaxDelay
+	defer fw.burst.stop()
+	var latest []api.FrontendSpec
+	for {
+		select {
+		case frontends, ok := <-updates:
+			if !ok {
+				if fw.burst.pending > 0 {
+					fw.burst.flush()
+					fw.handler.Update(latest)
+				}
+				return
+			}
+			latest = frontends
+			fw.burst.add()
+		case <-fw.burst.ready():
+			fw.burst.flush()
+			fw.handler.Update(latest)
+		}
 	}
 }
@@ -1 +1,95 @@
 package watch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/twanies/flow/api"
+)
+
+type fakeEndpointHandler struct {
+	updates chan []api.Endpoints
+}
+
+func (f *fakeEndpointHandler) Update(endpoints []api.Endpoints) {
+	f.updates <- endpoints
+}
+
+func newTestEndpointWatcher(window, maxDelay time.Duration) (*EndpointWatcher, *fakeEndpointHandler) {
+	handler := &fakeEndpointHandler{make(chan []api.Endpoints, 100)}
+	ew := &EndpointWatcher{
+		Window:   window,
+		MaxDelay: maxDelay,
+		handler:  handler,
+	}
+	return ew, handler
+}
+
+func TestCoalesceBurst(t *testing.T) {
+	ew, handler := newTestEndpointWatcher(50*time.Millisecond, time.Second)
+	updates := make(chan []api.Endpoints)
+	go ew.watch(updates)
+
+	for i := 0; i < 50; i++ {
+		updates <- []api.Endpoints{api.Endpoints{Name: fmt.Sprintf("foo%d", i)}}
+	}
+	select {
+	case endpoints := <-handler.updates:
+		if endpoints[0].Name != "foo49" {
+			t.Fatalf("expected the latest update (foo49) got %s", endpoints[0].Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the coalesced update")
+	}
+	close(updates)
+
+	select {
+	case <-handler.updates:
+		t.Fatal("expected a single update for the burst")
+	case <-time.After(100 * time.Millisecond):
+	}
+	stats := ew.Stats()
+	if stats.Events != 50 || stats.Updates != 1 || stats.Merged != 49 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCoalesceMaxDelay(t *testing.T) {
+	ew, handler := newTestEndpointWatcher(50*time.Millisecond, 150*time.Millisecond)
+	updates := make(chan []api.Endpoints)
+	go ew.watch(updates)
+	defer close(updates)
+
+	start := time.Now()
+	stop := time.After(time.Second)
+	for {
+		select {
+		case <-handler.updates:
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Fatalf("update delayed for %s, expected at most the max delay", elapsed)
+			}
+			return
+		case <-stop:
+			t.Fatal("max delay did not flush the pending updates")
+		case <-time.After(10 * time.Millisecond):
+			updates <- []api.Endpoints{}
+		}
+	}
+}
+
+func TestCoalesceFlushOnClose(t *testing.T) {
+	ew, handler := newTestEndpointWatcher(time.Hour, time.Hour)
+	updates := make(chan []api.Endpoints)
+	done := make(chan bool)
+	go func() {
+		ew.watch(updates)
+		done <- true
+	}()
+	updates <- []api.Endpoints{api.Endpoints{Name: "foo"}}
+	close(updates)
+	<-done
+	if len(handler.updates) != 1 {
+		t.Fatalf("expected pending update to be flushed, got %d updates", len(handler.updates))
+	}
+}